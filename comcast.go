@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net"
 	"os"
+	"os/user"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/tylertreat/comcast/throttler"
 )
@@ -14,21 +17,57 @@ import (
 const version = "1.0.0"
 
 func main() {
-	// TODO: Add support for other options like packet reordering, duplication, etc.
-	var (
-		device      = flag.String("device", "", "Interface (device) to use (defaults to eth0 where applicable)")
-		stop        = flag.Bool("stop", false, "Stop packet controls")
-		latency     = flag.Int("latency", -1, "Latency to add in ms")
-		targetbw    = flag.Int("target-bw", -1, "Target bandwidth limit in kbit/s (slow-lane)")
-		defaultbw   = flag.Int("default-bw", -1, "Default bandwidth limit in kbit/s (fast-lane)")
-		packetLoss  = flag.String("packet-loss", "0", "Packet loss percentage (e.g. 0.1%)")
-		targetaddr  = flag.String("target-addr", "", "Target addresses, (e.g. 10.0.0.1 or 10.0.0.0/24 or 10.0.0.1,192.168.0.0/24 or 2001:db8:a::123)")
-		targetport  = flag.String("target-port", "", "Target port(s) (e.g. 80 or 1:65535 or 22,80,443,1000:1010)")
-		targetproto = flag.String("target-proto", "tcp,udp,icmp", "Target protocol TCP/UDP (e.g. tcp or tcp,udp or icmp)")
-		dryrun      = flag.Bool("dry-run", false, "Specifies whether or not to actually commit the rule changes")
-		//icmptype  = flag.String("icmp-type", "", "icmp message type (e.g. reply or reply,request)") //TODO: Maybe later :3
-		vers = flag.Bool("version", false, "Print Comcast's version")
-	)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "serve":
+			serve(os.Args[2:])
+			return
+		case "exec":
+			execCommand(os.Args[2:])
+			return
+		case "partition":
+			partition(os.Args[2:])
+			return
+		case "replay":
+			replay(os.Args[2:])
+			return
+		case "record":
+			record(os.Args[2:])
+			return
+		case "echo":
+			echo(os.Args[2:])
+			return
+		case "doctor":
+			doctor(os.Args[2:])
+			return
+		case "export":
+			export(os.Args[2:])
+			return
+		case "plan":
+			plan(os.Args[2:])
+			return
+		case "apply":
+			apply(os.Args[2:])
+			return
+		}
+	}
+
+	stop := flag.Bool("stop", false, "Stop packet controls")
+	metrics := flag.String("metrics-listen", "", "Stay in the foreground serving Prometheus metrics on this address (e.g. :9090) until interrupted")
+	vers := flag.Bool("version", false, "Print Comcast's version")
+	flapSched := flag.String("flap", "", "Stay in the foreground taking the link down and up again, given as up:down periods (e.g. 10s:2s)")
+	flapJitter := flag.Float64("flap-jitter", 0, "Randomize each flap period by up to this fraction of it (e.g. 0.2)")
+	flapSeed := flag.Int64("flap-seed", 0, "Seed for --flap-jitter, to repeat a run (default random)")
+	bwPattern := flag.String("bandwidth-pattern", "", "Stay in the foreground varying the target bandwidth in kbit/s: ramp:<from>:<to>:<duration>, sine:<mid>:<amplitude>:<period> or walk:<start>:<step>:<min>:<max> (e.g. ramp:5000:500:60s)")
+	latPattern := flag.String("latency-pattern", "", "Stay in the foreground varying the latency in ms, like --bandwidth-pattern")
+	lossPattern := flag.String("loss-pattern", "", "Stay in the foreground varying the packet loss percentage, like --bandwidth-pattern")
+	patternSeed := flag.Int64("pattern-seed", 0, "Seed for walk patterns, to repeat a run (default random)")
+	tick := flag.Duration("tick", time.Second, "How often patterns update the shaping")
+	verify := flag.String("verify", "", "Check the rules took effect by probing this target before and after setup: a host to ping, host:port for TCP connects, or local for an echo endpoint comcast serves on the loopback device")
+	verifyMethod := flag.String("verify-method", "", "Probe --verify with icmp, tcp connects or udp to a comcast echo endpoint")
+	verifyProbes := flag.Int("verify-probes", 50, "Probes to send each time for --verify")
+	verifyTolerance := flag.Duration("verify-tolerance", 10*time.Millisecond, "How far the latency measured by --verify may be off, on top of 10% of it")
+	flags := newConfigFlags(flag.CommandLine)
 	flag.Parse()
 
 	if *vers {
@@ -36,21 +75,171 @@ func main() {
 		return
 	}
 
-	targetIPv4, targetIPv6 := parseAddrs(*targetaddr)
+	cfg := flags.config()
+	cfg.Stop = *stop
+
+	base := cfg
+	var gen *throttler.Generated
+	if (*bwPattern != "" || *latPattern != "" || *lossPattern != "") && !*stop {
+		if *flapSched != "" {
+			fmt.Println("Use either --flap or patterns, not both")
+			os.Exit(1)
+		}
+		seed := *patternSeed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		gen = &throttler.Generated{
+			Bandwidth:  parsePattern(*bwPattern, seed, *tick),
+			Latency:    parsePattern(*latPattern, seed+1, *tick),
+			PacketLoss: parsePattern(*lossPattern, seed+2, *tick),
+		}
+
+		// Start out shaped like the beginning of the patterns
+		first, _ := gen.Sample(0)
+		cfg = throttler.ApplySample(cfg, first)
+	}
+
+	var v *verifier
+	stopEcho := func() {}
+	if *verify != "" && !*stop && !cfg.DryRun {
+		if *flapSched != "" && cfg.Partition != "" {
+			fmt.Println("A flapping partition starts without rules, so there's nothing to --verify")
+			os.Exit(1)
+		}
+		target, method := *verify, *verifyMethod
+		if target == verifyLocal {
+			echoCtx, cancel := context.WithCancel(context.Background())
+			stopEcho = cancel
+			target = localEcho(echoCtx, cfg)
+			if method == "" {
+				method = "udp"
+			}
+		}
+		v = newVerifier(cfg, target, parseProber(target, method), *verifyProbes, *verifyTolerance)
+	}
+
+	// A flapping partition starts up, so its rules are only added when it
+	// first goes down
+	if *flapSched == "" || cfg.Partition == "" || *stop {
+		throttler.Run(cfg)
+	}
+
+	if *stop {
+		return
+	}
+
+	if v != nil {
+		ok := v.check(cfg)
+		stopEcho()
+		if !ok {
+			fmt.Println("Removing the packet rules again")
+			if err := throttler.Teardown(cfg); err != nil && err != throttler.ErrNotSetup {
+				fmt.Printf("Couldn't remove them, run `%s --device %s --stop` to: %s\n", os.Args[0], cfg.Device, err)
+			}
+			os.Exit(1)
+		}
+	}
+
+	if *flapSched != "" {
+		s := parseFlap(*flapSched)
+		s.Jitter = *flapJitter
+		s.Seed = *flapSeed
+		if s.Seed == 0 {
+			s.Seed = time.Now().UnixNano()
+		}
+		foreground(cfg, *metrics, func(ctx context.Context, current *throttler.Applied) error {
+			return throttler.Flap(ctx, cfg, s, current)
+		})
+	} else if gen != nil {
+		foreground(cfg, *metrics, func(ctx context.Context, current *throttler.Applied) error {
+			return throttler.Replay(ctx, base, gen, *tick, current)
+		})
+	} else if *metrics != "" {
+		foreground(cfg, *metrics, nil)
+	}
+}
 
-	throttler.Run(&throttler.Config{
-		Device:           *device,
-		Stop:             *stop,
-		Latency:          *latency,
-		TargetBandwidth:  *targetbw,
-		DefaultBandwidth: *defaultbw,
-		PacketLoss:       parseLoss(*packetLoss),
+// configFlags are the flags describing a throttler.Config, shared by the
+// commands that apply one.
+type configFlags struct {
+	device      *string
+	latency     *int
+	targetbw    *int
+	defaultbw   *int
+	packetLoss  *string
+	targetaddr  *string
+	targetport  *string
+	targetproto *string
+	targetcg    *string
+	targetuid   *string
+	targetgid   *string
+	targetpid   *string
+	partition   *string
+	reject      *bool
+	matrix      *string
+	regions     *string
+	dryrun      *bool
+	privilege   *string
+	targetOS    *string
+	backend     *string
+}
+
+const privilegeUsage = "How to get the privileges to change packet rules: auto, none, sudo, doas, or a custom command prefix (e.g. \"sudo -n\")"
+
+func newConfigFlags(fs *flag.FlagSet) *configFlags {
+	// TODO: Add support for other options like packet reordering, duplication, etc.
+	return &configFlags{
+		device:      fs.String("device", "", "Interface (device) to use (defaults to eth0 where applicable)"),
+		latency:     fs.Int("latency", -1, "Latency to add in ms"),
+		targetbw:    fs.Int("target-bw", -1, "Target bandwidth limit in kbit/s (slow-lane)"),
+		defaultbw:   fs.Int("default-bw", -1, "Default bandwidth limit in kbit/s (fast-lane)"),
+		packetLoss:  fs.String("packet-loss", "0", "Packet loss percentage (e.g. 0.1%)"),
+		targetaddr:  fs.String("target-addr", "", "Target addresses, (e.g. 10.0.0.1 or 10.0.0.0/24 or 10.0.0.1,192.168.0.0/24 or 2001:db8:a::123)"),
+		targetport:  fs.String("target-port", "", "Target port(s) (e.g. 80 or 1:65535 or 22,80,443,1000:1010)"),
+		targetproto: fs.String("target-proto", "tcp,udp,icmp", "Target protocol TCP/UDP (e.g. tcp or tcp,udp or icmp)"),
+		targetcg:    fs.String("target-cgroup", "", "Target traffic sent from cgroup v2 path(s) (e.g. system.slice/nginx.service)"),
+		targetuid:   fs.String("target-uid", "", "Target traffic sent by user(s) (e.g. 1000 or www-data,1001)"),
+		targetgid:   fs.String("target-gid", "", "Target traffic sent by group(s) (e.g. 1000 or www-data,1001)"),
+		targetpid:   fs.String("target-pid", "", "Target traffic sent from the cgroup of process(es) (e.g. 4242 or 4242,4343)"),
+		partition:   fs.String("partition", "", "Blackhole traffic to and from the target addresses instead of shaping it: both, in (from targets) or out (to targets)"),
+		reject:      fs.Bool("partition-reject", false, "Reject partitioned traffic instead of silently dropping it"),
+		matrix:      fs.String("matrix", "", "Latency matrix file with per-destination impairments, or builtin:<region> for typical inter-region RTTs (e.g. builtin:us-east)"),
+		regions:     fs.String("regions", "", "Addresses of the other regions for a built-in matrix (e.g. eu-west=10.0.2.0/24,ap-south=10.0.3.0/24)"),
+		dryrun:      fs.Bool("dry-run", false, "Specifies whether or not to actually commit the rule changes"),
+		privilege:   fs.String("privilege", throttler.PrivilegeAuto, privilegeUsage),
+		targetOS:    fs.String("target-os", "", "Generate the rules of another OS (linux, darwin or freebsd), with --dry-run or export"),
+		backend:     fs.String("backend", "", "Use a given backend ("+strings.Join(throttler.Backends(), ", ")+") instead of the OS's default, generating its rules when it doesn't run here"),
+		//icmptype:  fs.String("icmp-type", "", "icmp message type (e.g. reply or reply,request)"), //TODO: Maybe later :3
+	}
+}
+
+// config builds the throttler.Config for the parsed flags, exiting on
+// invalid values.
+func (f *configFlags) config() *throttler.Config {
+	targetIPv4, targetIPv6 := parseAddrs(*f.targetaddr)
+
+	return &throttler.Config{
+		Device:           *f.device,
+		Latency:          *f.latency,
+		TargetBandwidth:  *f.targetbw,
+		DefaultBandwidth: *f.defaultbw,
+		PacketLoss:       parseLoss(*f.packetLoss),
 		TargetIps:        targetIPv4,
 		TargetIps6:       targetIPv6,
-		TargetPorts:      parsePorts(*targetport),
-		TargetProtos:     parseProtos(*targetproto),
-		DryRun:           *dryrun,
-	})
+		TargetPorts:      parsePorts(*f.targetport),
+		TargetProtos:     parseProtos(*f.targetproto),
+		TargetCgroups:    append(parseCgroups(*f.targetcg), parsePids(*f.targetpid)...),
+		TargetUids:       parseOwners(*f.targetuid, "user"),
+		TargetGids:       parseOwners(*f.targetgid, "group"),
+		Links:            parseMatrix(*f.matrix, *f.regions),
+		Partition:        parsePartition(*f.partition),
+		PartitionReject:  *f.reject,
+		DryRun:           *f.dryrun,
+		Privilege:        *f.privilege,
+		TargetOS:         *f.targetOS,
+		Backend:          *f.backend,
+	}
 }
 
 func parseLoss(loss string) float64 {
@@ -66,6 +255,86 @@ func parseLoss(loss string) float64 {
 	return l
 }
 
+func parseFlap(sched string) throttler.FlapSchedule {
+	parts := strings.Split(sched, ":")
+	if len(parts) == 2 {
+		up, err := time.ParseDuration(parts[0])
+		if err == nil {
+			down, err := time.ParseDuration(parts[1])
+			if err == nil && up > 0 && down > 0 {
+				return throttler.FlapSchedule{Up: up, Down: down}
+			}
+		}
+	}
+
+	fmt.Println("Incorrectly specified flap schedule:", sched)
+	os.Exit(1)
+	return throttler.FlapSchedule{}
+}
+
+func parsePattern(pattern string, seed int64, tick time.Duration) throttler.Generator {
+	if pattern == "" {
+		return nil
+	}
+
+	gen, err := throttler.ParseGenerator(pattern, seed, tick)
+	if err != nil {
+		fmt.Println("Incorrectly specified pattern:", err)
+		os.Exit(1)
+	}
+	return gen
+}
+
+func parsePartition(direction string) string {
+	switch direction {
+	case "", throttler.PartitionBoth, throttler.PartitionIn, throttler.PartitionOut:
+		return direction
+	}
+
+	fmt.Println("Incorrectly specified partition direction:", direction)
+	os.Exit(1)
+	return ""
+}
+
+func parseMatrix(matrix, regions string) []throttler.Link {
+	if matrix == "" {
+		return nil
+	}
+
+	if strings.HasPrefix(matrix, "builtin:") {
+		dests := map[string]string{}
+		for _, r := range strings.Split(regions, ",") {
+			kv := strings.SplitN(r, "=", 2)
+			if len(kv) != 2 {
+				fmt.Println("Incorrectly specified region address:", r)
+				os.Exit(1)
+			}
+			dests[kv[0]] = kv[1]
+		}
+
+		links, err := throttler.BuiltinMatrix(strings.TrimPrefix(matrix, "builtin:"), dests)
+		if err != nil {
+			fmt.Println("Incorrectly specified regions:", err)
+			os.Exit(1)
+		}
+		return links
+	}
+
+	f, err := os.Open(matrix)
+	if err != nil {
+		fmt.Println("Couldn't read latency matrix:", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	links, err := throttler.ParseMatrix(f)
+	if err != nil {
+		fmt.Println("Incorrectly specified latency matrix:", err)
+		os.Exit(1)
+	}
+	return links
+}
+
 func parseAddrs(addrs string) ([]string, []string) {
 	adrs := strings.Split(addrs, ",")
 	parsedIPv4 := []string{}
@@ -99,6 +368,75 @@ func parseAddrs(addrs string) ([]string, []string) {
 	return parsedIPv4, parsedIPv6
 }
 
+func parseCgroups(cgroups string) []string {
+	parsed := []string{}
+
+	if cgroups != "" {
+		for _, cg := range strings.Split(cgroups, ",") {
+			cg = strings.Trim(cg, "/")
+			if cg == "" {
+				fmt.Println("Incorrectly specified cgroup:", cgroups)
+				os.Exit(1)
+			}
+			parsed = append(parsed, cg)
+		}
+	}
+
+	return parsed
+}
+
+func parsePids(pids string) []string {
+	parsed := []string{}
+
+	if pids != "" {
+		for _, p := range strings.Split(pids, ",") {
+			pid, err := strconv.Atoi(p)
+			if err != nil || pid <= 0 {
+				fmt.Println("Incorrectly specified pid:", p)
+				os.Exit(1)
+			}
+
+			cg, err := throttler.CgroupOf(pid)
+			if err != nil {
+				fmt.Println("Couldn't find the cgroup of", p+":", err)
+				os.Exit(1)
+			}
+			parsed = append(parsed, cg)
+		}
+	}
+
+	return parsed
+}
+
+// parseOwners validates user or group names and ids, kind being "user" or
+// "group".
+func parseOwners(owners string, kind string) []string {
+	parsed := []string{}
+
+	if owners != "" {
+		for _, o := range strings.Split(owners, ",") {
+			if id, err := strconv.Atoi(o); err == nil && id >= 0 {
+				parsed = append(parsed, o)
+				continue
+			}
+
+			var err error
+			if kind == "user" {
+				_, err = user.Lookup(o)
+			} else {
+				_, err = user.LookupGroup(o)
+			}
+			if err != nil {
+				fmt.Printf("Incorrectly specified %s: %s\n", kind, o)
+				os.Exit(1)
+			}
+			parsed = append(parsed, o)
+		}
+	}
+
+	return parsed
+}
+
 func parsePorts(ports string) []string {
 	prts := strings.Split(ports, ",")
 	parsed := []string{}
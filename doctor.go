@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/tylertreat/comcast/throttler"
+)
+
+// doctor checks the prerequisites of the packet rules without changing
+// anything, saying how to fix whatever is missing.
+func doctor(args []string) {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	device := fs.String("device", "", "Interface (device) to check (defaults to eth0 where applicable)")
+	privilege := fs.String("privilege", throttler.PrivilegeAuto, privilegeUsage)
+	fs.Parse(args)
+
+	failed := false
+	for _, check := range throttler.Doctor(&throttler.Config{Device: *device, Privilege: *privilege}) {
+		fmt.Printf("[%-4s] %s: %s\n", strings.ToUpper(check.Status), check.Name, check.Detail)
+		if check.Fix != "" {
+			fmt.Printf("       fix: %s\n", check.Fix)
+		}
+		if check.Status == throttler.CheckFail {
+			failed = true
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
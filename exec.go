@@ -0,0 +1,189 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/tylertreat/comcast/throttler"
+)
+
+// Waits for the parent to move it into its cgroup before exec'ing the real
+// command, so none of its traffic escapes the packet rules.
+const cgroupShim = `read _ <&3 && exec "$@"`
+
+// execCommand applies the packet rules, runs the given command, and tears the
+// rules down again however it exits, exiting with the command's status.
+func execCommand(args []string) {
+	fs := flag.NewFlagSet("exec", flag.ExitOnError)
+	flags := newConfigFlags(fs)
+	cgroup := fs.Bool("cgroup", false, "Only impair the command's traffic by running it in its own cgroup (cgroup v2)")
+	netns := fs.Bool("netns", false, "Only impair the command's traffic by running it in its own network namespace")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s exec [flags] -- <command> [args...]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	argv := fs.Args()
+	if len(argv) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	if *cgroup && *netns {
+		// The namespace already scopes the rules to the command
+		fmt.Println("Use either --cgroup or --netns, not both")
+		os.Exit(2)
+	}
+
+	cfg := flags.config()
+	cleanups := []func() error{}
+	cleanup := func() {
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			if err := cleanups[i](); err != nil {
+				fmt.Println("Failed to clean up:", err)
+			}
+		}
+	}
+	fail := func(msg string, err error) {
+		fmt.Println(msg, err)
+		cleanup()
+		os.Exit(1)
+	}
+
+	var ns *throttler.Netns
+	if *netns {
+		ns = throttler.NewNetns(cfg, os.Getpid())
+		cleanups = append(cleanups, ns.Remove)
+		if err := ns.Create(); err != nil {
+			fail("Couldn't create network namespace:", err)
+		}
+		argv = ns.Command(argv)
+	}
+
+	var cg *throttler.Cgroup
+	if *cgroup {
+		cg = throttler.NewCgroup(cfg, "comcast-"+strconv.Itoa(os.Getpid()))
+		if err := cg.Create(); err != nil {
+			fail("Couldn't create cgroup:", err)
+		}
+		cleanups = append(cleanups, cg.Remove)
+		cfg.TargetCgroups = append(cfg.TargetCgroups, cg.Path)
+		argv = append([]string{"/bin/sh", "-c", cgroupShim, "comcast-exec"}, argv...)
+	}
+
+	if ns != nil {
+		// Removing the namespace takes its rules with it
+		if err := ns.Setup(cfg); err != nil {
+			fail("I couldn't setup the packet rules:", err)
+		}
+	} else {
+		// Registered first so whatever a failing setup left behind goes too
+		cleanups = append(cleanups, func() error {
+			if err := throttler.Teardown(cfg); err != throttler.ErrNotSetup {
+				return err
+			}
+			return nil
+		})
+		if err := throttler.Setup(cfg); err != nil {
+			fail("I couldn't setup the packet rules:", err)
+		}
+	}
+
+	if cfg.DryRun {
+		fmt.Println(strings.Join(argv, " "))
+		cleanup()
+		return
+	}
+
+	status, err := run(argv, cg)
+	if err != nil {
+		fail("Couldn't run command:", err)
+	}
+
+	cleanup()
+	os.Exit(status)
+}
+
+// run starts argv, forwarding signals to it until it exits, and returns its
+// exit status the way a shell would report it. The child shares the terminal
+// with comcast, so the signals the terminal sends to both aren't forwarded.
+func run(argv []string, cg *throttler.Cgroup) (int, error) {
+	child := exec.Command(argv[0], argv[1:]...)
+	child.Stdin = os.Stdin
+	child.Stdout = os.Stdout
+	child.Stderr = os.Stderr
+
+	var release *os.File
+	if cg != nil {
+		r, w, err := os.Pipe()
+		if err != nil {
+			return 0, err
+		}
+		defer r.Close()
+		child.ExtraFiles = []*os.File{r}
+		release = w
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
+	defer signal.Stop(sigs)
+	fromTerminal := inForeground()
+
+	if err := child.Start(); err != nil {
+		return 0, err
+	}
+
+	if release != nil {
+		err := cg.Add(child.Process.Pid)
+		if err == nil {
+			_, err = release.Write([]byte("\n"))
+		}
+		release.Close()
+		if err != nil {
+			child.Process.Kill()
+			child.Wait()
+			return 0, err
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- child.Wait() }()
+
+	for {
+		select {
+		case sig := <-sigs:
+			if fromTerminal && sig != syscall.SIGTERM {
+				continue //The child got it from the terminal too
+			}
+			child.Process.Signal(sig)
+		case err := <-done:
+			if err == nil {
+				return 0, nil
+			}
+			exitErr, ok := err.(*exec.ExitError)
+			if !ok {
+				return 0, err
+			}
+			if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+				return 128 + int(ws.Signal()), nil
+			}
+			return exitErr.ExitCode(), nil
+		}
+	}
+}
+
+// inForeground reports whether comcast is in the foreground process group of
+// its terminal, which gets the terminal's SIGINT, SIGQUIT and SIGHUP.
+func inForeground() bool {
+	var pgrp int32
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, os.Stdin.Fd(), syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgrp)))
+	return errno == 0 && int(pgrp) == syscall.Getpgrp()
+}
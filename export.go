@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/tylertreat/comcast/throttler"
+)
+
+// export writes the scripts that set up and tear down the packet rules, for
+// review before they're run.
+func export(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", throttler.FormatSh, "Script format: sh, or sh batching commands through tc-batch, iptables-restore, pf-anchor or ipfw")
+	output := fs.String("output", "comcast", "Write <output>-apply.sh and <output>-teardown.sh, or - to print both")
+	flags := newConfigFlags(fs)
+	fs.Parse(args)
+
+	apply, teardown, err := throttler.Export(flags.config(), *format)
+	if err != nil {
+		fmt.Println("I couldn't export the packet rules:", err)
+		os.Exit(1)
+	}
+
+	if *output == "-" {
+		fmt.Print(apply, "\n", teardown)
+		return
+	}
+
+	scripts := []string{apply, teardown}
+	for i, name := range []string{*output + "-apply.sh", *output + "-teardown.sh"} {
+		if err := ioutil.WriteFile(name, []byte(scripts[i]), 0755); err != nil {
+			fmt.Println("I couldn't write the script:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Wrote", name)
+	}
+}
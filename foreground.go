@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/tylertreat/comcast/throttler"
+)
+
+// foreground keeps comcast running after setup until it is interrupted,
+// serving metrics if metricsAddr is set and running loop if given, then tears
+// the packet rules down again. The metrics follow the config loop applies.
+func foreground(cfg *throttler.Config, metricsAddr string, loop func(context.Context, *throttler.Applied) error) {
+	current := throttler.NewApplied(cfg)
+	if metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", throttler.MetricsHandler(current.Config))
+		srv := &http.Server{Addr: metricsAddr, Handler: mux}
+		defer srv.Close()
+
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fmt.Println("Metrics endpoint stopped:", err)
+			}
+		}()
+		fmt.Printf("Serving metrics on %s/metrics, interrupt to stop\n", metricsAddr)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	failed := false
+	if loop != nil {
+		if err := loop(ctx, current); err != nil {
+			fmt.Println("Stopping early:", err)
+			failed = true
+		}
+	} else {
+		<-ctx.Done()
+	}
+
+	if err := throttler.Teardown(cfg); err != nil && err != throttler.ErrNotSetup {
+		fmt.Println("Failed to stop packet controls:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Packet rules stopped...")
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/tylertreat/comcast/throttler"
+)
+
+// partition blackholes this node from its peers for one of the cluster
+// partition modes, e.g. isolating a node or splitting off a minority.
+func partition(args []string) {
+	fs := flag.NewFlagSet("partition", flag.ExitOnError)
+	nodes := fs.String("nodes", "", "Addresses of all cluster nodes, in the same order on every node (e.g. 10.0.0.1,10.0.0.2,10.0.0.3)")
+	mode := fs.String("mode", throttler.ModeMajorityMinority, "Partition to create: majority-minority, isolate=<node>, bridge or ring")
+	self := fs.String("self", "", "This node's address (defaults to whichever node address is on a local interface)")
+	device := fs.String("device", "", "Interface (device) to use (defaults to eth0 where applicable)")
+	reject := fs.Bool("partition-reject", false, "Reject partitioned traffic instead of silently dropping it")
+	stop := fs.Bool("stop", false, "Heal the partition")
+	dryrun := fs.Bool("dry-run", false, "Specifies whether or not to actually commit the rule changes")
+	privilege := fs.String("privilege", throttler.PrivilegeAuto, privilegeUsage)
+	fs.Parse(args)
+
+	cfg := &throttler.Config{
+		Device:          *device,
+		Stop:            *stop,
+		Partition:       throttler.PartitionBoth,
+		PartitionReject: *reject,
+		DryRun:          *dryrun,
+		Privilege:       *privilege,
+	}
+
+	if *stop {
+		throttler.Run(cfg)
+		return
+	}
+
+	all := parseNodes(*nodes)
+	if len(all) < 2 {
+		fmt.Println("A partition needs at least two nodes")
+		os.Exit(1)
+	}
+
+	me := *self
+	if me == "" {
+		me = localNode(all)
+	} else {
+		me = parseNodes(me)[0]
+	}
+
+	peers, err := throttler.PartitionPeers(all, me, *mode)
+	if err != nil {
+		fmt.Println("Couldn't compute the partition:", err)
+		os.Exit(1)
+	}
+
+	if len(peers) == 0 {
+		fmt.Printf("%s stays connected to all nodes in %s\n", me, *mode)
+		return
+	}
+
+	fmt.Printf("Partitioning %s from %s\n", me, strings.Join(peers, ", "))
+	cfg.TargetIps, cfg.TargetIps6 = parseAddrs(strings.Join(peers, ","))
+	throttler.Run(cfg)
+}
+
+// parseNodes validates single node addresses, keeping their order.
+func parseNodes(nodes string) []string {
+	parsed := []string{}
+
+	for _, node := range strings.Split(nodes, ",") {
+		if net.ParseIP(node) == nil {
+			fmt.Println("Incorrectly specified node address:", node)
+			os.Exit(1)
+		}
+		ipv4, ipv6 := parseAddrs(node)
+		parsed = append(parsed, append(ipv4, ipv6...)...)
+	}
+
+	return parsed
+}
+
+// localNode finds the node whose address is on one of this host's
+// interfaces.
+func localNode(nodes []string) string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		fmt.Println("Couldn't list local addresses, use --self:", err)
+		os.Exit(1)
+	}
+
+	found := []string{}
+	for _, node := range nodes {
+		ip := net.ParseIP(node)
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				found = append(found, node)
+				break
+			}
+		}
+	}
+
+	if len(found) != 1 {
+		fmt.Printf("Couldn't tell which node this is (found %d local node addresses), use --self\n", len(found))
+		os.Exit(1)
+	}
+	return found[0]
+}
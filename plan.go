@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/tylertreat/comcast/throttler"
+)
+
+// plan shows what apply would add, change and remove to take the live packet
+// rules to the ones the flags ask for.
+func plan(args []string) {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	flags := newConfigFlags(fs)
+	fs.Parse(args)
+
+	changes, err := throttler.Plan(flags.config())
+	if err != nil {
+		fmt.Println("I couldn't read the packet rules in place:", err)
+		os.Exit(1)
+	}
+	printChanges(changes)
+}
+
+// apply makes only the changes plan shows, so running it again with the same
+// flags leaves the packet rules alone.
+func apply(args []string) {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	flags := newConfigFlags(fs)
+	fs.Parse(args)
+
+	changes, err := throttler.Apply(flags.config())
+	if err != nil {
+		fmt.Println("I couldn't apply the packet rules:", err)
+		os.Exit(1)
+	}
+	printChanges(changes)
+}
+
+func printChanges(changes []throttler.Change) {
+	if len(changes) == 0 {
+		fmt.Println("No changes, the packet rules are up to date")
+		return
+	}
+
+	counts := map[string]int{}
+	for _, change := range changes {
+		fmt.Println(change)
+		counts[change.Action]++
+	}
+	fmt.Printf("%d to add, %d to change, %d to remove\n", counts[throttler.ChangeAdd], counts[throttler.ChangeUpdate], counts[throttler.ChangeRemove])
+}
@@ -0,0 +1,120 @@
+package probe
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+)
+
+// ServeEcho echoes back TCP streams and UDP datagrams sent to addr until ctx
+// is done. It's the endpoint for measuring throughput, and can run anywhere,
+// e.g. in a network namespace, to test against.
+func ServeEcho(ctx context.Context, addr string) error {
+	ln, pc, err := listenEcho(addr)
+	if err != nil {
+		return err
+	}
+	return serveEcho(ctx, ln, pc)
+}
+
+// StartEcho serves echo on addr in the background until ctx is done, and
+// returns the address it listens on, with the port picked for port 0.
+func StartEcho(ctx context.Context, addr string) (string, error) {
+	ln, pc, err := listenEcho(addr)
+	if err != nil {
+		return "", err
+	}
+	go serveEcho(ctx, ln, pc)
+	return ln.Addr().String(), nil
+}
+
+// listenEcho listens for TCP and UDP on the same port.
+func listenEcho(addr string) (net.Listener, net.PacketConn, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pc, err := net.ListenPacket("udp", ln.Addr().String())
+	if err != nil {
+		ln.Close()
+		return nil, nil, err
+	}
+	return ln, pc, nil
+}
+
+func serveEcho(ctx context.Context, ln net.Listener, pc net.PacketConn) error {
+	defer ln.Close()
+	defer pc.Close()
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+		pc.Close()
+	}()
+
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], from)
+		}
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+// Throughput streams data to the TCP echo endpoint at addr for d and returns
+// how fast it came back, in kbit/s. As the data crosses the link both ways,
+// this is the slower direction's throughput.
+func Throughput(addr string, d time.Duration) (int, error) {
+	conn, err := net.DialTimeout("tcp", addr, d)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	deadline := start.Add(d)
+	conn.SetDeadline(deadline)
+
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			if _, err := conn.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	received := 0
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := conn.Read(buf)
+		received += n
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			return 0, err
+		}
+	}
+
+	return int(float64(received*8) / 1000 / time.Since(start).Seconds()), nil
+}
@@ -0,0 +1,95 @@
+package probe
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// startEcho serves echo on a free local port until ctx is done.
+func startEcho(t *testing.T, ctx context.Context) string {
+	addr, err := StartEcho(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+func TestServeEcho(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr := startEcho(t, ctx)
+
+	for _, network := range []string{"tcp", "udp"} {
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte("hello"))
+		buf := make([]byte, 16)
+		n, err := conn.Read(buf)
+		if err != nil || string(buf[:n]) != "hello" {
+			t.Errorf("Expected %s echo of hello, got %q (%v)", network, buf[:n], err)
+		}
+		conn.Close()
+	}
+}
+
+func TestServeEchoStops(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- ServeEcho(ctx, addr) }()
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Echo server didn't stop with its context")
+	}
+}
+
+func TestThroughput(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr := startEcho(t, ctx)
+
+	kbit, err := Throughput(addr, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if kbit <= 0 {
+		t.Errorf("Expected some throughput over loopback, got %d", kbit)
+	}
+}
+
+func TestUDPEcho(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr := startEcho(t, ctx)
+
+	p := &UDPEcho{Addr: addr}
+	for i := 0; i < 3; i++ {
+		if _, err := p.Probe(time.Second); err != nil {
+			t.Errorf("Unexpected error probing: %s", err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Package probe measures the round trip time, loss and throughput of a real
+// link, to record it for replaying later.
+package probe
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Prober sends a single probe and returns its round trip time. An error means
+// the probe was lost.
+type Prober interface {
+	Probe(timeout time.Duration) (time.Duration, error)
+}
+
+// SYNRetransmit is when an unanswered SYN is sent again. A handshake that
+// takes longer may have had its first SYN lost and the retransmit answered,
+// so TCP connects can only tell loss from latency below it.
+const SYNRetransmit = time.Second
+
+// TCPConnect probes by timing TCP handshakes with Addr, a host:port.
+type TCPConnect struct {
+	Addr string
+}
+
+// Probe times one handshake. A refused connection still took a round trip, so
+// it counts. One that isn't done before the SYN is retransmitted is lost.
+func (p *TCPConnect) Probe(timeout time.Duration) (time.Duration, error) {
+	if timeout > SYNRetransmit {
+		timeout = SYNRetransmit
+	}
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", p.Addr, timeout)
+	rtt := time.Since(start)
+	if err != nil {
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return rtt, nil
+		}
+		return 0, err
+	}
+	conn.Close()
+	return rtt, nil
+}
+
+// UDPEcho probes by timing datagrams echoed back by Addr, a host:port
+// running `comcast echo`.
+type UDPEcho struct {
+	Addr string
+	seq  uint64
+}
+
+// Probe sends one datagram and waits for it to come back.
+func (p *UDPEcho) Probe(timeout time.Duration) (time.Duration, error) {
+	conn, err := net.Dial("udp", p.Addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	p.seq++
+	payload := []byte(fmt.Sprintf("comcast %d", p.seq))
+	start := time.Now()
+	conn.SetDeadline(start.Add(timeout))
+	if _, err := conn.Write(payload); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, 64)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		// Skip late replies to earlier probes
+		if string(buf[:n]) == string(payload) {
+			return time.Since(start), nil
+		}
+	}
+}
+
+// ICMP probes Host with echo requests sent by the system's ping, which
+// doesn't need raw socket privileges.
+type ICMP struct {
+	Host string
+}
+
+var pingTime = regexp.MustCompile(`time[=<]([0-9.]+) ?ms`)
+
+// Probe pings the host once.
+func (p *ICMP) Probe(timeout time.Duration) (time.Duration, error) {
+	secs := int(timeout.Seconds() + 0.999)
+	if secs < 1 {
+		secs = 1
+	}
+
+	wait := "-W"
+	if runtime.GOOS != "linux" {
+		// -W is in milliseconds on the BSDs, -t is the overall timeout
+		wait = "-t"
+	}
+	out, err := exec.Command("ping", "-c", "1", wait, strconv.Itoa(secs), p.Host).Output()
+	if err != nil {
+		return 0, fmt.Errorf("no reply from %s", p.Host)
+	}
+	return parsePing(string(out))
+}
+
+// parsePing finds the round trip time in ping's output, such as
+// `64 bytes from 10.0.0.1: icmp_seq=1 ttl=64 time=12.3 ms`.
+func parsePing(out string) (time.Duration, error) {
+	m := pingTime.FindStringSubmatch(out)
+	if m == nil {
+		return 0, errors.New("no reply in ping output")
+	}
+	ms, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(ms * float64(time.Millisecond)), nil
+}
@@ -0,0 +1,63 @@
+package probe
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParsePing(t *testing.T) {
+	for out, expected := range map[string]time.Duration{
+		"64 bytes from 10.0.0.1: icmp_seq=1 ttl=64 time=12.3 ms":  12300 * time.Microsecond,
+		"64 bytes from ::1: icmp_seq=1 ttl=64 time=0.045 ms":      45 * time.Microsecond,
+		"64 bytes from 10.0.0.1: icmp_seq=0 ttl=64 time<1 ms":     time.Millisecond,
+		"64 bytes from 192.168.1.1: icmp_seq=0 ttl=64 time=5.1ms": 5100 * time.Microsecond,
+	} {
+		rtt, err := parsePing(out)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %s", out, err)
+		}
+		if rtt != expected {
+			t.Errorf("Expected %s from %q, got %s", expected, out, rtt)
+		}
+	}
+
+	if _, err := parsePing("1 packets transmitted, 0 received, 100% packet loss"); err == nil {
+		t.Error("Expected an error without a reply")
+	}
+}
+
+func TestTCPConnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+
+	p := &TCPConnect{Addr: addr}
+	if _, err := p.Probe(time.Second); err != nil {
+		t.Errorf("Unexpected error probing a listener: %s", err)
+	}
+
+	// A refused connection still made a round trip
+	ln.Close()
+	if _, err := p.Probe(time.Second); err != nil {
+		t.Errorf("Unexpected error probing a closed port: %s", err)
+	}
+}
+
+// fakeProber loses every lose'th probe and returns rtt for the rest.
+type fakeProber struct {
+	rtt   time.Duration
+	lose  int
+	count int
+}
+
+func (p *fakeProber) Probe(timeout time.Duration) (time.Duration, error) {
+	p.count++
+	if p.lose > 0 && p.count%p.lose == 0 {
+		return 0, errors.New("lost")
+	}
+	return p.rtt, nil
+}
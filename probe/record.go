@@ -0,0 +1,176 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/tylertreat/comcast/throttler"
+)
+
+// Options say how to record a link.
+type Options struct {
+	Prober Prober
+	// Echo is a TCP echo endpoint to measure throughput against, if any.
+	Echo     string
+	Duration time.Duration
+	// Interval is how much of the recording each trace sample covers.
+	Interval time.Duration
+	// Probes is how many probes to send each interval.
+	Probes  int
+	Timeout time.Duration
+}
+
+// Recording is what was measured over a link.
+type Recording struct {
+	Trace *throttler.Trace
+	// RTTs of every probe that made it back, in the order they were sent.
+	RTTs []time.Duration
+	Sent int
+	Lost int
+	// Throughput is the median over the intervals, in kbit/s, or -1 without
+	// an echo endpoint.
+	Throughput int
+}
+
+// Record measures the link for opts.Duration, or until ctx is done, with a
+// trace sample for each interval giving its median RTT as the latency, its
+// loss and, with an echo endpoint, its throughput as the bandwidth.
+func Record(ctx context.Context, opts Options) (*Recording, error) {
+	if opts.Interval <= 0 || opts.Probes <= 0 || opts.Duration < opts.Interval {
+		return nil, errors.New("need a positive interval and probe count, and a duration of at least one interval")
+	}
+
+	// With an echo endpoint, probe during the first half of each interval
+	// and saturate the link in the second, so the two don't skew each other
+	probing := opts.Interval
+	if opts.Echo != "" {
+		probing /= 2
+	}
+	spacing := probing / time.Duration(opts.Probes)
+
+	rec := &Recording{Trace: &throttler.Trace{}, Throughput: -1}
+	throughputs := []int{}
+
+intervals:
+	for at := time.Duration(0); at+opts.Interval <= opts.Duration; at += opts.Interval {
+		rtts := []time.Duration{}
+		lost := 0
+		for i := 0; i < opts.Probes; i++ {
+			start := time.Now()
+			rtt, err := opts.Prober.Probe(opts.Timeout)
+			if err != nil {
+				lost++
+			} else {
+				rtts = append(rtts, rtt)
+			}
+			if !sleep(ctx, spacing-time.Since(start)) {
+				break intervals // Drop the unfinished interval
+			}
+		}
+
+		s := throttler.Sample{At: at, Bandwidth: -1, Latency: -1, PacketLoss: 100 * float64(lost) / float64(opts.Probes)}
+		if len(rtts) > 0 {
+			s.Latency = int(math.Round(float64(percentile(rtts, 50)) / float64(time.Millisecond)))
+		}
+
+		if opts.Echo != "" {
+			kbit, err := Throughput(opts.Echo, opts.Interval-probing)
+			if err != nil {
+				return nil, fmt.Errorf("measuring throughput: %s", err)
+			}
+			s.Bandwidth = kbit
+			throughputs = append(throughputs, kbit)
+		}
+
+		rec.Trace.Samples = append(rec.Trace.Samples, s)
+		rec.Trace.Length = at + opts.Interval
+		rec.RTTs = append(rec.RTTs, rtts...)
+		rec.Sent += opts.Probes
+		rec.Lost += lost
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if len(throughputs) > 0 {
+		sort.Ints(throughputs)
+		rec.Throughput = throughputs[len(throughputs)/2]
+	}
+	return rec, nil
+}
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// Percentile returns the p'th percentile of the round trip times.
+func (r *Recording) Percentile(p float64) time.Duration {
+	return percentile(r.RTTs, p)
+}
+
+// Loss returns the percentage of probes lost.
+func (r *Recording) Loss() float64 {
+	if r.Sent == 0 {
+		return 0
+	}
+	return 100 * float64(r.Lost) / float64(r.Sent)
+}
+
+func percentile(rtts []time.Duration, p float64) time.Duration {
+	if len(rtts) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration{}, rtts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// WriteSummary writes the RTT distribution, loss and throughput.
+func (r *Recording) WriteSummary(w io.Writer) {
+	fmt.Fprintf(w, "%d probes, %d lost (%.1f%%)\n", r.Sent, r.Lost, r.Loss())
+	if len(r.RTTs) > 0 {
+		fmt.Fprintf(w, "rtt min/p50/p90/p99/max = %s/%s/%s/%s/%s\n",
+			r.Percentile(0), r.Percentile(50), r.Percentile(90), r.Percentile(99), r.Percentile(100))
+	}
+	if r.Throughput >= 0 {
+		fmt.Fprintf(w, "throughput = %d kbit/s\n", r.Throughput)
+	}
+}
+
+// Profile returns the comcast flags for a static profile of the link, from
+// its median RTT, overall loss and median throughput.
+func (r *Recording) Profile() string {
+	profile := fmt.Sprintf("--latency=%d --packet-loss=%.2f%%",
+		int(math.Round(float64(r.Percentile(50))/float64(time.Millisecond))), r.Loss())
+	if r.Throughput >= 0 {
+		profile += fmt.Sprintf(" --target-bw=%d", r.Throughput)
+	}
+	return profile
+}
+
+// WriteTrace writes the recording as a trace `comcast replay` can load,
+// noting the static profile in a comment.
+func (r *Recording) WriteTrace(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "# Recorded by comcast, as a static profile: %s\n", r.Profile()); err != nil {
+		return err
+	}
+	return throttler.WriteTraceCSV(w, r.Trace)
+}
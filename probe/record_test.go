@@ -0,0 +1,89 @@
+package probe
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tylertreat/comcast/throttler"
+)
+
+func TestRecord(t *testing.T) {
+	p := &fakeProber{rtt: 40 * time.Millisecond, lose: 4}
+	rec, err := Record(context.Background(), Options{
+		Prober:   p,
+		Duration: 30 * time.Millisecond,
+		Interval: 10 * time.Millisecond,
+		Probes:   4,
+		Timeout:  time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if rec.Sent != 12 || rec.Lost != 3 || len(rec.RTTs) != 9 {
+		t.Errorf("Expected 12 probes with 3 lost, got %d with %d lost", rec.Sent, rec.Lost)
+	}
+	if len(rec.Trace.Samples) != 3 || rec.Trace.Length != 30*time.Millisecond {
+		t.Fatalf("Expected 3 samples over 30ms, got %v over %s", rec.Trace.Samples, rec.Trace.Length)
+	}
+	expected := throttler.Sample{At: 10 * time.Millisecond, Bandwidth: -1, Latency: 40, PacketLoss: 25}
+	if rec.Trace.Samples[1] != expected {
+		t.Errorf("Expected %v, got %v", expected, rec.Trace.Samples[1])
+	}
+	if rec.Profile() != "--latency=40 --packet-loss=25.00%" {
+		t.Errorf("Unexpected profile %s", rec.Profile())
+	}
+}
+
+func TestRecordWithEcho(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr := startEcho(t, ctx)
+
+	rec, err := Record(ctx, Options{
+		Prober:   &TCPConnect{Addr: addr},
+		Echo:     addr,
+		Duration: 100 * time.Millisecond,
+		Interval: 100 * time.Millisecond,
+		Probes:   2,
+		Timeout:  time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if rec.Throughput <= 0 || rec.Trace.Samples[0].Bandwidth != rec.Throughput {
+		t.Errorf("Expected a throughput measurement, got %d", rec.Throughput)
+	}
+}
+
+func TestRecordingReplays(t *testing.T) {
+	rec := &Recording{
+		Trace: &throttler.Trace{Samples: []throttler.Sample{
+			{At: 0, Bandwidth: 800, Latency: 40, PacketLoss: 0},
+			{At: time.Second, Bandwidth: -1, Latency: -1, PacketLoss: 100},
+		}},
+		RTTs:       []time.Duration{40 * time.Millisecond},
+		Sent:       2,
+		Lost:       1,
+		Throughput: 800,
+	}
+
+	var buf bytes.Buffer
+	if err := rec.WriteTrace(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "# Recorded by comcast, as a static profile: --latency=40 --packet-loss=50.00% --target-bw=800\n") {
+		t.Errorf("Unexpected trace header in:\n%s", buf.String())
+	}
+
+	trace, err := throttler.ParseTraceCSV(&buf)
+	if err != nil {
+		t.Fatalf("Unexpected error reading the trace back: %s", err)
+	}
+	if len(trace.Samples) != 2 || trace.Samples[0] != rec.Trace.Samples[0] || trace.Samples[1] != rec.Trace.Samples[1] {
+		t.Errorf("Expected %v back, got %v", rec.Trace.Samples, trace.Samples)
+	}
+}
@@ -0,0 +1,113 @@
+package probe
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// Stats summarize a batch of probes.
+type Stats struct {
+	Sent int
+	Lost int
+	// RTT is the median round trip time of the probes that came back.
+	RTT time.Duration
+}
+
+// Loss returns the percentage of probes lost.
+func (s Stats) Loss() float64 {
+	if s.Sent == 0 {
+		return 0
+	}
+	return 100 * float64(s.Lost) / float64(s.Sent)
+}
+
+// Measure sends n probes, spaced apart, and summarizes them.
+func Measure(p Prober, n int, spacing, timeout time.Duration) Stats {
+	stats := Stats{Sent: n}
+	rtts := []time.Duration{}
+	for i := 0; i < n; i++ {
+		start := time.Now()
+		rtt, err := p.Probe(timeout)
+		if err != nil {
+			stats.Lost++
+		} else {
+			rtts = append(rtts, rtt)
+		}
+		if wait := spacing - time.Since(start); wait > 0 && i < n-1 {
+			time.Sleep(wait)
+		}
+	}
+	stats.RTT = percentile(rtts, 50)
+	return stats
+}
+
+// Report compares what probes measured after the packet rules were set up
+// with the link before, and with what the rules asked for.
+type Report struct {
+	Baseline Stats
+	Measured Stats
+	// Latency and PacketLoss are what the rules should add, and the
+	// tolerances how far off the measurements may be.
+	Latency          time.Duration
+	PacketLoss       float64
+	LatencyTolerance time.Duration
+	LossTolerance    float64
+	Problems         []string
+}
+
+// Verify checks that the measured RTT and loss went up from the baseline by
+// the requested latency and packet loss, give or take latencyTolerance plus
+// 10% of the latency, and three standard deviations of the loss the number of
+// probes can detect. Latency is only added one way, so the RTT should go up by
+// exactly it.
+func Verify(baseline, measured Stats, latency time.Duration, loss float64, latencyTolerance time.Duration) *Report {
+	r := &Report{
+		Baseline:         baseline,
+		Measured:         measured,
+		Latency:          latency,
+		PacketLoss:       loss,
+		LatencyTolerance: latencyTolerance + latency/10,
+	}
+
+	if baseline.Sent > 0 && baseline.Lost == baseline.Sent {
+		r.Problems = append(r.Problems, "the target didn't answer any probes before the packet rules were set up, so nothing can be measured")
+		return r
+	}
+
+	// Only compare RTTs if some probes made it through
+	if measured.Lost < measured.Sent {
+		added := measured.RTT - baseline.RTT
+		if d := added - latency; d > r.LatencyTolerance || -d > r.LatencyTolerance {
+			r.Problems = append(r.Problems, fmt.Sprintf("latency went up by %s, expected %s ± %s", round(added), latency, round(r.LatencyTolerance)))
+		}
+	}
+
+	expected := baseline.Loss() + loss*(100-baseline.Loss())/100
+	p := expected / 100
+	r.LossTolerance = 100 * (3*math.Sqrt(p*(1-p)/float64(measured.Sent)) + 1/float64(measured.Sent))
+	if d := measured.Loss() - expected; math.Abs(d) > r.LossTolerance {
+		r.Problems = append(r.Problems, fmt.Sprintf("%.1f%% of probes were lost, expected %.1f%% ± %.1f%%", measured.Loss(), expected, r.LossTolerance))
+	}
+
+	return r
+}
+
+// OK is true when the measurements matched the packet rules.
+func (r *Report) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// Write prints the measurements and any problems.
+func (r *Report) Write(w io.Writer) {
+	fmt.Fprintf(w, "Before: rtt %s, %.1f%% loss over %d probes\n", round(r.Baseline.RTT), r.Baseline.Loss(), r.Baseline.Sent)
+	fmt.Fprintf(w, "After:  rtt %s, %.1f%% loss over %d probes\n", round(r.Measured.RTT), r.Measured.Loss(), r.Measured.Sent)
+	for _, problem := range r.Problems {
+		fmt.Fprintln(w, "Mismatch:", problem)
+	}
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(100 * time.Microsecond)
+}
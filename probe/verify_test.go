@@ -0,0 +1,57 @@
+package probe
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMeasure(t *testing.T) {
+	stats := Measure(&fakeProber{rtt: 30 * time.Millisecond, lose: 5}, 20, 0, time.Second)
+	if stats.Sent != 20 || stats.Lost != 4 || stats.RTT != 30*time.Millisecond {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if stats.Loss() != 20 {
+		t.Errorf("Expected 20%% loss, got %v", stats.Loss())
+	}
+}
+
+func TestVerifyOK(t *testing.T) {
+	baseline := Stats{Sent: 100, RTT: 2 * time.Millisecond}
+	measured := Stats{Sent: 100, Lost: 9, RTT: 104 * time.Millisecond}
+
+	r := Verify(baseline, measured, 100*time.Millisecond, 10, 5*time.Millisecond)
+	if !r.OK() {
+		t.Errorf("Expected the measurements to match, got %v", r.Problems)
+	}
+}
+
+func TestVerifyMismatch(t *testing.T) {
+	baseline := Stats{Sent: 100, RTT: 2 * time.Millisecond}
+	// As if sch_netem was missing and nothing changed
+	measured := Stats{Sent: 100, RTT: 2 * time.Millisecond}
+
+	r := Verify(baseline, measured, 100*time.Millisecond, 30, 5*time.Millisecond)
+	if len(r.Problems) != 2 {
+		t.Fatalf("Expected a latency and a loss mismatch, got %v", r.Problems)
+	}
+
+	var buf bytes.Buffer
+	r.Write(&buf)
+	for _, expected := range []string{
+		"Mismatch: latency went up by 0s, expected 100ms ± 15ms",
+		"Mismatch: 0.0% of probes were lost, expected 30.0% ± 14.7%",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("Expected %q in the report:\n%s", expected, buf.String())
+		}
+	}
+}
+
+func TestVerifyUnreachable(t *testing.T) {
+	r := Verify(Stats{Sent: 10, Lost: 10}, Stats{Sent: 10, Lost: 10}, 0, 100, time.Millisecond)
+	if r.OK() {
+		t.Error("Expected verifying against an unreachable target to fail")
+	}
+}
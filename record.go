@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/tylertreat/comcast/probe"
+)
+
+// record measures a real link and writes it out as a trace for replaying.
+func record(args []string) {
+	fs := flag.NewFlagSet("record", flag.ExitOnError)
+	target := fs.String("target", "", "Host to probe, or host:port to probe with TCP connects")
+	method := fs.String("method", "", "Probe with icmp, tcp connects or udp to a comcast echo endpoint (defaults to tcp when --target has a port and icmp otherwise)")
+	duration := fs.Duration("duration", time.Minute, "How long to record for")
+	interval := fs.Duration("interval", time.Second, "How much of the recording each trace sample covers")
+	probes := fs.Int("probes", 10, "Probes to send each interval")
+	timeout := fs.Duration("timeout", time.Second, "How long to wait before counting a probe as lost")
+	echo := fs.String("echo", "", "TCP echo endpoint, such as comcast echo, to measure throughput against, as host:port")
+	output := fs.String("o", "", "File to write the trace to (defaults to stdout)")
+	fs.Parse(args)
+
+	if *target == "" {
+		fmt.Println("A target to record is required")
+		os.Exit(2)
+	}
+
+	prober := parseProber(*target, *method)
+
+	var out io.Writer = os.Stdout
+	status := io.Writer(os.Stderr)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Println("Couldn't create trace file:", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		out, status = f, os.Stdout
+	}
+
+	// Interrupting keeps what's been recorded so far
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	fmt.Fprintf(status, "Recording %s for %s, interrupt to stop early\n", *target, *duration)
+	rec, err := probe.Record(ctx, probe.Options{
+		Prober:   prober,
+		Echo:     *echo,
+		Duration: *duration,
+		Interval: *interval,
+		Probes:   *probes,
+		Timeout:  *timeout,
+	})
+	if err != nil {
+		fmt.Fprintln(status, "Couldn't record the link:", err)
+		os.Exit(1)
+	}
+
+	rec.WriteSummary(status)
+	fmt.Fprintf(status, "profile: %s\n", rec.Profile())
+	if err := rec.WriteTrace(out); err != nil {
+		fmt.Fprintln(status, "Couldn't write the trace:", err)
+		os.Exit(1)
+	}
+}
+
+// parseProber picks how to probe target, which has a port for TCP and UDP.
+func parseProber(target, method string) probe.Prober {
+	_, _, err := net.SplitHostPort(target)
+	hasPort := err == nil
+
+	switch {
+	case method == "tcp" || method == "udp" || (method == "" && hasPort):
+		if !hasPort {
+			fmt.Printf("TCP and UDP probes need a port, e.g. %s:7007\n", target)
+			os.Exit(2)
+		}
+		if method == "udp" {
+			return &probe.UDPEcho{Addr: target}
+		}
+		return &probe.TCPConnect{Addr: target}
+	case method == "icmp" || method == "":
+		if hasPort {
+			fmt.Println("ICMP probes don't use a port, leave it off", target)
+			os.Exit(2)
+		}
+		if _, err := exec.LookPath("ping"); err != nil {
+			fmt.Println("ICMP probes need ping installed, or use TCP probes with a host:port")
+			os.Exit(1)
+		}
+		return &probe.ICMP{Host: target}
+	default:
+		fmt.Println("Incorrectly specified probe method:", method)
+		os.Exit(2)
+		return nil
+	}
+}
+
+// echo serves TCP and UDP echo, for recording throughput against.
+func echo(args []string) {
+	fs := flag.NewFlagSet("echo", flag.ExitOnError)
+	listen := fs.String("listen", ":7007", "Address to serve TCP and UDP echo on")
+	fs.Parse(args)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	fmt.Printf("Serving echo on %s, interrupt to stop\n", *listen)
+	if err := probe.ServeEcho(ctx, *listen); err != nil {
+		fmt.Println("Echo server stopped:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tylertreat/comcast/throttler"
+)
+
+// replay applies a recorded trace to the target class, looping it until
+// interrupted, then tears the packet rules down again.
+func replay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	flags := newConfigFlags(fs)
+	format := fs.String("format", "", "Trace format, csv or mahimahi (defaults to csv for .csv files and mahimahi otherwise)")
+	interpolate := fs.Bool("interpolate", false, "Blend between samples instead of stepping from one to the next")
+	once := fs.Bool("once", false, "Stop at the end of the trace instead of looping")
+	tick := fs.Duration("tick", 100*time.Millisecond, "How often to update the shaping")
+	bin := fs.Duration("bin", 100*time.Millisecond, "Window Mahimahi delivery opportunities are counted over to get a bandwidth")
+	metrics := fs.String("metrics-listen", "", "Serve Prometheus metrics on this address (e.g. :9090)")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s replay [flags] <trace>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	trace := readTrace(fs.Arg(0), *format, *bin)
+	trace.Interpolate = *interpolate
+	trace.Loop = !*once
+
+	// Start out shaped like the beginning of the trace
+	base := flags.config()
+	first, _ := trace.Sample(0)
+	cfg := throttler.ApplySample(base, first)
+	if err := throttler.Setup(cfg); err != nil {
+		fmt.Println("I couldn't setup the packet rules:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Replaying %s, interrupt to stop\n", fs.Arg(0))
+
+	foreground(cfg, *metrics, func(ctx context.Context, current *throttler.Applied) error {
+		return throttler.Replay(ctx, base, trace, *tick, current)
+	})
+}
+
+func readTrace(path, format string, bin time.Duration) *throttler.Trace {
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Println("Couldn't open trace:", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	if format == "" {
+		format = "mahimahi"
+		if strings.HasSuffix(strings.ToLower(path), ".csv") {
+			format = "csv"
+		}
+	}
+
+	var trace *throttler.Trace
+	switch format {
+	case "csv":
+		trace, err = throttler.ParseTraceCSV(f)
+	case "mahimahi":
+		trace, err = throttler.ParseMahimahi(f, bin)
+	default:
+		fmt.Println("Incorrectly specified trace format:", format)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Printf("Incorrectly specified trace %s: %s\n", path, err)
+		os.Exit(1)
+	}
+	return trace
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tylertreat/comcast/throttler"
+)
+
+const defaultListen = "unix:///run/comcast.sock"
+
+// serve runs comcast as a daemon exposing the throttler over HTTP until it is
+// interrupted, tearing down any applied rules on the way out.
+func serve(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	listen := fs.String("listen", defaultListen, "Address to serve the control API on (e.g. unix:///run/comcast.sock or tcp://127.0.0.1:8080)")
+	group := fs.String("socket-group", "", "Let this group's members use the unix socket too, which only its owner can by default")
+	fs.Parse(args)
+
+	l, err := listenOn(*listen, *group)
+	if err != nil {
+		fmt.Println("Couldn't listen on", *listen+":", err)
+		os.Exit(1)
+	}
+
+	srv := throttler.NewServer()
+	httpSrv := &http.Server{Handler: srv}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		httpSrv.Close()
+	}()
+
+	fmt.Println("Serving control API on", *listen)
+	if err := httpSrv.Serve(l); err != nil && err != http.ErrServerClosed {
+		fmt.Println("Control API stopped:", err)
+	}
+
+	if err := srv.Close(); err != nil && err != throttler.ErrNotSetup {
+		fmt.Println("Failed to stop packet controls:", err)
+		os.Exit(1)
+	}
+}
+
+// listenOn accepts unix://path, tcp://host:port or a bare host:port. A unix
+// socket is only for its owner, and group's members if it's given.
+func listenOn(addr, group string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		path := strings.TrimPrefix(addr, "unix://")
+		// A socket left behind by a previous daemon would make Listen fail,
+		// but one a daemon still answers on is its own
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("Something is already listening on %s, another comcast serve?", path)
+			}
+			os.Remove(path)
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		// Only the owner (normally root) may drive the throttler
+		mode := os.FileMode(0600)
+		if group != "" {
+			gid, err := lookupGid(group)
+			if err == nil {
+				err = os.Chown(path, -1, gid)
+			}
+			if err != nil {
+				l.Close()
+				return nil, err
+			}
+			mode = 0660
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			l.Close()
+			return nil, err
+		}
+		return l, nil
+	case strings.HasPrefix(addr, "tcp://"):
+		return net.Listen("tcp", strings.TrimPrefix(addr, "tcp://"))
+	default:
+		return net.Listen("tcp", addr)
+	}
+}
+
+// lookupGid returns the id of the group with the given name or id.
+func lookupGid(group string) (int, error) {
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		if _, numeric := strconv.Atoi(group); numeric != nil {
+			return 0, err
+		}
+		if g, err = user.LookupGroupId(group); err != nil {
+			return 0, err
+		}
+	}
+	return strconv.Atoi(g.Gid)
+}
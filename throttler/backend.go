@@ -0,0 +1,192 @@
+package throttler
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Backend sets up and tears down packet rules with some system tool. Besides
+// the built-in tc, pfctl and ipfw, backends can be added with RegisterBackend
+// and picked with Config.Backend.
+type Backend interface {
+	Setup(*Config) error
+	Teardown(*Config) error
+	// Exists reports whether the backend's rules are in place.
+	Exists() bool
+	// Check returns the command that shows the rules.
+	Check() []string
+}
+
+// Commander runs a backend's commands as argv, with whatever gives them
+// privileges, or prints or collects them instead for dry runs and exports.
+type Commander interface {
+	Execute(cmd []string) error
+	ExecuteGetLines(cmd []string) ([]string, error)
+	ExecuteInput(cmd []string, input string) error
+	CommandExists(cmd string) bool
+}
+
+// BackendInfo describes a backend to register.
+type BackendInfo struct {
+	Name string
+	// OSes the backend runs on. Its rules are generated for the first one
+	// when it's picked on another OS for a dry run or export.
+	OSes []string
+	// Tool makes the backend the default for its OSes when the command
+	// exists, unless a backend registered earlier is. Empty means it's
+	// only used when picked.
+	Tool string
+	New  func(cfg *Config, c Commander) (Backend, error)
+}
+
+// Backends Config.Backend can pick from the start.
+const (
+	BackendTc    = "tc"
+	BackendPfctl = "pfctl"
+	BackendIpfw  = "ipfw"
+)
+
+type backend struct {
+	BackendInfo
+	builtin func(cfg *Config, c commander, goos string) (throttler, error)
+	// always makes it the default for its OSes even if the tool isn't on
+	// PATH, like tc, which lives in /sbin where users' PATH often doesn't
+	// look.
+	always bool
+}
+
+// backends are the registered backends, in the order defaults are picked.
+var backends = []*backend{
+	{BackendInfo{Name: BackendTc, OSes: []string{linux}, Tool: "tc"}, func(cfg *Config, c commander, _ string) (throttler, error) {
+		defaultDevice(cfg)
+		return &tcThrottler{c}, nil
+	}, true},
+	// Avoid OS version pinning and choose based on what's available
+	{BackendInfo{Name: BackendPfctl, OSes: []string{darwin}, Tool: pfctl}, func(cfg *Config, c commander, _ string) (throttler, error) {
+		defaultDevice(cfg)
+		return &pfctlThrottler{c}, nil
+	}, false},
+	{BackendInfo{Name: BackendIpfw, OSes: []string{freebsd, darwin}, Tool: ipfw}, func(cfg *Config, c commander, goos string) (throttler, error) {
+		if goos == freebsd && cfg.Device == "" {
+			return nil, errors.New("Device not specified, unable to default to eth0 on FreeBSD.")
+		}
+		defaultDevice(cfg)
+		return &ipfwThrottler{c}, nil
+	}, false},
+}
+
+func defaultDevice(cfg *Config) {
+	if cfg.Device == "" {
+		cfg.Device = "eth0"
+	}
+}
+
+// RegisterBackend adds a backend, e.g. from an init function, before any
+// packet rules are set up.
+func RegisterBackend(info BackendInfo) error {
+	if info.Name == "" || len(info.OSes) == 0 || info.New == nil {
+		return errors.New("A backend needs a name, OSes and New")
+	}
+	if findBackend(info.Name) != nil {
+		return fmt.Errorf("Backend %s is already registered", info.Name)
+	}
+	backends = append(backends, &backend{BackendInfo: info})
+	return nil
+}
+
+// Backends returns the names of the registered backends.
+func Backends() []string {
+	names := []string{}
+	for _, b := range backends {
+		names = append(names, b.Name)
+	}
+	return names
+}
+
+func findBackend(name string) *backend {
+	for _, b := range backends {
+		if b.Name == name {
+			return b
+		}
+	}
+	return nil
+}
+
+// defaultBackend picks the first backend for goos whose tool exists, or that
+// is picked regardless.
+func defaultBackend(c commander, goos string) (*backend, error) {
+	tried := []string{}
+	for _, b := range backends {
+		if b.Tool == "" || !contains(b.OSes, goos) {
+			continue
+		}
+		if b.always || c.commandExists(b.Tool) {
+			return b, nil
+		}
+		tried = append(tried, b.Tool)
+	}
+
+	if len(tried) == 0 {
+		return nil, fmt.Errorf("I don't support your OS: %s", goos)
+	}
+	return nil, fmt.Errorf("Could not determine an appropriate firewall tool for %s (tried %s), exiting", goos, strings.Join(tried, ", "))
+}
+
+func (b *backend) create(cfg *Config, c commander, goos string) (throttler, error) {
+	if b.builtin != nil {
+		return b.builtin(cfg, c, goos)
+	}
+
+	registered, err := b.New(cfg, &publicCommander{c})
+	if err != nil {
+		return nil, err
+	}
+	return &backendThrottler{registered}, nil
+}
+
+// publicCommander hands registered backends the commander the built-in ones
+// use.
+type publicCommander struct {
+	c commander
+}
+
+func (p *publicCommander) Execute(cmd []string) error {
+	return p.c.execute(cmd)
+}
+
+func (p *publicCommander) ExecuteGetLines(cmd []string) ([]string, error) {
+	return p.c.executeGetLines(cmd)
+}
+
+func (p *publicCommander) ExecuteInput(cmd []string, input string) error {
+	return p.c.executeInput(cmd, input)
+}
+
+func (p *publicCommander) CommandExists(cmd string) bool {
+	return p.c.commandExists(cmd)
+}
+
+// backendThrottler runs a registered Backend as a throttler.
+type backendThrottler struct {
+	b Backend
+}
+
+func (t *backendThrottler) setup(cfg *Config) error {
+	return t.b.Setup(cfg)
+}
+
+func (t *backendThrottler) teardown(cfg *Config) error {
+	return t.b.Teardown(cfg)
+}
+
+func (t *backendThrottler) exists() bool {
+	if dry {
+		return false
+	}
+	return t.b.Exists()
+}
+
+func (t *backendThrottler) check() []string {
+	return t.b.Check()
+}
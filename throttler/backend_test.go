@@ -0,0 +1,100 @@
+package throttler
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+type proxyBackend struct {
+	c Commander
+}
+
+func (b *proxyBackend) Setup(cfg *Config) error {
+	return b.c.ExecuteInput([]string{"proxyctl", "load", "-"}, cfg.Device)
+}
+
+func (b *proxyBackend) Teardown(cfg *Config) error {
+	return b.c.Execute([]string{"proxyctl", "unload"})
+}
+
+func (b *proxyBackend) Exists() bool {
+	lines, _ := b.c.ExecuteGetLines([]string{"proxyctl", "status"})
+	return len(lines) > 0
+}
+
+func (b *proxyBackend) Check() []string {
+	return []string{"proxyctl", "status"}
+}
+
+func init() {
+	err := RegisterBackend(BackendInfo{
+		Name: "proxy",
+		OSes: []string{runtime.GOOS},
+		New: func(cfg *Config, c Commander) (Backend, error) {
+			return &proxyBackend{c}, nil
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestRegisteredBackend(t *testing.T) {
+	r := newCmdRecorder()
+	cfg := &Config{Backend: "proxy", Device: "lo"}
+	th, err := newThrottler(cfg, r)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if err := th.setup(cfg); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if err := th.teardown(cfg); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	r.verifyCommands(t, []string{
+		`proxyctl load - <<< "lo"`,
+		"proxyctl unload",
+	})
+
+	if strings.Join(th.check(), " ") != "proxyctl status" {
+		t.Errorf("Expected the backend's check, got %q", th.check())
+	}
+}
+
+func TestRegisterBackend(t *testing.T) {
+	newProxy := func(cfg *Config, c Commander) (Backend, error) { return &proxyBackend{c}, nil }
+	if err := RegisterBackend(BackendInfo{Name: BackendTc, OSes: []string{linux}, New: newProxy}); err == nil {
+		t.Error("Expected an error registering tc again")
+	}
+	if err := RegisterBackend(BackendInfo{Name: "nameless"}); err == nil {
+		t.Error("Expected an error registering a backend without New")
+	}
+
+	names := strings.Join(Backends(), ",")
+	if !strings.HasPrefix(names, "tc,pfctl,ipfw") || !strings.Contains(names, "proxy") {
+		t.Errorf("Expected the built-in and registered backends, got %s", names)
+	}
+}
+
+func TestDefaultBackend(t *testing.T) {
+	r := newCmdRecorder()
+	r.cmdBlackList = []string{pfctl}
+	b, err := defaultBackend(r, darwin)
+	if err != nil || b.Name != BackendIpfw {
+		t.Errorf("Expected ipfw without pfctl, got %v", err)
+	}
+
+	r.cmdBlackList = []string{pfctl, ipfw}
+	if _, err := defaultBackend(r, darwin); err == nil || !strings.Contains(err.Error(), "tried pfctl, ipfw") {
+		t.Errorf("Expected the tried tools in the error, got %v", err)
+	}
+
+	// tc outside of PATH, in /sbin say
+	r.cmdBlackList = []string{"tc"}
+	if b, err := defaultBackend(r, linux); err != nil || b.Name != BackendTc {
+		t.Errorf("Expected tc on Linux anyway, got %v", err)
+	}
+}
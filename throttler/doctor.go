@@ -0,0 +1,210 @@
+package throttler
+
+import (
+	"fmt"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	doctorNoPassword = `%s -n true`
+	doctorTcVersion  = `tc -V`
+	doctorModule     = `modinfo -F filename %s`
+	doctorSysModule  = `ls -d /sys/module/%s`
+	doctorKldModule  = `kldstat -q -m %s`
+	doctorModulesFix = `install your distribution's extra kernel modules (e.g. sudo apt install linux-modules-extra-$(uname -r)) or use a kernel built with it`
+)
+
+// Check statuses.
+const (
+	CheckOK   = "ok"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+)
+
+// Check is the outcome of one pre-flight check, with how to fix it if it
+// didn't pass.
+type Check struct {
+	Name   string
+	Status string
+	Detail string
+	Fix    string
+}
+
+// Doctor checks that what the throttler for this OS needs is in place,
+// without changing anything.
+func Doctor(cfg *Config) []Check {
+	return doctor(cfg, &quietCommander{}, runtime.GOOS, isPrivileged())
+}
+
+func doctor(cfg *Config, c commander, goos string, privileged bool) []Check {
+	checks := []Check{privilegeCheck(c, cfg.Privilege, privileged)}
+
+	switch goos {
+	case linux:
+		device := cfg.Device
+		if device == "" {
+			device = "eth0"
+		}
+
+		checks = append(checks,
+			toolCheck(c, "tc", "install iproute2"),
+			tcVersionCheck(c),
+			toolCheck(c, ip4Tables, "install iptables"),
+			toolCheck(c, ip6Tables, "install iptables (ip6tables is only needed for IPv6 targets)"),
+			moduleCheck(c, "sch_htb", CheckFail, "shapes bandwidth"),
+			moduleCheck(c, "sch_netem", CheckFail, "adds latency and loss"),
+			moduleCheck(c, "xt_CLASSIFY", CheckFail, "sends targeted traffic into the shaped class"),
+			moduleCheck(c, "ifb", CheckWarn, "is only needed to shape incoming traffic"),
+			rootQDiscCheck(c, &Config{Device: device}),
+		)
+	case darwin:
+		pf := c.commandExists(pfctl) && c.commandExists("dnctl")
+		if pf {
+			checks = append(checks, Check{Name: "pfctl", Status: CheckOK, Detail: "pfctl and dnctl found"})
+		} else if c.commandExists(ipfw) {
+			checks = append(checks, Check{Name: "ipfw", Status: CheckOK, Detail: "ipfw found"})
+		} else {
+			checks = append(checks, Check{Name: "firewall", Status: CheckFail, Detail: "neither pfctl and dnctl nor ipfw found", Fix: "comcast needs pf and dummynet (macOS 10.10+) or ipfw"})
+		}
+	case freebsd:
+		checks = append(checks,
+			toolCheck(c, ipfw, "ipfw is part of the base system, check your PATH"),
+			kldCheck(c, "ipfw", "sudo kldload ipfw, or ipfw_load=\"YES\" in /boot/loader.conf; note it blocks all traffic by default unless net.inet.ip.fw.default_to_accept=1"),
+			kldCheck(c, "dummynet", "sudo kldload dummynet, or dummynet_load=\"YES\" in /boot/loader.conf"),
+		)
+	default:
+		checks = append(checks, Check{Name: "os", Status: CheckFail, Detail: fmt.Sprintf("%s isn't supported", goos), Fix: "comcast runs on Linux, macOS and FreeBSD"})
+	}
+
+	return checks
+}
+
+func privilegeCheck(c commander, strategy string, privileged bool) Check {
+	check := Check{Name: "privileges", Status: CheckOK}
+	prefix := privilegePrefix(strategy, privileged, c.commandExists)
+	switch {
+	case len(prefix) == 0 && privileged:
+		check.Detail = "running as root or with CAP_NET_ADMIN"
+	case len(prefix) == 0:
+		check.Status = CheckFail
+		check.Detail = "not root, without CAP_NET_ADMIN and with nothing to get privileges"
+		if strategy == "" || strategy == PrivilegeAuto {
+			check.Detail = "not root, without CAP_NET_ADMIN and neither sudo nor doas found"
+		}
+		check.Fix = "run comcast as root, grant it CAP_NET_ADMIN, or install sudo or doas"
+	case !c.commandExists(prefix[0]):
+		check.Status = CheckFail
+		check.Detail = fmt.Sprintf("%s not found", prefix[0])
+		check.Fix = "install it or pick another --privilege"
+	case len(prefix) == 1 && (prefix[0] == PrivilegeSudo || prefix[0] == PrivilegeDoas):
+		if err := c.execute(args(doctorNoPassword, prefix[0])); err != nil {
+			check.Status = CheckFail
+			check.Detail = fmt.Sprintf("%s asks for a password", prefix[0])
+			check.Fix = fmt.Sprintf("run comcast as root, run %s once first, or allow the firewall tools without a password in its config", prefix[0])
+		} else {
+			check.Detail = fmt.Sprintf("%s works without a password", prefix[0])
+		}
+	default:
+		check.Detail = "using " + shellJoin(prefix)
+	}
+	return check
+}
+
+func toolCheck(c commander, tool, fix string) Check {
+	if c.commandExists(tool) {
+		return Check{Name: tool, Status: CheckOK, Detail: "found"}
+	}
+	return Check{Name: tool, Status: CheckFail, Detail: "not found", Fix: fix}
+}
+
+var iproute2Version = regexp.MustCompile(`iproute2-(ss)?(\d+)[0-9.]*`)
+
+func tcVersionCheck(c commander) Check {
+	check := Check{Name: "iproute2", Status: CheckWarn, Detail: "couldn't tell the version"}
+	lines, err := c.executeGetLines(args(doctorTcVersion))
+	if err != nil || len(lines) == 0 {
+		return check
+	}
+
+	m := iproute2Version.FindStringSubmatch(lines[0])
+	if m == nil {
+		return check
+	}
+	check.Detail = strings.TrimPrefix(m[0], "iproute2-")
+
+	// netem rate arrived in 3.3, when versions were still dated snapshots
+	n, _ := strconv.Atoi(m[2])
+	if (m[1] == "ss" && n < 120319) || (m[1] == "" && n < 3) {
+		check.Detail += ", too old for netem rate"
+		check.Fix = "upgrade iproute2 to use --target-bw"
+		return check
+	}
+	check.Status = CheckOK
+	return check
+}
+
+func moduleCheck(c commander, module, severity, purpose string) Check {
+	check := Check{Name: module, Status: CheckOK}
+
+	if lines, err := c.executeGetLines(args(doctorSysModule, module)); err == nil && len(lines) > 0 {
+		check.Detail = "loaded"
+		return check
+	}
+	if lines, err := c.executeGetLines(args(doctorModule, module)); err == nil && len(lines) > 0 {
+		check.Detail = "available, loaded on demand"
+		if lines[0] == "(builtin)" {
+			check.Detail = "built into the kernel"
+		}
+		return check
+	}
+
+	check.Status = severity
+	check.Detail = "not available, it " + purpose
+	check.Fix = doctorModulesFix
+	return check
+}
+
+func rootQDiscCheck(c commander, cfg *Config) Check {
+	check := Check{Name: "root qdisc", Status: CheckOK}
+	device := cfg.Device
+	lines, err := c.executeGetLines(args(tcShowQDisc, device))
+	if err != nil {
+		check.Status = CheckFail
+		check.Detail = fmt.Sprintf("couldn't look at device %s", device)
+		check.Fix = "pick the device traffic leaves through with --device, see ip route get <target>"
+		return check
+	}
+
+	tree := treeOf(lines, func() []string { return readState(cfg, c) })
+	kind, handle := rootQDisc(lines)
+	switch {
+	case tree.own || tree.graft && len(comcastLeaves(lines, tree.major)) > 0:
+		check.Status = CheckWarn
+		check.Detail = fmt.Sprintf("comcast's rules are already set up on %s", device)
+		check.Fix = "run comcast --stop first"
+	case handle == "":
+		check.Detail = fmt.Sprintf("%s has no root qdisc", device)
+	case handle == "0:":
+		check.Detail = fmt.Sprintf("%s has the default %s", device, kind)
+	case tree.graft:
+		check.Detail = fmt.Sprintf("%s has an HTB root qdisc %s that comcast grafts its classes onto", device, handle)
+	case kind == "hfsc" || kind == "drr" || kind == "qfq" || kind == "cbq":
+		check.Status = CheckFail
+		check.Detail = fmt.Sprintf("%s already has a %s root qdisc whose classes comcast couldn't restore after replacing it", device, kind)
+		check.Fix = fmt.Sprintf("remove it with sudo tc qdisc del dev %s root if nothing needs it", device)
+	default:
+		check.Status = CheckWarn
+		check.Detail = fmt.Sprintf("%s has a %s root qdisc that comcast replaces while its rules are set up, restoring it on --stop", device, kind)
+	}
+	return check
+}
+
+func kldCheck(c commander, module, fix string) Check {
+	if err := c.execute(args(doctorKldModule, module)); err == nil {
+		return Check{Name: module + " module", Status: CheckOK, Detail: "loaded"}
+	}
+	return Check{Name: module + " module", Status: CheckFail, Detail: "not loaded", Fix: fix}
+}
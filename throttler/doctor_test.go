@@ -0,0 +1,138 @@
+package throttler
+
+import (
+	"errors"
+	"testing"
+)
+
+func checkStatuses(checks []Check) map[string]string {
+	statuses := map[string]string{}
+	for _, check := range checks {
+		statuses[check.Name] = check.Status
+	}
+	return statuses
+}
+
+func verifyStatuses(t *testing.T, checks []Check, expected map[string]string) {
+	statuses := checkStatuses(checks)
+	for name, status := range expected {
+		if statuses[name] != status {
+			t.Errorf("Expected %s to be %s, got %s", name, status, statuses[name])
+		}
+	}
+	for _, check := range checks {
+		if check.Status != CheckOK && check.Fix == "" {
+			t.Errorf("Expected a fix for %s", check.Name)
+		}
+	}
+}
+
+func TestDoctorLinux(t *testing.T) {
+	r := newCmdRecorder()
+	r.cmdBlackList = []string{"ip6tables"}
+	r.responses = map[string][]string{
+		"tc -V":                         {"tc utility, iproute2-6.1.0, libbpf 1.1.2"},
+		"ls -d /sys/module/sch_htb":     {"/sys/module/sch_htb"},
+		"modinfo -F filename sch_netem": {"/lib/modules/6.1.0/kernel/net/sched/sch_netem.ko"},
+		"modinfo -F filename ifb":       {"(builtin)"},
+		"tc qdisc show dev eth1":        {"qdisc fq_codel 0: root refcnt 2 limit 10240p flows 1024"},
+	}
+	checks := doctor(&Config{Device: "eth1"}, r, linux, false)
+
+	verifyStatuses(t, checks, map[string]string{
+		"privileges":  CheckOK,
+		"tc":          CheckOK,
+		"iproute2":    CheckOK,
+		"iptables":    CheckOK,
+		"ip6tables":   CheckFail,
+		"sch_htb":     CheckOK,
+		"sch_netem":   CheckOK,
+		"xt_CLASSIFY": CheckFail,
+		"ifb":         CheckOK,
+		"root qdisc":  CheckOK,
+	})
+}
+
+func TestDoctorRootQDisc(t *testing.T) {
+	for line, expected := range map[string]string{
+		"qdisc noqueue 0: root refcnt 2":                              CheckOK,
+		"qdisc htb 10: root refcnt 2 r2q 10 default 0x1":              CheckOK,
+		"qdisc tbf 8001: root refcnt 2 rate 1Mbit burst 32Kb lat 0us": CheckWarn,
+		"qdisc htb 1: root refcnt 2 r2q 10 default 0x30":              CheckOK,
+		"qdisc hfsc 1: root refcnt 2 default 10":                      CheckFail,
+	} {
+		r := newCmdRecorder()
+		r.responses["tc qdisc show dev eth0"] = []string{line}
+		if check := rootQDiscCheck(r, &Config{Device: "eth0"}); check.Status != expected {
+			t.Errorf("Expected %s for %q, got %s (%s)", expected, line, check.Status, check.Detail)
+		}
+	}
+
+	// Only comcast's own tree or classes count as its rules being set up
+	for _, lines := range [][]string{
+		tcRootQDiscShow,
+		append(tcForeignHTBShow, "qdisc netem 100: parent 1:10 limit 1000 loss 0.1%"),
+	} {
+		r := newCmdRecorder()
+		r.responses["tc qdisc show dev eth0"] = lines
+		if check := rootQDiscCheck(r, &Config{Device: "eth0"}); check.Status != CheckWarn || check.Fix != "run comcast --stop first" {
+			t.Errorf("Expected comcast's rules to be found in %q, got %s (%s)", lines, check.Status, check.Detail)
+		}
+	}
+}
+
+func TestDoctorIproute2Version(t *testing.T) {
+	for version, expected := range map[string]string{
+		"tc utility, iproute2-ss180813": CheckOK,
+		"tc utility, iproute2-ss100224": CheckWarn,
+		"tc utility, iproute2-5.15.0":   CheckOK,
+		"tc utility, iproute2-2.6.39":   CheckWarn,
+		"garbage":                       CheckWarn,
+	} {
+		r := newCmdRecorder()
+		r.responses["tc -V"] = []string{version}
+		if check := tcVersionCheck(r); check.Status != expected {
+			t.Errorf("Expected %s for %q, got %s", expected, version, check.Status)
+		}
+	}
+}
+
+func TestDoctorPrivileges(t *testing.T) {
+	r := newCmdRecorder()
+	if check := privilegeCheck(r, "", false); check.Status != CheckOK || check.Detail != "sudo works without a password" {
+		t.Errorf("Expected sudo to work, got %+v", check)
+	}
+
+	r.failures["doas -n true"] = errors.New("exit status 1")
+	if check := privilegeCheck(r, PrivilegeDoas, false); check.Status != CheckFail {
+		t.Errorf("Expected doas asking for a password to fail, got %+v", check)
+	}
+
+	r.cmdBlackList = []string{"sudo", "doas"}
+	if check := privilegeCheck(r, "", false); check.Status != CheckFail || check.Fix == "" {
+		t.Errorf("Expected no way to get privileges to fail, got %+v", check)
+	}
+	if check := privilegeCheck(r, "", true); check.Status != CheckOK {
+		t.Errorf("Expected CAP_NET_ADMIN to be enough, got %+v", check)
+	}
+	r.verifyCommands(t, []string{"sudo -n true", "doas -n true"})
+}
+
+func TestDoctorDarwin(t *testing.T) {
+	r := newCmdRecorder()
+	r.cmdBlackList = []string{"dnctl"}
+	verifyStatuses(t, doctor(&Config{}, r, darwin, true), map[string]string{"ipfw": CheckOK})
+
+	r.cmdBlackList = []string{"dnctl", "ipfw"}
+	verifyStatuses(t, doctor(&Config{}, r, darwin, true), map[string]string{"firewall": CheckFail})
+}
+
+func TestDoctorFreeBSD(t *testing.T) {
+	r := newCmdRecorder()
+	r.failures["kldstat -q -m ipfw"] = errors.New("exit status 1")
+	verifyStatuses(t, doctor(&Config{Device: "em0"}, r, freebsd, true), map[string]string{
+		"ipfw":            CheckOK,
+		"ipfw module":     CheckFail,
+		"dummynet module": CheckOK,
+	})
+}
@@ -0,0 +1,274 @@
+package throttler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Export formats. Each is a shell script; all but sh batch the commands of
+// one tool through its own batch input, so they can be reviewed in the form
+// that tool reads.
+const (
+	FormatSh              = "sh"
+	FormatTcBatch         = "tc-batch"
+	FormatIptablesRestore = "iptables-restore"
+	FormatPfAnchor        = "pf-anchor"
+	FormatIpfw            = "ipfw"
+)
+
+const (
+	pfAnchorFile = `/etc/pf.anchors/comcast`
+	scriptHeader = "#!/bin/sh\n# %s the packet rules, as exported by comcast\n"
+)
+
+// undoer is implemented by throttlers whose teardown looks at the live rules,
+// to remove exactly what setup adds for a Config instead.
+type undoer interface {
+	undo(*Config) error
+}
+
+// collectCommander collects the commands it's given instead of running them.
+// What they read comes from reader, if any, as reading changes nothing.
+type collectCommander struct {
+	commands []command
+	reader   commander
+}
+
+// command is a collected command, with what it's fed on stdin.
+type command struct {
+	argv  []string
+	input string
+}
+
+func (c *collectCommander) execute(cmd []string) error {
+	c.commands = append(c.commands, command{argv: cmd})
+	return nil
+}
+
+func (c *collectCommander) executeGetLines(cmd []string) ([]string, error) {
+	if c.reader != nil {
+		return c.reader.executeGetLines(cmd)
+	}
+	return []string{}, nil
+}
+
+func (c *collectCommander) executeInput(cmd []string, input string) error {
+	c.commands = append(c.commands, command{argv: cmd, input: input})
+	return nil
+}
+
+func (c *collectCommander) commandExists(cmd string) bool {
+	return true
+}
+
+// Export returns the scripts that set up and tear down the packet rules for
+// cfg, without running anything. Commands get a privilege prefix only when
+// cfg names one, as the scripts may well run elsewhere.
+func Export(cfg *Config, format string) (string, string, error) {
+	return export(cfg, format, func(c commander) (throttler, error) {
+		return newThrottler(cfg, c)
+	})
+}
+
+func export(cfg *Config, format string, backend func(commander) (throttler, error)) (string, string, error) {
+	batch, found := batchers[format]
+	if !found {
+		return "", "", fmt.Errorf("Unknown export format %s", format)
+	}
+
+	setup := &collectCommander{}
+	t, err := backend(setup)
+	if err != nil {
+		return "", "", err
+	}
+	if err := t.setup(cfg); err != nil {
+		return "", "", err
+	}
+
+	teardown := &collectCommander{}
+	t, _ = backend(teardown)
+	if u, ok := t.(undoer); ok {
+		err = u.undo(cfg)
+	} else {
+		err = t.teardown(cfg)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	apply, batched := batch(setup.commands, false)
+	if !batched {
+		return "", "", fmt.Errorf("The %s format doesn't apply to these rules, try %s", format, FormatSh)
+	}
+	undo, _ := batch(teardown.commands, true)
+
+	prefix := []string{}
+	if cfg.Privilege != "" && cfg.Privilege != PrivilegeAuto {
+		prefix = privilegePrefix(cfg.Privilege, false, func(string) bool { return false })
+	}
+	return renderScript("Sets up", apply, prefix, true), renderScript("Tears down", undo, prefix, false), nil
+}
+
+// renderScript writes cmds as a shell script, feeding inputs as here-documents.
+// Setup stops at the first failure, while teardown removes what it can.
+func renderScript(what string, cmds []command, prefix []string, stop bool) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, scriptHeader, what)
+	if stop {
+		b.WriteString("set -e\n")
+	}
+	b.WriteString("\n")
+
+	for _, cmd := range cmds {
+		b.WriteString(shellJoin(concat(prefix, cmd.argv)))
+		if cmd.input != "" {
+			fmt.Fprintf(&b, " <<'EOF'\n%s\nEOF", strings.TrimRight(cmd.input, "\n"))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// batchers rewrite the commands for each format, reporting whether there was
+// anything for the format to batch.
+var batchers = map[string]func(cmds []command, teardown bool) ([]command, bool){
+	FormatSh: func(cmds []command, _ bool) ([]command, bool) {
+		return cmds, true
+	},
+	FormatTcBatch: func(cmds []command, _ bool) ([]command, bool) {
+		return batchRuns(cmds, func(cmd command) string {
+			return toolOf(cmd, "tc")
+		}, func(_ string, run []command) command {
+			lines := []string{}
+			for _, cmd := range run {
+				lines = append(lines, strings.Join(cmd.argv[1:], " "))
+			}
+			return command{argv: []string{"tc", "-batch", "-"}, input: strings.Join(lines, "\n")}
+		})
+	},
+	FormatIptablesRestore: func(cmds []command, _ bool) ([]command, bool) {
+		return batchRuns(cmds, func(cmd command) string {
+			if tool := toolOf(cmd, ip4Tables); tool != "" {
+				return tool
+			}
+			return toolOf(cmd, ip6Tables)
+		}, iptablesRestore)
+	},
+	FormatIpfw: func(cmds []command, _ bool) ([]command, bool) {
+		return batchRuns(cmds, func(cmd command) string {
+			return toolOf(cmd, ipfw)
+		}, func(_ string, run []command) command {
+			lines := []string{}
+			for _, cmd := range run {
+				lines = append(lines, strings.Join(cmd.argv[1:], " "))
+			}
+			return command{argv: []string{ipfw, "-q", "/dev/stdin"}, input: strings.Join(lines, "\n")}
+		})
+	},
+	FormatPfAnchor: pfAnchor,
+}
+
+// toolOf returns tool if cmd runs it without any input of its own.
+func toolOf(cmd command, tool string) string {
+	if len(cmd.argv) > 1 && cmd.argv[0] == tool && cmd.input == "" {
+		return tool
+	}
+	return ""
+}
+
+// batchRuns replaces each run of consecutive commands that key puts in the
+// same batch with the one command merge makes of them.
+func batchRuns(cmds []command, key func(command) string, merge func(string, []command) command) ([]command, bool) {
+	batched := []command{}
+	found := false
+	for i := 0; i < len(cmds); {
+		k := key(cmds[i])
+		if k == "" {
+			batched = append(batched, cmds[i])
+			i++
+			continue
+		}
+
+		j := i
+		for j < len(cmds) && key(cmds[j]) == k {
+			j++
+		}
+		batched = append(batched, merge(k, cmds[i:j]))
+		found = true
+		i = j
+	}
+	return batched, found
+}
+
+// iptablesRestore turns iptables commands into one iptables-restore that
+// leaves the other rules in place, grouping them by table.
+func iptablesRestore(tool string, run []command) command {
+	tables := []string{}
+	rules := map[string][]string{}
+	for _, cmd := range run {
+		table, rule := "filter", []string{}
+		for i := 1; i < len(cmd.argv); i++ {
+			if cmd.argv[i] == "-t" && i+1 < len(cmd.argv) {
+				table = cmd.argv[i+1]
+				i++
+				continue
+			}
+			rule = append(rule, cmd.argv[i])
+		}
+		if _, found := rules[table]; !found {
+			tables = append(tables, table)
+		}
+		rules[table] = append(rules[table], strings.Join(rule, " "))
+	}
+
+	lines := []string{}
+	for _, table := range tables {
+		lines = append(lines, "*"+table)
+		lines = append(lines, rules[table]...)
+		lines = append(lines, "COMMIT")
+	}
+	return command{argv: []string{tool + "-restore", "--noflush"}, input: strings.Join(lines, "\n")}
+}
+
+// restoredRules returns the rules an iptables-restore batch adds, as the
+// commands that would add them one by one.
+func restoredRules(restore, input string) [][]string {
+	tool := strings.TrimSuffix(restore, "-restore")
+	table := "filter"
+	rules := [][]string{}
+	for _, line := range strings.Split(input, "\n") {
+		switch {
+		case strings.HasPrefix(line, "*"):
+			table = line[1:]
+		case strings.HasPrefix(line, "-A "):
+			rule := []string{tool}
+			if table != "filter" {
+				rule = append(rule, "-t", table)
+			}
+			rules = append(rules, concat(rule, strings.Fields(line)))
+		}
+	}
+	return rules
+}
+
+// pfAnchor keeps the rules loaded into the anchor in a file of their own,
+// where pf keeps its other anchors, and loads them from there.
+func pfAnchor(cmds []command, teardown bool) ([]command, bool) {
+	anchored := []command{}
+	found := false
+	for _, cmd := range cmds {
+		if len(cmd.argv) == 5 && cmd.argv[0] == pfctl && cmd.argv[1] == "-a" && cmd.argv[4] == "-" {
+			anchored = append(anchored,
+				command{argv: []string{"tee", pfAnchorFile}, input: cmd.input},
+				command{argv: []string{pfctl, "-a", cmd.argv[2], "-f", pfAnchorFile}},
+			)
+			found = true
+			continue
+		}
+		anchored = append(anchored, cmd)
+	}
+	if teardown {
+		anchored = append(anchored, command{argv: []string{"rm", "-f", pfAnchorFile}})
+	}
+	return anchored, found
+}
@@ -0,0 +1,163 @@
+package throttler
+
+import (
+	"strings"
+	"testing"
+)
+
+func exportWith(t *testing.T, cfg *Config, format string, backend func(commander) throttler) (string, string) {
+	apply, teardown, err := export(cfg, format, func(c commander) (throttler, error) {
+		return backend(c), nil
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return apply, teardown
+}
+
+func tcBackend(c commander) throttler {
+	return &tcThrottler{c}
+}
+
+func verifyScript(t *testing.T, actual, expected string) {
+	if actual != expected {
+		t.Errorf("Expected script:\n%s\ngot:\n%s", expected, actual)
+	}
+}
+
+func TestExportTcSh(t *testing.T) {
+	cfg := defaultTestConfig
+	cfg.Privilege = PrivilegeSudo
+	apply, teardown := exportWith(t, &cfg, FormatSh, tcBackend)
+
+	verifyScript(t, apply, `#!/bin/sh
+# Sets up the packet rules, as exported by comcast
+set -e
+
+sudo tc qdisc add dev eth0 handle 10: root htb default 1
+sudo tc class add dev eth0 parent 10: classid 10:1 htb rate 20000kbit
+sudo tc class add dev eth0 parent 10: classid 10:10 htb rate 1000000kbit
+sudo tc qdisc add dev eth0 parent 10:10 handle 100: netem loss 0.10%
+sudo iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p tcp --dport 80 -d 10.10.10.10
+`)
+	verifyScript(t, teardown, `#!/bin/sh
+# Tears down the packet rules, as exported by comcast
+
+sudo iptables -D POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p tcp --dport 80 -d 10.10.10.10
+sudo tc qdisc del dev eth0 handle 10: root
+`)
+}
+
+func TestExportBatched(t *testing.T) {
+	cfg := defaultTestConfig
+	cfg.Latency = 100
+	apply, _ := exportWith(t, &cfg, FormatTcBatch, tcBackend)
+	verifyScript(t, apply, `#!/bin/sh
+# Sets up the packet rules, as exported by comcast
+set -e
+
+tc -batch - <<'EOF'
+qdisc add dev eth0 handle 10: root htb default 1
+class add dev eth0 parent 10: classid 10:1 htb rate 20000kbit
+class add dev eth0 parent 10: classid 10:10 htb rate 1000000kbit
+qdisc add dev eth0 parent 10:10 handle 100: netem delay 100ms loss 0.10%
+EOF
+iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p tcp --dport 80 -d 10.10.10.10
+`)
+
+	_, teardown := exportWith(t, &cfg, FormatIptablesRestore, tcBackend)
+	verifyScript(t, teardown, `#!/bin/sh
+# Tears down the packet rules, as exported by comcast
+
+iptables-restore --noflush <<'EOF'
+*mangle
+-D POSTROUTING -j CLASSIFY --set-class 10:10 -p tcp --dport 80 -d 10.10.10.10
+COMMIT
+EOF
+tc qdisc del dev eth0 handle 10: root
+`)
+
+	cfg.PacketLoss = 0
+	apply, teardown = exportWith(t, &cfg, FormatIpfw, func(c commander) throttler { return &ipfwThrottler{c} })
+	verifyScript(t, apply, `#!/bin/sh
+# Sets up the packet rules, as exported by comcast
+set -e
+
+ipfw -q /dev/stdin <<'EOF'
+add 1 pipe 1 tcp from any to 10.10.10.10 dst-port 80 via eth0
+add 1 pipe 2 ip from any to any via eth0
+pipe 1 config delay 100ms
+pipe 2 config bw 20000Kbit/s
+EOF
+`)
+	verifyScript(t, teardown, `#!/bin/sh
+# Tears down the packet rules, as exported by comcast
+
+ipfw -q /dev/stdin <<'EOF'
+delete 1
+EOF
+rm -f /var/run/comcast.applied
+`)
+}
+
+func TestExportPfAnchor(t *testing.T) {
+	cfg := defaultTestConfig
+	cfg.Partition = PartitionOut
+	cfg.TargetProtos = []string{"tcp"}
+	apply, teardown := exportWith(t, &cfg, FormatPfAnchor, func(c commander) throttler { return &pfctlThrottler{c} })
+
+	verifyScript(t, apply, `#!/bin/sh
+# Sets up the packet rules, as exported by comcast
+set -e
+
+pfctl -E
+pfctl -f - <<'EOF'
+include "/etc/pf.conf"
+dummynet-anchor "mop"
+anchor "mop"
+EOF
+tee /etc/pf.anchors/comcast <<'EOF'
+block drop out quick inet proto tcp to 10.10.10.10 port 80
+EOF
+pfctl -a mop -f /etc/pf.anchors/comcast
+`)
+	verifyScript(t, teardown, `#!/bin/sh
+# Tears down the packet rules, as exported by comcast
+
+pfctl -f /etc/pf.conf
+pfctl -d
+dnctl -q flush
+rm -f /var/run/comcast.applied
+rm -f /etc/pf.anchors/comcast
+`)
+}
+
+func TestExportFormatMismatch(t *testing.T) {
+	cfg := defaultTestConfig
+	backend := func(c commander) (throttler, error) { return &tcThrottler{c}, nil }
+	if _, _, err := export(&cfg, FormatPfAnchor, backend); err == nil {
+		t.Error("Expected an error exporting tc rules as a pf anchor")
+	}
+	if _, _, err := export(&cfg, "yaml", backend); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
+
+func TestRestoredRules(t *testing.T) {
+	rules := []command{
+		{argv: strings.Fields("iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -d 10.0.0.1")},
+		{argv: strings.Fields("iptables -A OUTPUT -d 10.0.0.1 -j DROP")},
+	}
+	restore := iptablesRestore(ip4Tables, rules)
+	actual := []string{}
+	for _, rule := range restoredRules(restore.argv[0], restore.input) {
+		actual = append(actual, strings.Join(rule, " "))
+	}
+	expected := []string{
+		"iptables -t mangle -A POSTROUTING -j CLASSIFY --set-class 10:10 -d 10.0.0.1",
+		"iptables -A OUTPUT -d 10.0.0.1 -j DROP",
+	}
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+}
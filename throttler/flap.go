@@ -0,0 +1,144 @@
+package throttler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// changer is implemented by throttlers that can update their shaping in
+// place, which is much cheaper than a teardown and setup.
+type changer interface {
+	change(*Config) error
+}
+
+// FlapSchedule says how long a flapping link stays up and down.
+type FlapSchedule struct {
+	Up   time.Duration
+	Down time.Duration
+	// Jitter randomizes each period by up to this fraction of it, e.g. 0.2
+	// for ±20%.
+	Jitter float64
+	// Seed seeds the jitter so a run can be repeated.
+	Seed int64
+}
+
+// Flap takes the link down and brings it back up on schedule until ctx is
+// done, then leaves it up. The link is taken down with 100% loss on the
+// target class, or by adding the partition rules when cfg.Partition is set,
+// so for a partition the link starts up with no rules in place. current, if
+// not nil, follows the config in effect.
+func Flap(ctx context.Context, cfg *Config, s FlapSchedule, current *Applied) error {
+	t, err := newThrottler(cfg, newCommander(cfg))
+	if err != nil {
+		return err
+	}
+	return flap(ctx, t, cfg, s, current, time.After)
+}
+
+func flap(ctx context.Context, t throttler, cfg *Config, s FlapSchedule, current *Applied, after func(time.Duration) <-chan time.Time) error {
+	if s.Up <= 0 || s.Down <= 0 {
+		return errors.New("Flapping needs both an up and a down period")
+	}
+	if cfg.Partition != "" {
+		if err := checkPartition(cfg); err != nil {
+			return err
+		}
+	}
+
+	rnd := rand.New(rand.NewSource(s.Seed))
+	up := true
+	current.set(flapped(cfg, up))
+	for {
+		d := s.Up
+		if !up {
+			d = s.Down
+		}
+		if s.Jitter > 0 {
+			d += time.Duration((rnd.Float64()*2 - 1) * s.Jitter * float64(d))
+		}
+
+		select {
+		case <-ctx.Done():
+			if up {
+				return nil
+			}
+			if err := linkUp(t, cfg); err != nil {
+				return err
+			}
+			current.set(flapped(cfg, true))
+			return nil
+		case <-after(d):
+		}
+
+		var err error
+		if up {
+			fmt.Println("Link down...")
+			err = linkDown(t, cfg)
+		} else {
+			fmt.Println("Link up...")
+			err = linkUp(t, cfg)
+		}
+		if err != nil {
+			return err
+		}
+		up = !up
+		current.set(flapped(cfg, up))
+	}
+}
+
+// flapped returns the config in effect with the link up or down, nil for a
+// partition that's up.
+func flapped(cfg *Config, up bool) *Config {
+	switch {
+	case cfg.Partition == "" && up:
+		return cfg
+	case cfg.Partition == "":
+		return downConfig(cfg)
+	case up:
+		return nil
+	default:
+		return cfg
+	}
+}
+
+func linkDown(t throttler, cfg *Config) error {
+	if cfg.Partition != "" {
+		return t.setup(cfg)
+	}
+	return change(t, downConfig(cfg))
+}
+
+// downConfig is cfg with all of the target traffic lost.
+func downConfig(cfg *Config) *Config {
+	down := *cfg
+	down.PacketLoss = 100
+	if len(cfg.Links) > 0 {
+		down.Links = make([]Link, len(cfg.Links))
+		for i, link := range cfg.Links {
+			link.PacketLoss = 100
+			down.Links[i] = link
+		}
+	}
+	return &down
+}
+
+func linkUp(t throttler, cfg *Config) error {
+	if cfg.Partition != "" {
+		return t.teardown(cfg)
+	}
+	return change(t, cfg)
+}
+
+// change updates the shaping to cfg, in place if the throttler can.
+func change(t throttler, cfg *Config) error {
+	if c, ok := t.(changer); ok {
+		return c.change(cfg)
+	}
+	if err := t.teardown(cfg); err != nil {
+		return err
+	}
+	return t.setup(cfg)
+}
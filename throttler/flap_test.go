@@ -0,0 +1,156 @@
+package throttler
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// flapTicks lets n periods elapse immediately, recording them, then cancels
+// the flapping.
+func flapTicks(n int, cancel func(), periods *[]time.Duration) func(time.Duration) <-chan time.Time {
+	return func(d time.Duration) <-chan time.Time {
+		*periods = append(*periods, d)
+		if len(*periods) > n {
+			cancel()
+			return nil
+		}
+		ch := make(chan time.Time, 1)
+		ch <- time.Now()
+		return ch
+	}
+}
+
+func TestTcFlap(t *testing.T) {
+	r := newCmdRecorder()
+	th := &tcThrottler{r}
+	cfg := defaultTestConfig
+	ctx, cancel := context.WithCancel(context.Background())
+	periods := []time.Duration{}
+
+	err := flap(ctx, th, &cfg, FlapSchedule{Up: 10 * time.Second, Down: 2 * time.Second}, nil, flapTicks(3, cancel, &periods))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	down := []string{
+		"tc qdisc show dev eth0",
+		"tc class change dev eth0 parent 10: classid 10:10 htb rate 1000000kbit",
+		"tc qdisc change dev eth0 parent 10:10 handle 100: netem loss 100.00%",
+	}
+	up := []string{
+		"tc qdisc show dev eth0",
+		"tc class change dev eth0 parent 10: classid 10:10 htb rate 1000000kbit",
+		"tc qdisc change dev eth0 parent 10:10 handle 100: netem loss 0.10%",
+	}
+	// Down, up, down, then back up when cancelled
+	expected := append(append(append(append([]string{}, down...), up...), down...), up...)
+	r.verifyCommands(t, expected)
+
+	want := []time.Duration{10 * time.Second, 2 * time.Second, 10 * time.Second, 2 * time.Second}
+	for i, d := range want {
+		if periods[i] != d {
+			t.Errorf("Expected period %d to be %s, got %s", i, d, periods[i])
+		}
+	}
+}
+
+func TestTcFlapLinks(t *testing.T) {
+	r := newCmdRecorder()
+	th := &tcThrottler{r}
+	cfg := defaultTestConfig
+	cfg.Links = []Link{{Dest: "10.0.0.1", Latency: 80, Jitter: 5}}
+	ctx, cancel := context.WithCancel(context.Background())
+	periods := []time.Duration{}
+
+	flap(ctx, th, &cfg, FlapSchedule{Up: time.Second, Down: time.Second}, nil, flapTicks(1, cancel, &periods))
+	r.verifyCommands(t, []string{
+		"tc qdisc show dev eth0",
+		"tc class change dev eth0 parent 10: classid 10:11 htb rate 1000000kbit",
+		"tc qdisc change dev eth0 parent 10:11 handle 101: netem delay 80ms 5ms loss 100.00%",
+		"tc qdisc show dev eth0",
+		"tc class change dev eth0 parent 10: classid 10:11 htb rate 1000000kbit",
+		"tc qdisc change dev eth0 parent 10:11 handle 101: netem delay 80ms 5ms",
+	})
+	if cfg.Links[0].PacketLoss != 0 {
+		t.Error("Expected flapping to leave the configured links alone")
+	}
+}
+
+func TestTcFlapPartition(t *testing.T) {
+	r := newCmdRecorder()
+	th := &tcThrottler{r}
+	cfg := defaultTestConfig
+	cfg.Partition = PartitionOut
+	ctx, cancel := context.WithCancel(context.Background())
+	periods := []time.Duration{}
+
+	// Cancelled while up, so the rules are only added and removed once
+	current := NewApplied(&cfg)
+	seen := []*Config{}
+	ticks := flapTicks(2, cancel, &periods)
+	flap(ctx, th, &cfg, FlapSchedule{Up: time.Second, Down: time.Second}, current, func(d time.Duration) <-chan time.Time {
+		seen = append(seen, current.Config())
+		return ticks(d)
+	})
+	if len(seen) != 3 || seen[0] != nil || seen[1] != &cfg || seen[2] != nil {
+		t.Errorf("Expected the partition to be in effect only while down, got %v", seen)
+	}
+	r.verifyCommands(t, []string{
+		"iptables -A OUTPUT -d 10.10.10.10 -p tcp --dport 80 -m comment --comment comcast-partition -j DROP",
+		tcReadEth0State,
+		"tc qdisc show dev eth0",
+		"iptables -S -t mangle",
+		"ip6tables -S -t mangle",
+		"iptables -S",
+		"ip6tables -S",
+	})
+}
+
+func TestIpfwFlap(t *testing.T) {
+	r := newCmdRecorder()
+	th := &ipfwThrottler{r}
+	cfg := defaultTestConfig
+	cfg.Latency = 50
+	ctx, cancel := context.WithCancel(context.Background())
+	periods := []time.Duration{}
+
+	flap(ctx, th, &cfg, FlapSchedule{Up: time.Second, Down: time.Second}, nil, flapTicks(1, cancel, &periods))
+	r.verifyCommands(t, []string{
+		"ipfw pipe 1 config delay 50ms plr 1.0000",
+		"ipfw pipe 1 config delay 50ms plr 0.0010",
+	})
+}
+
+func TestFlapJitter(t *testing.T) {
+	s := FlapSchedule{Up: 10 * time.Second, Down: 2 * time.Second, Jitter: 0.5, Seed: 42}
+	run := func() []time.Duration {
+		ctx, cancel := context.WithCancel(context.Background())
+		periods := []time.Duration{}
+		cfg := defaultTestConfig
+		flap(ctx, &tcThrottler{newCmdRecorder()}, &cfg, s, nil, flapTicks(20, cancel, &periods))
+		return periods
+	}
+
+	first, second := run(), run()
+	for i, d := range first {
+		base := s.Up
+		if i%2 == 1 {
+			base = s.Down
+		}
+		if d < base/2 || d > base*3/2 {
+			t.Errorf("Expected period %d to be within 50%% of %s, got %s", i, base, d)
+		}
+		if d != second[i] {
+			t.Errorf("Expected the same seed to give the same periods, got %s and %s", d, second[i])
+		}
+	}
+}
+
+func TestFlapNeedsPeriods(t *testing.T) {
+	cfg := defaultTestConfig
+	err := flap(context.Background(), &tcThrottler{newCmdRecorder()}, &cfg, FlapSchedule{Up: time.Second}, nil, time.After)
+	if err == nil {
+		t.Error("Expected an error without a down period")
+	}
+}
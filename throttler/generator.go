@@ -0,0 +1,121 @@
+package throttler
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Generator gives a value, such as a bandwidth in kbit/s, at a point in time.
+type Generator func(at time.Duration) float64
+
+// Ramp goes linearly from one value to another over a duration, then holds.
+func Ramp(from, to float64, over time.Duration) Generator {
+	return func(at time.Duration) float64 {
+		if at >= over || over <= 0 {
+			return to
+		}
+		return from + (to-from)*float64(at)/float64(over)
+	}
+}
+
+// Sine oscillates around mid by up to amplitude, once per period.
+func Sine(mid, amplitude float64, period time.Duration) Generator {
+	return func(at time.Duration) float64 {
+		return mid + amplitude*math.Sin(2*math.Pi*float64(at)/float64(period))
+	}
+}
+
+// RandomWalk starts at start and moves up or down by up to step every
+// interval, staying within min and max. The same seed gives the same walk.
+func RandomWalk(start, step, min, max float64, interval time.Duration, seed int64) Generator {
+	rnd := rand.New(rand.NewSource(seed))
+	walk := []float64{math.Max(min, math.Min(max, start))}
+
+	return func(at time.Duration) float64 {
+		n := int(at / interval)
+		for len(walk) <= n {
+			next := walk[len(walk)-1] + (rnd.Float64()*2-1)*step
+			walk = append(walk, math.Max(min, math.Min(max, next)))
+		}
+		return walk[n]
+	}
+}
+
+// ParseGenerator parses a generator given as ramp:<from>:<to>:<duration>,
+// sine:<mid>:<amplitude>:<period> or walk:<start>:<step>:<min>:<max>. A random
+// walk takes a step every tick, seeded by seed.
+func ParseGenerator(spec string, seed int64, tick time.Duration) (Generator, error) {
+	parts := strings.Split(spec, ":")
+	params := parts[1:]
+
+	switch parts[0] {
+	case "ramp":
+		if len(params) == 3 {
+			from, err1 := strconv.ParseFloat(params[0], 64)
+			to, err2 := strconv.ParseFloat(params[1], 64)
+			over, err3 := time.ParseDuration(params[2])
+			if err1 == nil && err2 == nil && err3 == nil && over > 0 {
+				return Ramp(from, to, over), nil
+			}
+		}
+		return nil, fmt.Errorf("invalid ramp %q, expected ramp:<from>:<to>:<duration>", spec)
+	case "sine":
+		if len(params) == 3 {
+			mid, err1 := strconv.ParseFloat(params[0], 64)
+			amplitude, err2 := strconv.ParseFloat(params[1], 64)
+			period, err3 := time.ParseDuration(params[2])
+			if err1 == nil && err2 == nil && err3 == nil && period > 0 {
+				return Sine(mid, amplitude, period), nil
+			}
+		}
+		return nil, fmt.Errorf("invalid sine %q, expected sine:<mid>:<amplitude>:<period>", spec)
+	case "walk":
+		if len(params) == 4 {
+			vals := make([]float64, 4)
+			var err error
+			for i, param := range params {
+				if vals[i], err = strconv.ParseFloat(param, 64); err != nil {
+					break
+				}
+			}
+			if err == nil && vals[2] <= vals[3] {
+				if tick <= 0 {
+					return nil, errors.New("a random walk needs a positive tick")
+				}
+				return RandomWalk(vals[0], vals[1], vals[2], vals[3], tick, seed), nil
+			}
+		}
+		return nil, fmt.Errorf("invalid random walk %q, expected walk:<start>:<step>:<min>:<max>", spec)
+	default:
+		return nil, fmt.Errorf("unknown generator %q (expected ramp, sine or walk)", parts[0])
+	}
+}
+
+// Generated is a Source whose shaping comes from a generator per value. A nil
+// generator leaves its value as configured. It never runs out.
+type Generated struct {
+	Bandwidth  Generator // kbit/s
+	Latency    Generator // ms
+	PacketLoss Generator // percent
+}
+
+// Sample returns the generated shaping at time at, kept within what the
+// throttlers accept.
+func (g *Generated) Sample(at time.Duration) (Sample, bool) {
+	s := Sample{At: at, Bandwidth: -1, Latency: -1, PacketLoss: -1}
+	if g.Bandwidth != nil {
+		s.Bandwidth = int(math.Max(1, math.Round(g.Bandwidth(at))))
+	}
+	if g.Latency != nil {
+		s.Latency = int(math.Max(0, math.Round(g.Latency(at))))
+	}
+	if g.PacketLoss != nil {
+		s.PacketLoss = math.Max(0, math.Min(100, g.PacketLoss(at)))
+	}
+	return s, true
+}
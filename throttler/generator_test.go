@@ -0,0 +1,106 @@
+package throttler
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRamp(t *testing.T) {
+	ramp := Ramp(5000, 500, 60*time.Second)
+	for at, expected := range map[time.Duration]float64{
+		0:                5000,
+		30 * time.Second: 2750,
+		60 * time.Second: 500,
+		90 * time.Second: 500,
+	} {
+		if v := ramp(at); v != expected {
+			t.Errorf("Expected %v at %s, got %v", expected, at, v)
+		}
+	}
+}
+
+func TestSine(t *testing.T) {
+	sine := Sine(100, 50, 4*time.Second)
+	for at, expected := range map[time.Duration]float64{
+		0:               100,
+		time.Second:     150,
+		3 * time.Second: 50,
+	} {
+		if v := sine(at); math.Abs(v-expected) > 1e-9 {
+			t.Errorf("Expected %v at %s, got %v", expected, at, v)
+		}
+	}
+}
+
+func TestRandomWalk(t *testing.T) {
+	walk := RandomWalk(1000, 400, 500, 1500, time.Second, 7)
+	again := RandomWalk(1000, 400, 500, 1500, time.Second, 7)
+
+	if v := walk(0); v != 1000 {
+		t.Errorf("Expected the walk to start at 1000, got %v", v)
+	}
+	prev := walk(0)
+	for i := 1; i < 100; i++ {
+		at := time.Duration(i) * time.Second
+		v := walk(at)
+		if v < 500 || v > 1500 {
+			t.Errorf("Expected the walk to stay within bounds, got %v", v)
+		}
+		if math.Abs(v-prev) > 400 {
+			t.Errorf("Expected steps of at most 400, went from %v to %v", prev, v)
+		}
+		prev = v
+	}
+	// Asking out of order gives the same walk
+	if walk(50*time.Second) != again(50*time.Second) || walk(20*time.Second) != again(20*time.Second) {
+		t.Error("Expected the same seed to give the same walk")
+	}
+}
+
+func TestParseGenerator(t *testing.T) {
+	for _, spec := range []string{"ramp:5000:500:60s", "sine:2000:1500:30s", "walk:2000:100:500:5000"} {
+		if _, err := ParseGenerator(spec, 1, time.Second); err != nil {
+			t.Errorf("Unexpected error parsing %s: %s", spec, err)
+		}
+	}
+	for _, spec := range []string{"ramp:5000:500", "sine:a:b:30s", "walk:1:1:10:5", "square:1:2:3s", "ramp:1:2:-1s"} {
+		if _, err := ParseGenerator(spec, 1, time.Second); err == nil {
+			t.Errorf("Expected an error parsing %s", spec)
+		}
+	}
+}
+
+func TestGeneratedSample(t *testing.T) {
+	g := &Generated{
+		Bandwidth:  Ramp(10, -10, 10*time.Second),
+		PacketLoss: Sine(90, 20, 4*time.Second),
+	}
+	s, ok := g.Sample(time.Second)
+	if !ok || s.Bandwidth != 8 || s.Latency != -1 || s.PacketLoss != 100 {
+		t.Errorf("Unexpected sample %v", s)
+	}
+	s, _ = g.Sample(10 * time.Second)
+	if s.Bandwidth != 1 {
+		t.Errorf("Expected bandwidth to stay positive, got %v", s.Bandwidth)
+	}
+}
+
+func TestTcReplayGenerated(t *testing.T) {
+	r := newCmdRecorder()
+	cfg := defaultTestConfig
+	g := &Generated{Bandwidth: Ramp(3000, 1000, 2*time.Second)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := &fakeClock{now: time.Unix(0, 0), n: 3, cancel: cancel}
+	replay(ctx, &tcThrottler{r}, &cfg, g, time.Second, nil, clock.Now, clock.After)
+	r.verifyCommands(t, []string{
+		"tc qdisc show dev eth0",
+		"tc class change dev eth0 parent 10: classid 10:10 htb rate 2000kbit",
+		"tc qdisc change dev eth0 parent 10:10 handle 100: netem rate 2000kbit loss 0.10%",
+		"tc qdisc show dev eth0",
+		"tc class change dev eth0 parent 10: classid 10:10 htb rate 1000kbit",
+		"tc qdisc change dev eth0 parent 10:10 handle 100: netem rate 1000kbit loss 0.10%",
+	})
+}
@@ -2,14 +2,21 @@ package throttler
 
 import (
 	"strconv"
+	"strings"
 )
 
 const (
-	ipfwAddPipe  = `sudo ipfw add 1 pipe 1 ip from any to any via `
-	ipfwTeardown = `sudo ipfw delete 1`
-	ipfwConfig   = `sudo ipfw pipe 1 config`
-	ipfwExists   = `sudo ipfw list | grep "pipe 1"`
-	ipfwCheck    = `sudo ipfw list`
+	ipfwAddPipe  = `ipfw add 1 pipe 1 ip from any to any via %s`
+	ipfwTeardown = `ipfw delete 1`
+	ipfwConfig   = `ipfw pipe 1 config`
+	ipfwExists   = `ipfw list`
+	ipfwRuleNum  = `00001 `
+	ipfwAddRule  = `ipfw add 1`
+	ipfwCheck    = `ipfw list`
+	ipfwPipe     = `pipe 1`
+	ipfwVia      = `via %s`
+	ipfwFastLane = `ipfw add 1 pipe 2 ip from any to any via %s`
+	ipfwFastBw   = `ipfw pipe 2 config bw %dKbit/s`
 )
 
 type ipfwThrottler struct {
@@ -17,47 +24,165 @@ type ipfwThrottler struct {
 }
 
 func (i *ipfwThrottler) setup(c *Config) error {
-	cmd := ipfwAddPipe + c.Device
-	err := i.c.execute(cmd)
-	if err != nil {
+	if err := checkTcOnly(c); err != nil {
 		return err
 	}
 
+	if c.Partition != "" {
+		return i.setupPartition(c)
+	}
+
+	for _, cmd := range ipfwPipeRules(c) {
+		if err := i.c.execute(cmd); err != nil {
+			return err
+		}
+	}
+
 	configCmd := i.buildConfigCommand(c)
-	err = i.c.execute(configCmd)
+	err := i.c.execute(configCmd)
+	if err == nil && fastLane(c) {
+		err = i.c.execute(args(ipfwFastBw, c.DefaultBandwidth))
+	}
 	return err
 }
 
+// ipfwPipeRules sends the targeted traffic through pipe 1, or all of it if
+// nothing is targeted. Other traffic goes through pipe 2, limited to the
+// default bandwidth, in a rule after the targeted ones. All of them are
+// numbered 1, so teardown removes them together.
+func ipfwPipeRules(c *Config) [][]string {
+	if !targeted(c) {
+		return [][]string{args(ipfwAddPipe, c.Device)}
+	}
+
+	pipe := func(string) []string { return args(ipfwPipe) }
+	rules := ipfwTargetRules(c, true, false, pipe, args(ipfwVia, c.Device))
+	if fastLane(c) {
+		rules = append(rules, args(ipfwFastLane, c.Device))
+	}
+	return rules
+}
+
+// change reconfigures the pipe in place.
+func (i *ipfwThrottler) change(c *Config) error {
+	return i.c.execute(i.buildConfigCommand(c))
+}
+
+// setupPartition adds deny rules for the targets, numbered 1 like the pipe
+// rule so that teardown removes them too.
+func (i *ipfwThrottler) setupPartition(c *Config) error {
+	if err := checkPartition(c); err != nil {
+		return err
+	}
+
+	for _, rule := range ipfwPartitionRules(c) {
+		if err := i.c.execute(rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ipfwPartitionRules(c *Config) [][]string {
+	in, out := partitionDirections(c)
+	action := func(proto string) []string {
+		if !c.PartitionReject {
+			return []string{"deny"}
+		}
+		if proto == "tcp" {
+			return []string{"reset"}
+		}
+		return []string{"unreach", "host"}
+	}
+	return ipfwTargetRules(c, out, in, action, nil)
+}
+
+// ipfwTargetRules returns a rule for each target address, or any if there
+// are none, and protocol, to the targets for out and from them for in. The
+// ports only apply to TCP and UDP.
+func ipfwTargetRules(c *Config, out, in bool, action func(proto string) []string, via []string) [][]string {
+	ports := ""
+	if len(c.TargetPorts) > 0 {
+		ports = strings.Replace(strings.Join(c.TargetPorts, ","), ":", "-", -1)
+	}
+
+	rules := [][]string{}
+	addRules := func(v6 bool, addrs []string) {
+		protos := c.TargetProtos
+		if len(protos) == 0 {
+			protos = []string{"ip"}
+		}
+
+		for _, addr := range addrs {
+			for _, proto := range protos {
+				act := action(proto)
+				if v6 && proto == "icmp" {
+					proto = "ipv6-icmp"
+				}
+
+				dst, src := []string{}, []string{}
+				if ports != "" && (proto == "tcp" || proto == "udp") {
+					dst, src = []string{"dst-port", ports}, []string{"src-port", ports}
+				}
+
+				if out {
+					rules = append(rules, concat(args(ipfwAddRule), act, args("%s from any to %s", proto, addr), dst, via))
+				}
+				if in {
+					rules = append(rules, concat(args(ipfwAddRule), act, args("%s from %s to any", proto, addr), src, via))
+				}
+			}
+		}
+	}
+	if len(c.TargetIps) == 0 && len(c.TargetIps6) == 0 {
+		addRules(false, []string{"any"})
+	}
+	addRules(false, c.TargetIps)
+	addRules(true, c.TargetIps6)
+
+	return rules
+}
+
 func (i *ipfwThrottler) teardown(_ *Config) error {
-	err := i.c.execute(ipfwTeardown)
-	return err
+	if err := i.c.execute(args(ipfwTeardown)); err != nil {
+		return err
+	}
+	return i.c.execute(args(appliedDel, appliedFile))
 }
 
 func (i *ipfwThrottler) exists() bool {
 	if dry {
 		return false
 	}
-	err := i.c.execute(ipfwExists)
-	return err == nil
+	lines, err := i.c.executeGetLines(args(ipfwExists))
+	if err != nil {
+		return false
+	}
+	for _, line := range lines {
+		if strings.HasPrefix(line, ipfwRuleNum) {
+			return true
+		}
+	}
+	return false
 }
 
-func (i *ipfwThrottler) check() string {
-	return ipfwCheck
+func (i *ipfwThrottler) check() []string {
+	return args(ipfwCheck)
 }
 
-func (i *ipfwThrottler) buildConfigCommand(c *Config) string {
-	cmd := ipfwConfig
+func (i *ipfwThrottler) buildConfigCommand(c *Config) []string {
+	cmd := args(ipfwConfig)
 
 	if c.Latency > 0 {
-		cmd = cmd + " delay " + strconv.Itoa(c.Latency) + "ms"
+		cmd = append(cmd, "delay", strconv.Itoa(c.Latency)+"ms")
 	}
 
 	if c.TargetBandwidth > 0 {
-		cmd = cmd + " bw " + strconv.Itoa(c.TargetBandwidth) + "Kbit/s"
+		cmd = append(cmd, "bw", strconv.Itoa(c.TargetBandwidth)+"Kbit/s")
 	}
 
 	if c.PacketLoss > 0 {
-		cmd = cmd + " plr " + strconv.FormatFloat(c.PacketLoss/100, 'f', 4, 64)
+		cmd = append(cmd, "plr", strconv.FormatFloat(c.PacketLoss/100, 'f', 4, 64))
 	}
 
 	return cmd
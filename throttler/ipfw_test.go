@@ -0,0 +1,57 @@
+package throttler
+
+import (
+	"testing"
+)
+
+func TestIpfwTargetSetup(t *testing.T) {
+	r := newCmdRecorder()
+	th := &ipfwThrottler{r}
+	cfg := defaultTestConfig
+	cfg.TargetIps = []string{"10.0.0.0/24"}
+	cfg.TargetIps6 = []string{"2001:db8::1"}
+	cfg.TargetPorts = []string{"80", "8000:8080"}
+	cfg.TargetProtos = []string{"tcp", "icmp"}
+	if err := th.setup(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	r.verifyCommands(t, []string{
+		"ipfw add 1 pipe 1 tcp from any to 10.0.0.0/24 dst-port 80,8000-8080 via eth0",
+		"ipfw add 1 pipe 1 icmp from any to 10.0.0.0/24 via eth0",
+		"ipfw add 1 pipe 1 tcp from any to 2001:db8::1 dst-port 80,8000-8080 via eth0",
+		"ipfw add 1 pipe 1 ipv6-icmp from any to 2001:db8::1 via eth0",
+		"ipfw add 1 pipe 2 ip from any to any via eth0",
+		"ipfw pipe 1 config plr 0.0010",
+		"ipfw pipe 2 config bw 20000Kbit/s",
+	})
+}
+
+func TestIpfwPortsWithoutAddrs(t *testing.T) {
+	r := newCmdRecorder()
+	th := &ipfwThrottler{r}
+	cfg := defaultTestConfig
+	cfg.TargetIps = nil
+	cfg.TargetProtos = []string{"tcp", "udp"}
+	cfg.DefaultBandwidth = -1
+	if err := th.setup(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	r.verifyCommands(t, []string{
+		"ipfw add 1 pipe 1 tcp from any to any dst-port 80 via eth0",
+		"ipfw add 1 pipe 1 udp from any to any dst-port 80 via eth0",
+		"ipfw pipe 1 config plr 0.0010",
+	})
+}
+
+func TestIpfwUntargetedSetup(t *testing.T) {
+	r := newCmdRecorder()
+	th := &ipfwThrottler{r}
+	cfg := Config{Device: "em0", Latency: 100, DefaultBandwidth: 20000}
+	if err := th.setup(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	r.verifyCommands(t, []string{
+		"ipfw add 1 pipe 1 ip from any to any via em0",
+		"ipfw pipe 1 config delay 100ms",
+	})
+}
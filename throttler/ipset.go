@@ -0,0 +1,106 @@
+package throttler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	ipset        = `ipset`
+	ipsetRestore = `ipset restore`
+	ipsetCreate  = `create %s hash:net family %s -exist`
+	ipsetFlush   = `flush %s`
+	ipsetAdd     = `add %s %s`
+	ipsetSave    = `ipset save %s`
+	ipsetDestroy = `ipset destroy %s`
+	ipsetMin     = 8 //Target addresses that go into a set rather than a rule each
+)
+
+// targetSets are the ipsets of target addresses, for iptables and ip6tables.
+var targetSets = map[string]string{ip4Tables: "comcast4", ip6Tables: "comcast6"}
+
+// targetSet returns the set the addresses go into for the iptables command,
+// or "" if there are few enough for a rule each, or no ipset to put them in.
+func targetSet(c commander, command string, addrs []string) string {
+	if len(addrs) < ipsetMin || !c.commandExists(ipset) {
+		return ""
+	}
+	return targetSets[command]
+}
+
+// addTargetSet creates the set if need be and fills it with just addrs, in a
+// single ipset restore.
+func addTargetSet(c commander, set string, addrs []string) error {
+	family := "inet"
+	if set == targetSets[ip6Tables] {
+		family = "inet6"
+	}
+
+	lines := []string{fmt.Sprintf(ipsetCreate, set, family), fmt.Sprintf(ipsetFlush, set)}
+	for _, addr := range addrs {
+		lines = append(lines, fmt.Sprintf(ipsetAdd, set, addr))
+	}
+	return c.executeInput(args(ipsetRestore), strings.Join(lines, "\n"))
+}
+
+// delTargetSets destroys the target sets the deleted rules matched, now no
+// rule does.
+func delTargetSets(c commander, deleted []string) error {
+	for _, set := range matchedSets(deleted) {
+		if err := c.execute(args(ipsetDestroy, set)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchedSets returns the target sets the rules match, in the order they
+// first come up.
+func matchedSets(rules []string) []string {
+	sets := []string{}
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "--match-set" && !contains(sets, fields[i+1]) && (fields[i+1] == targetSets[ip4Tables] || fields[i+1] == targetSets[ip6Tables]) {
+				sets = append(sets, fields[i+1])
+			}
+		}
+	}
+	return sets
+}
+
+// setMembers returns the addresses in the set, as ipset save or the input of
+// ipset restore lists them, sorted and with host prefixes left out.
+func setMembers(set string, lines []string) []string {
+	members := []string{}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "add" || fields[1] != set {
+			continue
+		}
+		addr := strings.TrimSuffix(strings.TrimSuffix(fields[2], "/32"), "/128")
+		members = append(members, addr)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// setChange compares the addresses the ipset restore command puts into the
+// set with the live ones, reporting whether they differ.
+func setChange(c commander, set string, cmd command) (Change, bool) {
+	now := setMembers(set, strings.Split(cmd.input, "\n"))
+	change := Change{Action: ChangeAdd, Rule: "set " + set, Detail: fmt.Sprintf("%d addresses", len(now)), Command: cmd.argv, Input: cmd.input}
+
+	lines, err := c.executeGetLines(args(ipsetSave, set))
+	if err != nil || len(lines) == 0 {
+		return change, true
+	}
+	live := setMembers(set, lines)
+	if strings.Join(live, " ") == strings.Join(now, " ") {
+		return change, false
+	}
+	change.Action = ChangeUpdate
+	change.Detail = fmt.Sprintf("%d -> %d addresses", len(live), len(now))
+	return change, true
+}
@@ -0,0 +1,177 @@
+package throttler
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func manyAddrs(n int) []string {
+	addrs := []string{}
+	for i := 0; i < n; i++ {
+		addrs = append(addrs, fmt.Sprintf("10.0.%d.0/24", i))
+	}
+	return addrs
+}
+
+func TestTcTargetSetSetup(t *testing.T) {
+	r := newCmdRecorder()
+	cfg := defaultTestConfig
+	cfg.TargetIps = manyAddrs(ipsetMin)
+	cfg.TargetProtos = []string{"tcp", "udp"}
+	if err := (&tcThrottler{r}).setup(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	members := []string{}
+	for _, addr := range cfg.TargetIps {
+		members = append(members, "add comcast4 "+addr)
+	}
+	r.verifyCommands(t, []string{
+		"tc qdisc show dev eth0",
+		"tc qdisc add dev eth0 handle 10: root htb default 1",
+		"tc class add dev eth0 parent 10: classid 10:1 htb rate 20000kbit",
+		"tc class add dev eth0 parent 10: classid 10:10 htb rate 1000000kbit",
+		"tc qdisc add dev eth0 parent 10:10 handle 100: netem loss 0.10%",
+		`ipset restore <<< "create comcast4 hash:net family inet -exist\nflush comcast4\n` + strings.Join(members, `\n`) + `"`,
+		"iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p tcp --dport 80 -m set --match-set comcast4 dst",
+		"iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p udp --dport 80 -m set --match-set comcast4 dst",
+	})
+
+	// Without ipset, a rule for each address
+	r = newCmdRecorder()
+	r.cmdBlackList = []string{ipset}
+	if err := (&tcThrottler{r}).setup(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if last := r.commands[len(r.commands)-1]; !strings.HasPrefix(last, "iptables-restore --noflush <<< \"*mangle\\n-A POSTROUTING") {
+		t.Errorf("Expected the rules in one iptables-restore, got %s", last)
+	}
+}
+
+func TestPortMatches(t *testing.T) {
+	ports := []string{}
+	for i := 1; i <= 14; i++ {
+		ports = append(ports, fmt.Sprint(i))
+	}
+	ports = append(ports, "1000:2000", "3000")
+
+	matches := []string{}
+	for _, m := range portMatches(ports, iptDestPorts, iptDestPort) {
+		matches = append(matches, strings.Join(m, " "))
+	}
+	expected := []string{
+		"--match multiport --dports 1,2,3,4,5,6,7,8,9,10,11,12,13,14",
+		"--match multiport --dports 1000:2000,3000",
+	}
+	if strings.Join(matches, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(matches, "\n"))
+	}
+
+	if m := portMatches(nil, iptDestPorts, iptDestPort); len(m) != 1 || len(m[0]) != 0 {
+		t.Errorf("Expected a single empty match without ports, got %v", m)
+	}
+}
+
+func TestTcPartitionSplitPorts(t *testing.T) {
+	cfg := defaultTestConfig
+	cfg.Partition = PartitionOut
+	cfg.TargetProtos = []string{"tcp", "icmp"}
+	cfg.TargetPorts = []string{}
+	for i := 1; i <= 16; i++ {
+		cfg.TargetPorts = append(cfg.TargetPorts, fmt.Sprint(i))
+	}
+	rules := []string{}
+	for _, rule := range partitionRules(&cfg, ip4Tables, cfg.TargetIps) {
+		rules = append(rules, strings.Join(rule, " "))
+	}
+	expected := []string{
+		"iptables -A OUTPUT -d 10.10.10.10 -p tcp --match multiport --dports 1,2,3,4,5,6,7,8,9,10,11,12,13,14,15 -m comment --comment comcast-partition -j DROP",
+		"iptables -A OUTPUT -d 10.10.10.10 -p tcp --match multiport --dports 16 -m comment --comment comcast-partition -j DROP",
+		"iptables -A OUTPUT -d 10.10.10.10 -p icmp -m comment --comment comcast-partition -j DROP",
+	}
+	if strings.Join(rules, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(rules, "\n"))
+	}
+}
+
+func TestTcTargetSetTeardown(t *testing.T) {
+	r := newCmdRecorder()
+	r.cmdBlackList = []string{ip6Tables}
+	r.responses = map[string][]string{
+		"tc qdisc show dev eth0": tcRootQDiscShow,
+		"iptables -S -t mangle": {
+			"-A POSTROUTING -p tcp -m tcp --dport 80 -m set --match-set comcast4 dst -j CLASSIFY --set-class 0010:0010",
+		},
+	}
+	if err := (&tcThrottler{r}).teardown(&defaultTestConfig); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	r.verifyCommands(t, []string{
+		tcReadEth0State,
+		"tc qdisc show dev eth0",
+		"iptables -S -t mangle",
+		"iptables -t mangle -D POSTROUTING -p tcp -m tcp --dport 80 -m set --match-set comcast4 dst -j CLASSIFY --set-class 0010:0010",
+		"iptables -S",
+		"ipset destroy comcast4",
+		"tc qdisc del dev eth0 handle 10: root",
+	})
+}
+
+func TestTcTargetSetUndo(t *testing.T) {
+	cfg := defaultTestConfig
+	cfg.TargetIps = manyAddrs(ipsetMin)
+	cfg.TargetPorts = nil
+	cfg.TargetProtos = nil
+	r := newCmdRecorder()
+	if err := (&tcThrottler{r}).undo(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	r.verifyCommands(t, []string{
+		"iptables -D POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -m set --match-set comcast4 dst",
+		"ipset destroy comcast4",
+		"tc qdisc del dev eth0 handle 10: root",
+	})
+
+	// Batched rules are deleted in a batch
+	cfg.TargetIps = []string{"10.0.0.1"}
+	cfg.TargetProtos = []string{"tcp"}
+	for i := 0; i < iptBatchMin; i++ {
+		cfg.TargetCgroups = append(cfg.TargetCgroups, fmt.Sprintf("/app%d", i))
+	}
+	r = newCmdRecorder()
+	if err := (&tcThrottler{r}).undo(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if first := r.commands[0]; !strings.HasPrefix(first, "iptables-restore --noflush <<< \"*mangle\\n-D POSTROUTING") || strings.Contains(first, "-A ") {
+		t.Errorf("Expected the rules deleted in one iptables-restore, got %s", first)
+	}
+}
+
+func TestTcPlanTargetSet(t *testing.T) {
+	cfg := defaultTestConfig
+	cfg.TargetIps = manyAddrs(ipsetMin)
+	live := map[string][]string{
+		"tc qdisc show dev eth0": tcRootQDiscShow,
+		"tc class show dev eth0": tcLiveState["tc class show dev eth0"],
+		"iptables -S -t mangle": {
+			"-A POSTROUTING -p tcp -m tcp --dport 80 -m set --match-set comcast4 dst -j CLASSIFY --set-class 0010:0010",
+		},
+		"ipset save comcast4": append([]string{"create comcast4 hash:net family inet hashsize 1024 maxelem 65536"}, strings.Split("add comcast4 "+strings.Join(cfg.TargetIps, "\nadd comcast4 "), "\n")...),
+	}
+	verifyChanges(t, planWith(t, &cfg, live), []string{})
+
+	cfg.TargetIps = append(cfg.TargetIps, "192.0.2.1")
+	changes := planWith(t, &cfg, live)
+	verifyChanges(t, changes, []string{"~ set comcast4 (8 -> 9 addresses)"})
+	if changes[0].Input == "" || !strings.HasSuffix(changes[0].Input, "add comcast4 192.0.2.1") {
+		t.Errorf("Expected the set to be restored, got %q", changes[0].Input)
+	}
+
+	cfg.TargetIps = []string{"10.10.10.10"}
+	verifyChanges(t, planWith(t, &cfg, live), []string{
+		"- iptables -t mangle -D POSTROUTING -p tcp -m tcp --dport 80 -m set --match-set comcast4 dst -j CLASSIFY --set-class 0010:0010",
+		"- set comcast4",
+		"+ iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p tcp --dport 80 -d 10.10.10.10",
+	})
+}
@@ -0,0 +1,181 @@
+package throttler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Link is the impairment applied to traffic towards one destination when
+// several destinations are shaped at once, e.g. from a latency matrix.
+type Link struct {
+	Dest       string  `json:"dest"`
+	Latency    int     `json:"latency"`
+	Jitter     int     `json:"jitter,omitempty"`
+	PacketLoss float64 `json:"packet_loss,omitempty"`
+	Bandwidth  int     `json:"bandwidth,omitempty"`
+}
+
+// regionRTTs holds typical round trip times in ms between cloud regions. They
+// are ballpark figures for public cloud backbones, meant as a starting point.
+var regionRTTs = map[string]map[string]int{
+	"us-east": {
+		"us-west": 65, "eu-west": 80, "eu-central": 90, "ap-south": 200,
+		"ap-southeast": 230, "ap-northeast": 150, "sa-east": 115,
+	},
+	"us-west": {
+		"eu-west": 135, "eu-central": 145, "ap-south": 220, "ap-southeast": 170,
+		"ap-northeast": 100, "sa-east": 175,
+	},
+	"eu-west": {
+		"eu-central": 25, "ap-south": 120, "ap-southeast": 170, "ap-northeast": 210,
+		"sa-east": 185,
+	},
+	"eu-central": {
+		"ap-south": 110, "ap-southeast": 160, "ap-northeast": 225, "sa-east": 200,
+	},
+	"ap-south": {
+		"ap-southeast": 60, "ap-northeast": 130, "sa-east": 300,
+	},
+	"ap-southeast": {
+		"ap-northeast": 70, "sa-east": 320,
+	},
+	"ap-northeast": {
+		"sa-east": 255,
+	},
+}
+
+// Regions lists the regions known to the built-in latency matrix.
+func Regions() []string {
+	seen := map[string]bool{}
+	for from, tos := range regionRTTs {
+		seen[from] = true
+		for to := range tos {
+			seen[to] = true
+		}
+	}
+
+	regions := make([]string, 0, len(seen))
+	for r := range seen {
+		regions = append(regions, r)
+	}
+	sort.Strings(regions)
+	return regions
+}
+
+// RegionRTT returns the built-in round trip time in ms between two regions.
+func RegionRTT(from, to string) (int, bool) {
+	if rtt, ok := regionRTTs[from][to]; ok {
+		return rtt, true
+	}
+	rtt, ok := regionRTTs[to][from]
+	return rtt, ok
+}
+
+// BuiltinMatrix builds links from region `from` to each of the other regions
+// in dests, which maps region names to the addresses standing in for them.
+// The whole RTT is applied on egress from this host.
+func BuiltinMatrix(from string, dests map[string]string) ([]Link, error) {
+	regions := make([]string, 0, len(dests))
+	for region := range dests {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+
+	links := []Link{}
+	for _, region := range regions {
+		rtt, ok := RegionRTT(from, region)
+		if !ok {
+			return nil, fmt.Errorf("No built-in RTT from %s to %s (known regions: %s)", from, region, strings.Join(Regions(), ", "))
+		}
+
+		dest, err := parseDest(dests[region])
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, Link{Dest: dest, Latency: rtt})
+	}
+	return links, nil
+}
+
+// ParseMatrix reads a latency matrix, one destination per line:
+//
+//	# destination   latency  jitter  loss   bandwidth
+//	10.0.1.0/24     80ms     5ms     0.1%   100000
+//	2001:db8::/64   200      -       1
+//
+// Latency and jitter are in ms, loss in percent and bandwidth in kbit/s. Only
+// the destination and latency are required, and `-` leaves a value unset.
+func ParseMatrix(r io.Reader) ([]Link, error) {
+	links := []Link{}
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(strings.Replace(line, ",", " ", -1))
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || len(fields) > 5 {
+			return nil, fmt.Errorf("line %d: expected destination, latency and optionally jitter, loss and bandwidth", lineNo)
+		}
+
+		dest, err := parseDest(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNo, err)
+		}
+		link := Link{Dest: dest}
+
+		for i, field := range fields[1:] {
+			if field == "-" {
+				continue
+			}
+
+			switch i {
+			case 0:
+				link.Latency, err = strconv.Atoi(strings.TrimSuffix(field, "ms"))
+			case 1:
+				link.Jitter, err = strconv.Atoi(strings.TrimSuffix(field, "ms"))
+			case 2:
+				link.PacketLoss, err = strconv.ParseFloat(strings.TrimSuffix(field, "%"), 64)
+			case 3:
+				link.Bandwidth, err = strconv.Atoi(strings.TrimSuffix(field, "kbit"))
+			}
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid value %q", lineNo, field)
+			}
+		}
+
+		links = append(links, link)
+	}
+
+	return links, scanner.Err()
+}
+
+func parseDest(dest string) (string, error) {
+	if ip := net.ParseIP(dest); ip != nil {
+		return dest, nil
+	}
+	_, n, err := net.ParseCIDR(dest)
+	if err != nil {
+		return "", fmt.Errorf("invalid destination %q", dest)
+	}
+	return n.String(), nil
+}
+
+func isIPv4(dest string) bool {
+	if i := strings.Index(dest, "/"); i >= 0 {
+		dest = dest[:i]
+	}
+	ip := net.ParseIP(dest)
+	return ip != nil && ip.To4() != nil
+}
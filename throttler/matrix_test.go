@@ -0,0 +1,64 @@
+package throttler
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMatrix(t *testing.T) {
+	links, err := ParseMatrix(strings.NewReader(`
+# destination   latency  jitter  loss   bandwidth
+10.0.1.0/24     80ms     5ms     0.1%   100000
+10.0.2.7        200      -       1
+2001:db8::1/64  150
+`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	expected := []Link{
+		{Dest: "10.0.1.0/24", Latency: 80, Jitter: 5, PacketLoss: 0.1, Bandwidth: 100000},
+		{Dest: "10.0.2.7", Latency: 200, PacketLoss: 1},
+		{Dest: "2001:db8::/64", Latency: 150},
+	}
+	if !reflect.DeepEqual(links, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, links)
+	}
+}
+
+func TestParseMatrixErrors(t *testing.T) {
+	for _, matrix := range []string{
+		"10.0.1.0/24",
+		"10.0.1.0/33 80",
+		"example.com 80",
+		"10.0.1.0/24 fast",
+		"10.0.1.0/24 80 5 1 1000 extra",
+	} {
+		if _, err := ParseMatrix(strings.NewReader(matrix)); err == nil {
+			t.Errorf("Expected an error parsing %q", matrix)
+		}
+	}
+}
+
+func TestBuiltinMatrix(t *testing.T) {
+	links, err := BuiltinMatrix("us-east", map[string]string{
+		"eu-west":  "10.0.2.0/24",
+		"ap-south": "10.0.3.1",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	expected := []Link{
+		{Dest: "10.0.3.1", Latency: 200},
+		{Dest: "10.0.2.0/24", Latency: 80},
+	}
+	if !reflect.DeepEqual(links, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, links)
+	}
+
+	if _, err := BuiltinMatrix("us-east", map[string]string{"mars": "10.0.9.0/24"}); err == nil {
+		t.Fatal("Expected an error for an unknown region")
+	}
+}
@@ -0,0 +1,220 @@
+package throttler
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const metricsContentType = "text/plain; version=0.0.4"
+
+// counters are the traffic counters the kernel keeps for a qdisc, class or
+// firewall rule. Fields a backend can't report are left at zero.
+type counters struct {
+	Bytes      uint64
+	Packets    uint64
+	Drops      uint64
+	Overlimits uint64
+}
+
+type qdiscStats struct {
+	Kind   string
+	Handle string
+	Parent string
+	counters
+}
+
+type classStats struct {
+	Class string
+	counters
+}
+
+type ruleStats struct {
+	Family string
+	Rule   string
+	counters
+}
+
+type backendStats struct {
+	Qdiscs  []qdiscStats
+	Classes []classStats
+	Rules   []ruleStats
+}
+
+// statsReporter is implemented by throttlers that can read back how much
+// traffic their rules have matched, delayed and dropped.
+type statsReporter interface {
+	stats(*Config) (*backendStats, error)
+}
+
+type metricWriter struct {
+	w       *bufio.Writer
+	written map[string]bool
+}
+
+func (m *metricWriter) write(name, kind, help string, labels map[string]string, value interface{}) {
+	if !m.written[name] {
+		fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		m.written[name] = true
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, k, escapeLabel(labels[k])))
+	}
+
+	if len(pairs) > 0 {
+		fmt.Fprintf(m.w, "%s{%s} %v\n", name, strings.Join(pairs, ","), value)
+	} else {
+		fmt.Fprintf(m.w, "%s %v\n", name, value)
+	}
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// WriteMetrics writes the configured impairment for cfg, and whatever traffic
+// counters its backend can report, in the Prometheus text exposition format.
+// A nil cfg reports that nothing is applied.
+func WriteMetrics(w io.Writer, cfg *Config) error {
+	if cfg == nil {
+		return writeMetrics(w, nil, nil)
+	}
+
+	t, err := newThrottler(cfg, commanderFor(cfg)) //Served concurrently, so leaving dry alone
+	if err != nil {
+		return err
+	}
+	return writeMetrics(w, t, cfg)
+}
+
+func writeMetrics(w io.Writer, t throttler, cfg *Config) error {
+	m := &metricWriter{bufio.NewWriter(w), map[string]bool{}}
+
+	if cfg == nil {
+		m.write("comcast_active", "gauge", "Whether comcast packet rules are applied.", nil, 0)
+		return m.w.Flush()
+	}
+
+	dev := map[string]string{"device": cfg.Device}
+	m.write("comcast_active", "gauge", "Whether comcast packet rules are applied.", dev, 1)
+	if cfg.Latency > 0 {
+		m.write("comcast_latency_milliseconds", "gauge", "Configured latency added to targeted traffic.", dev, cfg.Latency)
+	}
+	if cfg.TargetBandwidth > -1 {
+		m.write("comcast_target_bandwidth_kbits", "gauge", "Configured bandwidth limit for targeted traffic.", dev, cfg.TargetBandwidth)
+	}
+	if cfg.DefaultBandwidth > 0 {
+		m.write("comcast_default_bandwidth_kbits", "gauge", "Configured bandwidth limit for other traffic.", dev, cfg.DefaultBandwidth)
+	}
+	if cfg.PacketLoss > 0 {
+		m.write("comcast_packet_loss_percent", "gauge", "Configured packet loss for targeted traffic.", dev, cfg.PacketLoss)
+	}
+
+	sr, ok := t.(statsReporter)
+	if !ok {
+		return m.w.Flush()
+	}
+
+	st, err := sr.stats(cfg)
+	if err != nil {
+		return err
+	}
+
+	qdiscLabels := func(q qdiscStats) map[string]string {
+		return map[string]string{"device": cfg.Device, "kind": q.Kind, "handle": q.Handle, "parent": q.Parent}
+	}
+	for _, q := range st.Qdiscs {
+		m.write("comcast_qdisc_bytes_total", "counter", "Bytes sent by the qdisc.", qdiscLabels(q), q.Bytes)
+	}
+	for _, q := range st.Qdiscs {
+		m.write("comcast_qdisc_packets_total", "counter", "Packets sent by the qdisc.", qdiscLabels(q), q.Packets)
+	}
+	for _, q := range st.Qdiscs {
+		m.write("comcast_qdisc_drops_total", "counter", "Packets dropped by the qdisc.", qdiscLabels(q), q.Drops)
+	}
+	for _, q := range st.Qdiscs {
+		m.write("comcast_qdisc_overlimits_total", "counter", "Overlimit events of the qdisc.", qdiscLabels(q), q.Overlimits)
+	}
+
+	classLabels := func(c classStats) map[string]string {
+		return map[string]string{"device": cfg.Device, "class": c.Class}
+	}
+	for _, c := range st.Classes {
+		m.write("comcast_class_bytes_total", "counter", "Bytes sent by the class.", classLabels(c), c.Bytes)
+	}
+	for _, c := range st.Classes {
+		m.write("comcast_class_packets_total", "counter", "Packets sent by the class.", classLabels(c), c.Packets)
+	}
+	for _, c := range st.Classes {
+		m.write("comcast_class_drops_total", "counter", "Packets dropped by the class.", classLabels(c), c.Drops)
+	}
+	for _, c := range st.Classes {
+		m.write("comcast_class_overlimits_total", "counter", "Overlimit events of the class.", classLabels(c), c.Overlimits)
+	}
+
+	ruleLabels := func(r ruleStats) map[string]string {
+		return map[string]string{"family": r.Family, "rule": r.Rule}
+	}
+	for _, r := range st.Rules {
+		m.write("comcast_rule_bytes_total", "counter", "Bytes matched by the classification rule.", ruleLabels(r), r.Bytes)
+	}
+	for _, r := range st.Rules {
+		m.write("comcast_rule_packets_total", "counter", "Packets matched by the classification rule.", ruleLabels(r), r.Packets)
+	}
+
+	return m.w.Flush()
+}
+
+// Applied is the config in effect while Flap or Replay change it, for
+// MetricsHandler to report. nil means no rules are in place.
+type Applied struct {
+	mu  sync.Mutex
+	cfg *Config
+}
+
+// NewApplied starts out with cfg in effect.
+func NewApplied(cfg *Config) *Applied {
+	return &Applied{cfg: cfg}
+}
+
+// Config returns the config in effect.
+func (a *Applied) Config() *Config {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.cfg
+}
+
+func (a *Applied) set(cfg *Config) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cfg = cfg
+}
+
+// MetricsHandler serves WriteMetrics for whatever config current returns.
+func MetricsHandler(current func() *Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		if err := WriteMetrics(&buf, current()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", metricsContentType)
+		buf.WriteTo(w)
+	})
+}
@@ -0,0 +1,90 @@
+package throttler
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTcMetrics(t *testing.T) {
+	r := newCmdRecorder()
+	th := &tcThrottler{r}
+	r.responses = map[string][]string{
+		"tc -s -j qdisc show dev eth0": {
+			`[{"kind":"htb","handle":"10:","root":true,"bytes":5000,"packets":50,"drops":0,"overlimits":7},`,
+			`{"kind":"netem","handle":"100:","parent":"10:10","bytes":3000,"packets":30,"drops":2,"overlimits":0},`,
+			`{"kind":"fq_codel","handle":"0:","parent":":1","bytes":1,"packets":1,"drops":0,"overlimits":0}]`,
+		},
+		"tc -s class show dev eth0": {
+			"class htb 10:1 root prio 0 rate 20Mbit ceil 20Mbit burst 1600b cburst 1600b ",
+			" Sent 2000 bytes 20 pkt (dropped 0, overlimits 0 requeues 0) ",
+			" backlog 0b 0p requeues 0",
+			"class htb 10:10 root leaf 100: prio 0 rate 1Gbit ceil 1Gbit burst 1375b cburst 1375b ",
+			" Sent 3000 bytes 30 pkt (dropped 2, overlimits 4 requeues 0) ",
+			" backlog 0b 0p requeues 0",
+		},
+		"iptables -t mangle -S POSTROUTING -v": {
+			"-P POSTROUTING ACCEPT -c 100 10000",
+			"-A POSTROUTING -d 10.10.10.10/32 -p tcp -m tcp --dport 80 -c 30 3000 -j CLASSIFY --set-class 0010:0010",
+		},
+	}
+
+	var buf bytes.Buffer
+	cfg := defaultTestConfig
+	if err := writeMetrics(&buf, th, &cfg); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	out := buf.String()
+
+	for _, expected := range []string{
+		`comcast_active{device="eth0"} 1`,
+		`comcast_default_bandwidth_kbits{device="eth0"} 20000`,
+		`comcast_packet_loss_percent{device="eth0"} 0.1`,
+		`comcast_qdisc_packets_total{device="eth0",handle="10:",kind="htb",parent=""} 50`,
+		`comcast_qdisc_drops_total{device="eth0",handle="100:",kind="netem",parent="10:10"} 2`,
+		`comcast_class_bytes_total{class="10:1",device="eth0"} 2000`,
+		`comcast_class_overlimits_total{class="10:10",device="eth0"} 4`,
+		`comcast_rule_packets_total{family="ipv4",rule="-A POSTROUTING -d 10.10.10.10/32 -p tcp -m tcp --dport 80 -j CLASSIFY --set-class 0010:0010"} 30`,
+	} {
+		if !strings.Contains(out, expected+"\n") {
+			t.Errorf("Expected metrics to contain `%s`, got:\n%s", expected, out)
+		}
+	}
+
+	if strings.Contains(out, "fq_codel") {
+		t.Errorf("Expected qdiscs outside of comcast's tree to be skipped, got:\n%s", out)
+	}
+	if strings.Contains(out, "comcast_latency_milliseconds") {
+		t.Errorf("Expected unset latency to be omitted, got:\n%s", out)
+	}
+	if strings.Count(out, "# TYPE comcast_class_bytes_total counter") != 1 {
+		t.Errorf("Expected a single TYPE line per metric, got:\n%s", out)
+	}
+}
+
+func TestMetricsWithoutCounters(t *testing.T) {
+	var buf bytes.Buffer
+	cfg := defaultTestConfig
+	cfg.Latency = 250
+	if err := writeMetrics(&buf, &fakeThrottler{}, &cfg); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	out := buf.String()
+
+	if !strings.Contains(out, `comcast_latency_milliseconds{device="eth0"} 250`) {
+		t.Errorf("Expected configured latency gauge, got:\n%s", out)
+	}
+	if strings.Contains(out, "_total") {
+		t.Errorf("Expected no counters from a backend that can't report them, got:\n%s", out)
+	}
+}
+
+func TestMetricsInactive(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeMetrics(&buf, nil, nil); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.Contains(buf.String(), "comcast_active 0\n") {
+		t.Errorf("Expected inactive gauge, got:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,106 @@
+package throttler
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Cluster partition modes for PartitionPeers, named after the nemeses in
+// Jepsen.
+const (
+	// ModeMajorityMinority splits the nodes into a majority (the first
+	// n/2+1 nodes) and a minority (the rest).
+	ModeMajorityMinority = "majority-minority"
+	// ModeIsolate cuts a single node off from all others. It's given as
+	// isolate=<node>.
+	ModeIsolate = "isolate"
+	// ModeBridge splits the nodes into two halves, with the middle node
+	// still connected to both.
+	ModeBridge = "bridge"
+	// ModeRing arranges the nodes in a ring where each node sees a
+	// majority made of itself and its nearest neighbours, but no two
+	// nodes see the same majority. It needs at least 4 nodes.
+	ModeRing = "ring"
+)
+
+// PartitionPeers returns the nodes that self must be cut off from for the
+// given partition mode. Every node in the cluster runs this with the same
+// nodes, in the same order, and blocks its own peers, which together
+// produces the partition.
+func PartitionPeers(nodes []string, self string, mode string) ([]string, error) {
+	idx := indexOf(nodes, self)
+	if idx < 0 {
+		return nil, fmt.Errorf("%s is not one of the nodes", self)
+	}
+
+	var connected func(i, j int) bool
+	n := len(nodes)
+
+	switch {
+	case mode == ModeMajorityMinority:
+		majority := n/2 + 1
+		connected = func(i, j int) bool {
+			return (i < majority) == (j < majority)
+		}
+	case strings.HasPrefix(mode, ModeIsolate+"="):
+		isolated := indexOf(nodes, strings.TrimPrefix(mode, ModeIsolate+"="))
+		if isolated < 0 {
+			return nil, fmt.Errorf("Can't isolate %s, it's not one of the nodes", strings.TrimPrefix(mode, ModeIsolate+"="))
+		}
+		connected = func(i, j int) bool {
+			return i != isolated && j != isolated
+		}
+	case mode == ModeBridge:
+		bridge := n / 2
+		connected = func(i, j int) bool {
+			return i == bridge || j == bridge || (i < bridge) == (j < bridge)
+		}
+	case mode == ModeRing:
+		// Seeing reach neighbours on either side, and the node opposite when
+		// that's what evens it up, makes exactly a majority of n/2+1. Without
+		// an opposite node for an odd n, it's one more than that.
+		majority := n/2 + 1
+		reach := majority / 2
+		opposite := n%2 == 0 && majority%2 == 0
+		if opposite {
+			reach--
+		}
+		seen := 2*reach + 1
+		if opposite {
+			seen++
+		}
+		if seen >= n {
+			return nil, errors.New("A ring partition needs at least 4 nodes, so each one can see a majority without seeing them all")
+		}
+		connected = func(i, j int) bool {
+			d := i - j
+			if d < 0 {
+				d = -d
+			}
+			if n-d < d {
+				d = n - d
+			}
+			return d <= reach || (opposite && d == n/2)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown partition mode %q (expected %s, %s=<node>, %s or %s)", mode, ModeMajorityMinority, ModeIsolate, ModeBridge, ModeRing)
+	}
+
+	peers := []string{}
+	for j, node := range nodes {
+		if j != idx && !connected(idx, j) {
+			peers = append(peers, node)
+		}
+	}
+	return peers, nil
+}
+
+func indexOf(nodes []string, node string) int {
+	for i, n := range nodes {
+		if n == node {
+			return i
+		}
+	}
+	return -1
+}
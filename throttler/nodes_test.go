@@ -0,0 +1,131 @@
+package throttler
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testNodes = []string{"a", "b", "c", "d", "e"}
+
+func verifyPeers(t *testing.T, mode string, expected map[string][]string) {
+	verifyPeersOf(t, testNodes, mode, expected)
+}
+
+func verifyPeersOf(t *testing.T, nodes []string, mode string, expected map[string][]string) {
+	for _, self := range nodes {
+		peers, err := PartitionPeers(nodes, self, mode)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s in %s: %s", self, mode, err)
+		}
+		if !reflect.DeepEqual(peers, expected[self]) {
+			t.Errorf("Expected %s to block %v in %s, got %v", self, expected[self], mode, peers)
+		}
+	}
+}
+
+func TestPartitionPeersMajorityMinority(t *testing.T) {
+	verifyPeers(t, ModeMajorityMinority, map[string][]string{
+		"a": {"d", "e"},
+		"b": {"d", "e"},
+		"c": {"d", "e"},
+		"d": {"a", "b", "c"},
+		"e": {"a", "b", "c"},
+	})
+}
+
+func TestPartitionPeersIsolate(t *testing.T) {
+	verifyPeers(t, "isolate=c", map[string][]string{
+		"a": {"c"},
+		"b": {"c"},
+		"c": {"a", "b", "d", "e"},
+		"d": {"c"},
+		"e": {"c"},
+	})
+}
+
+func TestPartitionPeersBridge(t *testing.T) {
+	verifyPeers(t, ModeBridge, map[string][]string{
+		"a": {"d", "e"},
+		"b": {"d", "e"},
+		"c": {},
+		"d": {"a", "b"},
+		"e": {"a", "b"},
+	})
+}
+
+func TestPartitionPeersRing(t *testing.T) {
+	verifyPeersOf(t, []string{"a", "b", "c", "d"}, ModeRing, map[string][]string{
+		"a": {"c"},
+		"b": {"d"},
+		"c": {"a"},
+		"d": {"b"},
+	})
+	verifyPeersOf(t, []string{"a", "b", "c", "d", "e"}, ModeRing, map[string][]string{
+		"a": {"c", "d"},
+		"b": {"d", "e"},
+		"c": {"a", "e"},
+		"d": {"a", "b"},
+		"e": {"b", "c"},
+	})
+	verifyPeersOf(t, []string{"a", "b", "c", "d", "e", "f"}, ModeRing, map[string][]string{
+		"a": {"c", "e"},
+		"b": {"d", "f"},
+		"c": {"a", "e"},
+		"d": {"b", "f"},
+		"e": {"a", "c"},
+		"f": {"b", "d"},
+	})
+	verifyPeersOf(t, []string{"a", "b", "c", "d", "e", "f", "g"}, ModeRing, map[string][]string{
+		"a": {"d", "e"},
+		"b": {"e", "f"},
+		"c": {"f", "g"},
+		"d": {"a", "g"},
+		"e": {"a", "b"},
+		"f": {"b", "c"},
+		"g": {"c", "d"},
+	})
+}
+
+// Every node must see a majority, and no two the same one.
+func TestPartitionPeersRingMajorities(t *testing.T) {
+	names := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k"}
+	for n := 4; n <= len(names); n++ {
+		nodes := names[:n]
+		majorities := map[string]string{}
+		for _, self := range nodes {
+			peers, err := PartitionPeers(nodes, self, ModeRing)
+			if err != nil {
+				t.Fatalf("Unexpected error for %d nodes: %s", n, err)
+			}
+			if seen := n - len(peers); seen < n/2+1 || seen == n {
+				t.Errorf("Expected %s to see a majority short of all %d nodes, it sees %d", self, n, seen)
+			}
+			key := strings.Join(peers, ",")
+			if other, found := majorities[key]; found {
+				t.Errorf("Expected %s and %s to see different majorities of %d nodes", self, other, n)
+			}
+			majorities[key] = self
+		}
+	}
+}
+
+func TestPartitionPeersRingTooSmall(t *testing.T) {
+	for _, nodes := range [][]string{{"a"}, {"a", "b"}, {"a", "b", "c"}} {
+		if _, err := PartitionPeers(nodes, "a", ModeRing); err == nil {
+			t.Errorf("Expected an error for a ring of %d nodes", len(nodes))
+		}
+	}
+}
+
+func TestPartitionPeersErrors(t *testing.T) {
+	if _, err := PartitionPeers(testNodes, "z", ModeRing); err == nil {
+		t.Error("Expected an error when self isn't a node")
+	}
+	if _, err := PartitionPeers(testNodes, "a", "isolate=z"); err == nil {
+		t.Error("Expected an error isolating an unknown node")
+	}
+	if _, err := PartitionPeers(testNodes, "a", "scatter"); err == nil {
+		t.Error("Expected an error for an unknown mode")
+	}
+}
@@ -0,0 +1,35 @@
+package throttler
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Directions for Config.Partition.
+const (
+	PartitionBoth = "both"
+	PartitionIn   = "in"
+	PartitionOut  = "out"
+)
+
+// checkPartition validates the partition options of cfg.
+func checkPartition(cfg *Config) error {
+	switch cfg.Partition {
+	case PartitionBoth, PartitionIn, PartitionOut:
+	default:
+		return fmt.Errorf("Unknown partition direction %q (expected %s, %s or %s)", cfg.Partition, PartitionBoth, PartitionIn, PartitionOut)
+	}
+
+	// Blackholing everything would cut this host off, including whatever
+	// session is driving comcast
+	if len(cfg.TargetIps) == 0 && len(cfg.TargetIps6) == 0 {
+		return errors.New("A partition needs target addresses")
+	}
+	return nil
+}
+
+// partitionDirections reports whether traffic from (in) and to (out) the
+// targets is blocked.
+func partitionDirections(cfg *Config) (in, out bool) {
+	return cfg.Partition != PartitionOut, cfg.Partition != PartitionIn
+}
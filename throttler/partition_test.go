@@ -0,0 +1,122 @@
+package throttler
+
+import (
+	"testing"
+)
+
+func TestTcPartitionSetup(t *testing.T) {
+	r := newCmdRecorder()
+	th := &tcThrottler{r}
+	cfg := defaultTestConfig
+	cfg.Partition = PartitionBoth
+	cfg.TargetIps6 = []string{"2001:db8::1"}
+	cfg.TargetProtos = []string{"tcp", "icmp"}
+	th.setup(&cfg)
+	r.verifyCommands(t, []string{
+		"iptables -A OUTPUT -d 10.10.10.10 -p tcp --dport 80 -m comment --comment comcast-partition -j DROP",
+		"iptables -A INPUT -s 10.10.10.10 -p tcp --sport 80 -m comment --comment comcast-partition -j DROP",
+		"iptables -A OUTPUT -d 10.10.10.10 -p icmp -m comment --comment comcast-partition -j DROP",
+		"iptables -A INPUT -s 10.10.10.10 -p icmp -m comment --comment comcast-partition -j DROP",
+		"ip6tables -A OUTPUT -d 2001:db8::1 -p tcp --dport 80 -m comment --comment comcast-partition -j DROP",
+		"ip6tables -A INPUT -s 2001:db8::1 -p tcp --sport 80 -m comment --comment comcast-partition -j DROP",
+		"ip6tables -A OUTPUT -d 2001:db8::1 -p ipv6-icmp -m comment --comment comcast-partition -j DROP",
+		"ip6tables -A INPUT -s 2001:db8::1 -p ipv6-icmp -m comment --comment comcast-partition -j DROP",
+	})
+}
+
+func TestTcPartitionRejectOneWay(t *testing.T) {
+	r := newCmdRecorder()
+	th := &tcThrottler{r}
+	cfg := defaultTestConfig
+	cfg.Partition = PartitionOut
+	cfg.PartitionReject = true
+	cfg.TargetPorts = []string{}
+	cfg.TargetProtos = []string{"tcp", "udp"}
+	th.setup(&cfg)
+	r.verifyCommands(t, []string{
+		"iptables -A OUTPUT -d 10.10.10.10 -p tcp -m comment --comment comcast-partition -j REJECT --reject-with tcp-reset",
+		"iptables -A OUTPUT -d 10.10.10.10 -p udp -m comment --comment comcast-partition -j REJECT",
+	})
+}
+
+func TestTcPartitionNeedsTargets(t *testing.T) {
+	r := newCmdRecorder()
+	th := &tcThrottler{r}
+	cfg := defaultTestConfig
+	cfg.Partition = PartitionIn
+	cfg.TargetIps = []string{}
+	if err := th.setup(&cfg); err == nil {
+		t.Fatal("Expected an error partitioning without target addresses")
+	}
+	r.verifyCommands(t, []string{})
+}
+
+func TestTcPartitionTeardown(t *testing.T) {
+	r := newCmdRecorder()
+	th := &tcThrottler{r}
+	r.responses = map[string][]string{
+		"iptables -S": {
+			"-P INPUT ACCEPT",
+			"-P OUTPUT ACCEPT",
+			"-A INPUT -s 10.10.10.10/32 -p tcp -m tcp --sport 80 -m comment --comment comcast-partition -j DROP",
+			"-A OUTPUT -d 10.10.10.10/32 -p tcp -m tcp --dport 80 -m comment --comment comcast-partition -j DROP",
+		},
+		"tc qdisc show dev eth0": {
+			"qdisc fq_codel 0: root refcnt 2 limit 10240p flows 1024 quantum 1514",
+		},
+	}
+	th.teardown(&defaultTestConfig)
+	r.verifyCommands(t, []string{
+		tcReadEth0State,
+		"tc qdisc show dev eth0",
+		"iptables -S -t mangle",
+		"ip6tables -S -t mangle",
+		"iptables -S",
+		"iptables -D INPUT -s 10.10.10.10/32 -p tcp -m tcp --sport 80 -m comment --comment comcast-partition -j DROP",
+		"iptables -D OUTPUT -d 10.10.10.10/32 -p tcp -m tcp --dport 80 -m comment --comment comcast-partition -j DROP",
+		"ip6tables -S",
+	})
+}
+
+func TestPfctlPartitionSetup(t *testing.T) {
+	r := newCmdRecorder()
+	th := &pfctlThrottler{r}
+	cfg := defaultTestConfig
+	cfg.Partition = PartitionBoth
+	cfg.PartitionReject = true
+	cfg.TargetIps6 = []string{"2001:db8::1"}
+	cfg.TargetPorts = []string{"80", "8000:8080"}
+	cfg.TargetProtos = []string{"tcp", "icmp"}
+	th.setup(&cfg)
+	r.verifyCommands(t, []string{
+		"pfctl -s info",
+		"pfctl -E",
+		`pfctl -f - <<< "include \"/etc/pf.conf\"\ndummynet-anchor \"mop\"\nanchor \"mop\""`,
+		`pfctl -a mop -f - <<< "` +
+			`block return out quick inet proto tcp to 10.10.10.10 port { 80 8000:8080 }\n` +
+			`block return in quick inet proto tcp from 10.10.10.10 port { 80 8000:8080 }\n` +
+			`block return out quick inet proto icmp to 10.10.10.10\n` +
+			`block return in quick inet proto icmp from 10.10.10.10\n` +
+			`block return out quick inet6 proto tcp to 2001:db8::1 port { 80 8000:8080 }\n` +
+			`block return in quick inet6 proto tcp from 2001:db8::1 port { 80 8000:8080 }\n` +
+			`block return out quick inet6 proto ipv6-icmp to 2001:db8::1\n` +
+			`block return in quick inet6 proto ipv6-icmp from 2001:db8::1"`,
+	})
+}
+
+func TestIpfwPartitionSetup(t *testing.T) {
+	r := newCmdRecorder()
+	th := &ipfwThrottler{r}
+	cfg := defaultTestConfig
+	cfg.Partition = PartitionIn
+	cfg.TargetIps6 = []string{"2001:db8::1"}
+	cfg.TargetPorts = []string{"80", "8000:8080"}
+	cfg.TargetProtos = []string{"tcp", "icmp"}
+	th.setup(&cfg)
+	r.verifyCommands(t, []string{
+		"ipfw add 1 deny tcp from 10.10.10.10 to any src-port 80,8000-8080",
+		"ipfw add 1 deny icmp from 10.10.10.10 to any",
+		"ipfw add 1 deny tcp from 2001:db8::1 to any src-port 80,8000-8080",
+		"ipfw add 1 deny ipv6-icmp from 2001:db8::1 to any",
+	})
+}
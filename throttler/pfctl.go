@@ -7,205 +7,262 @@ import (
 )
 
 const (
-	// TODO: use printf in favour of echo due to shell portability issues
-	pfctlCreateAnchor    = `(cat /etc/pf.conf && echo "dummynet-anchor \"mop\"" && echo "anchor \"mop\"") | sudo pfctl -f -`
-	pfctlTeardown        = `sudo pfctl -f /etc/pf.conf`
-	dnctl                = `sudo dnctl pipe 1 config`
-	pfctlCreateDummynet  = `echo $'dummynet in on %s all pipe 1'`
-	pfctlExecuteInline   = `%s | sudo pfctl -a mop -f - `
-	pfctlEnableFirewall  = `sudo pfctl -E`
+	pfConf               = `/etc/pf.conf`
+	pfctlMainRules       = "include \"%s\"\ndummynet-anchor \"mop\"\nanchor \"mop\""
+	pfctlLoad            = `pfctl -f -`
+	pfctlTeardown        = `pfctl -f %s`
+	dnctl                = `dnctl pipe 1 config`
+	dnctlFastLane        = `dnctl pipe 2 config bw %dKbit/s`
+	pfctlCreateDummynet  = `dummynet on %s all pipe 1`
+	pfctlFastLane        = `dummynet on %s all pipe 2`
+	pfctlBlockDrop       = `block drop`
+	pfctlBlockReturn     = `block return`
+	pfctlLoadAnchor      = `pfctl -a mop -f -`
+	pfctlEnableFirewall  = `pfctl -E`
 	pfctlEnableFwRegex   = `pf enabled`
-	pfctlDisableFirewall = `sudo pfctl -d`
+	pfctlDisableFirewall = `pfctl -d`
 	pfctlDisbleFwRegex   = `pf disabled`
-	pfctlIsEnabled       = `sudo pfctl -sa | grep -i enabled`
-	dnctlIsConfigured    = `sudo dnctl show`
-	pfctlIsEnabledRegex  = `Enabled`
-	dnctlTeardown        = `sudo dnctl -q flush`
+	pfctlIsEnabled       = `pfctl -sa`
+	dnctlIsConfigured    = `dnctl show`
+	dnctlPipeSearch      = `00001:`
+	pfctlAnchorRules     = `pfctl -a mop -sr`
+	pfctlAnchorDummynet  = `pfctl -a mop -s dummynet`
+	dnctlTeardown        = `dnctl -q flush`
+	pfctlInfo            = `pfctl -s info`
+	pfctlInfoEnabled     = `Status: Enabled`
+	pfctlShowNat         = `pfctl -sn`
+	pfctlShowRules       = `pfctl -sr`
+	pfctlShowDummynet    = `pfctl -s dummynet`
+	pfctlShowTokens      = `pfctl -s References`
+	pfctlReleaseToken    = `pfctl -X %s`
+	pfctlFlushAnchor     = `pfctl -a mop -F all`
+	pfctlDummynetAnchor  = `dummynet-anchor "mop"`
+	pfctlAnchor          = `anchor "mop"`
+	pfStateFile          = `/var/run/comcast.pf`
+	pfReadState          = `cat %s`
+	pfWriteState         = `tee %s`
+	pfDelState           = `rm -f %s`
+	pfStateEnabled       = "enabled"
+	pfStateDisabled      = "disabled"
+	pfStateToken         = "token "
 )
 
 type pfctlThrottler struct {
 	c commander
 }
 
-// Execute a command and check that any matching line in the result contains 'match'
-func (i *pfctlThrottler) executeAndParse(cmd string, match string) bool {
-	lines, err := i.c.executeGetLines(cmd)
-
-	if err != nil {
-		return false
+func (i *pfctlThrottler) setup(c *Config) error {
+	if err := checkTcOnly(c); err != nil {
+		return err
 	}
 
-	for _, line := range lines {
-		if strings.Contains(line, match) {
-			return true
+	if c.Partition != "" {
+		if err := checkPartition(c); err != nil {
+			return err
 		}
 	}
-	return false
-}
 
-func (i *pfctlThrottler) setup(c *Config) error {
+	// Save what pf is running before touching it, so teardown can put it back
+	state := currentPf(i.c)
+
 	// Enable firewall
-	err := i.c.execute(pfctlEnableFirewall)
+	err := i.c.execute(args(pfctlEnableFirewall))
 	if err != nil {
-		return fmt.Errorf("Could not enable firewall using: `%s`. Error: %s", pfctlEnableFirewall, err.Error())
+		return fmt.Errorf("Could not enable firewall: %w", err)
 	}
 
-	// Add the dummynet and anchor
-	err = i.c.execute(pfctlCreateAnchor)
-	if err != nil {
-		return fmt.Errorf("Could not create anchor rule for dummynet using: `%s`. Error: %s", pfctlCreateAnchor, err.Error())
+	rules := fmt.Sprintf(pfctlMainRules, pfConf)
+	if state != nil {
+		state.token = newToken(i.c, state.tokens)
+		if err := i.c.executeInput(args(pfWriteState, pfStateFile), state.String()); err != nil {
+			return fmt.Errorf("Could not save the firewall state: %w", err)
+		}
+		rules = state.mainRules()
 	}
 
-	// Add 'execute' portion of the command
-	input := fmt.Sprintf(pfctlCreateDummynet, c.Device)
-	cmd := fmt.Sprintf(pfctlExecuteInline, input)
-
-	err = i.c.execute(cmd)
+	// Add the dummynet and anchor after the running rules, or the system's
+	err = i.c.executeInput(args(pfctlLoad), rules)
 	if err != nil {
-		return fmt.Errorf("Could not create dummynet using: `%s`. Error: %s", input, err.Error())
+		return fmt.Errorf("Could not create anchor rule for dummynet: %w", err)
 	}
 
-	// Apply the shaping etc.
-	for _, cmd := range i.buildConfigCommand(c) {
-		err = i.c.execute(cmd)
-		if err != nil {
-			return err
-		}
+	if c.Partition != "" {
+		return i.setupPartition(c)
 	}
 
-	return nil
-}
-
-func (i *pfctlThrottler) teardown(_ *Config) error {
-
-	// Reset firewall rules, leave it running
-	err := i.c.execute(pfctlTeardown)
+	// Load the dummynet rules into the anchor
+	err = i.c.executeInput(args(pfctlLoadAnchor), strings.Join(pfDummynetRules(c), "\n"))
 	if err != nil {
-		return fmt.Errorf("Could not remove firewall rules using: `%s`. Error: %s", pfctlTeardown, err.Error())
+		return fmt.Errorf("Could not create dummynet: %w", err)
 	}
 
-	// Turn off the firewall, discarding any rules
-	err = i.c.execute(pfctlDisableFirewall)
+	// Apply the shaping etc.
+	err = i.c.execute(i.buildConfigCommand(c))
 	if err != nil {
-		return fmt.Errorf("Could not disable firewall using: `%s`. Error: %s", pfctlDisableFirewall, err.Error())
+		return err
 	}
 
-	// Disable dnctl rules
-	err = i.c.execute(dnctlTeardown)
-	if err != nil {
-		return fmt.Errorf("Could not disable dnctl rules using: `%s`. Error: %s", dnctlTeardown, err.Error())
+	if fastLane(c) {
+		return i.c.execute(args(dnctlFastLane, c.DefaultBandwidth))
 	}
-
 	return nil
 }
 
-func (i *pfctlThrottler) isFirewallRunning() bool {
-	return i.executeAndParse(pfctlIsEnabled, pfctlIsEnabledRegex)
-}
-func (i *pfctlThrottler) exists() bool {
-	if dry {
-		return false
+// pfDummynetRules sends the targeted flows through pipe 1 both ways, or all
+// traffic if nothing is targeted. With a fast lane the rest goes through
+// pipe 2.
+func pfDummynetRules(c *Config) []string {
+	if !targeted(c) {
+		return []string{fmt.Sprintf(pfctlCreateDummynet, c.Device)}
+	}
+	rules := pfTargetRules(c, true, true, "dummynet", " on "+c.Device, " pipe 1")
+	if fastLane(c) {
+		rules = append(rules, fmt.Sprintf(pfctlFastLane, c.Device))
 	}
-	return i.executeAndParse(dnctlIsConfigured, "port") || i.isFirewallRunning()
+	return rules
 }
 
-func (i *pfctlThrottler) check() string {
-	return pfctlIsEnabled
+// change reconfigures the dummynet pipe in place.
+func (i *pfctlThrottler) change(c *Config) error {
+	return i.c.execute(i.buildConfigCommand(c))
 }
 
-func addProtosToCommands(cmds []string, protos []string) []string {
-	commands := make([]string, 0)
+// setupPartition loads block rules for the targets into the "mop" anchor.
+func (i *pfctlThrottler) setupPartition(c *Config) error {
+	input := strings.Join(pfPartitionRules(c), "\n")
 
-	for _, cmd := range cmds {
-		for _, proto := range protos {
-			commands = append(commands, fmt.Sprintf("%s proto %s", cmd, proto))
-		}
+	if err := i.c.executeInput(args(pfctlLoadAnchor), input); err != nil {
+		return fmt.Errorf("Could not create block rules: %w", err)
 	}
+	return nil
+}
 
-	return commands
+func pfPartitionRules(c *Config) []string {
+	in, out := partitionDirections(c)
+	block := pfctlBlockDrop
+	if c.PartitionReject {
+		block = pfctlBlockReturn
+	}
+	return pfTargetRules(c, out, in, block, "", "")
 }
-func addPortsToCommand(cmd string, ports []string) []string {
-	commands := make([]string, 0)
 
-	for _, port := range ports {
-		commands = append(commands, fmt.Sprintf("%s dst-port %s", cmd, port))
-		commands = append(commands, fmt.Sprintf("%s src-port %s", cmd, port))
+// pfTargetRules returns a quick rule with action for each target address, or
+// any if there are none, and protocol, to the targets for out and from them
+// for in. The ports only apply to TCP and UDP.
+func pfTargetRules(c *Config, out, in bool, action, on, suffix string) []string {
+	ports := ""
+	if len(c.TargetPorts) == 1 {
+		ports = " port " + c.TargetPorts[0]
+	} else if len(c.TargetPorts) > 1 {
+		ports = " port { " + strings.Join(c.TargetPorts, " ") + " }"
 	}
 
-	return commands
+	rules := []string{}
+	addRules := func(family string, addrs []string) {
+		protos := c.TargetProtos
+		if len(protos) == 0 {
+			protos = []string{""}
+		}
+
+		af := ""
+		if family != "" {
+			af = " " + family
+		}
+		for _, addr := range addrs {
+			for _, proto := range protos {
+				match, prts := "", ""
+				if proto != "" {
+					if family == "inet6" && proto == "icmp" {
+						proto = "ipv6-icmp"
+					}
+					match = " proto " + proto
+					if proto == "tcp" || proto == "udp" {
+						prts = ports
+					}
+				}
+
+				if out {
+					rules = append(rules, fmt.Sprintf("%s out quick%s%s%s to %s%s%s", action, on, af, match, addr, prts, suffix))
+				}
+				if in {
+					rules = append(rules, fmt.Sprintf("%s in quick%s%s%s from %s%s%s", action, on, af, match, addr, prts, suffix))
+				}
+			}
+		}
+	}
+	if len(c.TargetIps) == 0 && len(c.TargetIps6) == 0 {
+		addRules("", []string{"any"})
+	}
+	addRules("inet", c.TargetIps)
+	addRules("inet6", c.TargetIps6)
+
+	return rules
 }
 
-// Takes care of the annoying differences between ipv4 and ipv6
-func addIpsAndProtoToCommands(ipVersion int, cmds []string, ips []string, protos []string) []string {
+func (i *pfctlThrottler) teardown(_ *Config) error {
+	if state := readPfState(i.c); state != nil {
+		return i.restore(state)
+	}
 
-	commands := make([]string, 0)
+	// Reset firewall rules, leave it running
+	err := i.c.execute(args(pfctlTeardown, pfConf))
+	if err != nil {
+		return fmt.Errorf("Could not remove firewall rules: %w", err)
+	}
 
-	for _, cmd := range cmds {
-		for _, ip := range ips {
-			srcIpFlag := "src-ip"
-			dstIpFlag := "dst-ip"
-			if ipVersion == 6 {
-				srcIpFlag = "src-ip6"
-				dstIpFlag = "dst-ip6"
-			}
+	// Turn off the firewall, discarding any rules
+	err = i.c.execute(args(pfctlDisableFirewall))
+	if err != nil {
+		return fmt.Errorf("Could not disable firewall: %w", err)
+	}
 
-			commands = append(commands, addProtoToCommands(ipVersion, fmt.Sprintf("%s %s %s", cmd, srcIpFlag, ip), protos)...)
-			commands = append(commands, addProtoToCommands(ipVersion, fmt.Sprintf("%s %s %s", cmd, dstIpFlag, ip), protos)...)
-		}
+	// Disable dnctl rules
+	err = i.c.execute(args(dnctlTeardown))
+	if err != nil {
+		return fmt.Errorf("Could not disable dnctl rules: %w", err)
 	}
 
-	return commands
+	return i.c.execute(args(appliedDel, appliedFile))
 }
 
-func addProtoToCommands(ipVersion int, cmd string, protos []string) []string {
-	commands := make([]string, 0)
-	for _, proto := range protos {
-		if ipVersion == 6 {
-			if proto == "icmp" {
-				proto = "ipv6-icmp"
-			}
+// exists looks for comcast's own rules only, as pf may well be running for
+// something else, e.g. a VPN client: the saved state, rules in the "mop"
+// anchor, or dnctl pipe 1.
+func (i *pfctlThrottler) exists() bool {
+	if dry {
+		return false
+	}
+	if readPfState(i.c) != nil {
+		return true
+	}
+	for _, cmd := range []string{pfctlAnchorRules, pfctlAnchorDummynet} {
+		if lines, err := i.c.executeGetLines(args(cmd)); err == nil && len(lines) > 0 {
+			return true
 		}
-		commands = append(commands, fmt.Sprintf("%s proto %s", cmd, proto))
 	}
-	return commands
+	return listed(i.c, args(dnctlIsConfigured), dnctlPipeSearch)
 }
 
-func (i *pfctlThrottler) buildConfigCommand(c *Config) []string {
+func (i *pfctlThrottler) check() []string {
+	return args(pfctlIsEnabled)
+}
 
-	cmd := dnctl
+// buildConfigCommand configures the impairments of pipe 1, which the anchor
+// rules send the targeted traffic through.
+func (i *pfctlThrottler) buildConfigCommand(c *Config) []string {
+	cmd := args(dnctl)
 
-	// Add all non tcp version dependent stuff first...
 	if c.Latency > 0 {
-		cmd = cmd + " delay " + strconv.Itoa(c.Latency) + "ms"
+		cmd = append(cmd, "delay", strconv.Itoa(c.Latency)+"ms")
 	}
 
 	if c.TargetBandwidth > 0 {
-		cmd = cmd + " bw " + strconv.Itoa(c.TargetBandwidth) + "Kbit/s"
+		cmd = append(cmd, "bw", strconv.Itoa(c.TargetBandwidth)+"Kbit/s")
 	}
 
 	if c.PacketLoss > 0 {
-		cmd = cmd + " plr " + strconv.FormatFloat(c.PacketLoss/100, 'f', 4, 64)
-	}
-
-	// Add Mask keyword if we have pipe qualifiers
-	if len(c.TargetPorts) > 0 || len(c.TargetProtos) > 0 || len(c.TargetIps) > 0 || len(c.TargetIps6) > 0 {
-		cmd = cmd + " mask "
-	}
-
-	// Expand commands with ports
-	commands := []string{cmd}
-
-	if len(c.TargetPorts) > 0 {
-		commands = addPortsToCommand(cmd, c.TargetPorts)
-	}
-
-	if len(c.TargetIps) == 0 && len(c.TargetIps6) == 0 {
-		if len(c.TargetProtos) > 0 {
-			return addProtosToCommands(commands, c.TargetProtos)
-		}
-		return commands
+		cmd = append(cmd, "plr", strconv.FormatFloat(c.PacketLoss/100, 'f', 4, 64))
 	}
 
-	// create and combine the ipv4 and ipv6 IPs with the protocol version specific keywords
-	return append(addIpsAndProtoToCommands(4, commands, c.TargetIps, c.TargetProtos), addIpsAndProtoToCommands(6, commands, c.TargetIps6, c.TargetProtos)...)
+	return cmd
 }
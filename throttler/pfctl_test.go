@@ -1,11 +1,23 @@
 package throttler
 
 import (
+	"strconv"
+	"strings"
 	"testing"
 )
 
-func TestPfctlDefaultConfigCommand(t *testing.T) {
+// pfSetupCommands returns what setup runs up to loading the anchor rules,
+// without a ruleset to save.
+func pfSetupCommands(rules ...string) []string {
+	return []string{
+		"pfctl -s info",
+		"pfctl -E",
+		`pfctl -f - <<< "include \"/etc/pf.conf\"\ndummynet-anchor \"mop\"\nanchor \"mop\""`,
+		"pfctl -a mop -f - <<< " + strconv.Quote(strings.Join(rules, "\n")),
+	}
+}
 
+func TestPfctlDefaultConfigCommand(t *testing.T) {
 	r := newCmdRecorder()
 	th := &pfctlThrottler{r}
 	c := defaultTestConfig
@@ -14,15 +26,21 @@ func TestPfctlDefaultConfigCommand(t *testing.T) {
 	c.TargetIps6 = []string{}
 	c.TargetBandwidth = -1
 	c.TargetPorts = []string{}
-	c.TargetProtos = []string{"tcp,udp,icmp"}
+	c.TargetProtos = []string{"tcp", "udp", "icmp"}
 
 	th.setup(&c)
-	r.verifyCommands(t, []string{
-		"sudo pfctl -E",
-		`(cat /etc/pf.conf && echo "dummynet-anchor \"mop\"" && echo "anchor \"mop\"") | sudo pfctl -f -`,
-		`echo $'dummynet in all pipe 1' | sudo pfctl -a mop -f - `,
-		`sudo dnctl pipe 1 config mask  proto tcp,udp,icmp`,
-	})
+	r.verifyCommands(t, concat(pfSetupCommands(
+		"dummynet out quick on eth0 proto tcp to any pipe 1",
+		"dummynet in quick on eth0 proto tcp from any pipe 1",
+		"dummynet out quick on eth0 proto udp to any pipe 1",
+		"dummynet in quick on eth0 proto udp from any pipe 1",
+		"dummynet out quick on eth0 proto icmp to any pipe 1",
+		"dummynet in quick on eth0 proto icmp from any pipe 1",
+		"dummynet on eth0 all pipe 2",
+	), []string{
+		"dnctl pipe 1 config",
+		"dnctl pipe 2 config bw 20000Kbit/s",
+	}))
 }
 
 func TestPfctlThrottleOnlyConfigCommand(t *testing.T) {
@@ -39,13 +57,13 @@ func TestPfctlThrottleOnlyConfigCommand(t *testing.T) {
 	th := &pfctlThrottler{r}
 
 	th.setup(&c)
-	r.verifyCommands(t, []string{
-		"sudo pfctl -E",
-		`(cat /etc/pf.conf && echo "dummynet-anchor \"mop\"" && echo "anchor \"mop\"") | sudo pfctl -f -`,
-		`echo $'dummynet in all pipe 1' | sudo pfctl -a mop -f - `,
-		`sudo dnctl pipe 1 config plr 0.0010`,
-	})
+	r.verifyCommands(t, concat(pfSetupCommands(
+		"dummynet on eth0 all pipe 1",
+	), []string{
+		"dnctl pipe 1 config plr 0.0010",
+	}))
 }
+
 func TestPfctlNoIPThrottleConfigCommand(t *testing.T) {
 
 	var c = Config{
@@ -53,7 +71,7 @@ func TestPfctlNoIPThrottleConfigCommand(t *testing.T) {
 		Stop:             false,
 		Latency:          -1,
 		TargetBandwidth:  -1,
-		DefaultBandwidth: 20000,
+		DefaultBandwidth: -1,
 		PacketLoss:       0.1,
 		TargetProtos:     []string{"tcp"},
 	}
@@ -61,12 +79,12 @@ func TestPfctlNoIPThrottleConfigCommand(t *testing.T) {
 	th := &pfctlThrottler{r}
 
 	th.setup(&c)
-	r.verifyCommands(t, []string{
-		"sudo pfctl -E",
-		`(cat /etc/pf.conf && echo "dummynet-anchor \"mop\"" && echo "anchor \"mop\"") | sudo pfctl -f -`,
-		`echo $'dummynet in all pipe 1' | sudo pfctl -a mop -f - `,
-		`sudo dnctl pipe 1 config plr 0.0010 mask  proto tcp`,
-	})
+	r.verifyCommands(t, concat(pfSetupCommands(
+		"dummynet out quick on eth0 proto tcp to any pipe 1",
+		"dummynet in quick on eth0 proto tcp from any pipe 1",
+	), []string{
+		"dnctl pipe 1 config plr 0.0010",
+	}))
 }
 
 func TestPfctlPacketSetup(t *testing.T) {
@@ -77,15 +95,14 @@ func TestPfctlPacketSetup(t *testing.T) {
 	c.PacketLoss = 0.5
 
 	th.setup(&c)
-	r.verifyCommands(t, []string{
-		"sudo pfctl -E",
-		`(cat /etc/pf.conf && echo "dummynet-anchor \"mop\"" && echo "anchor \"mop\"") | sudo pfctl -f -`,
-		`echo $'dummynet in all pipe 1' | sudo pfctl -a mop -f - `,
-		`sudo dnctl pipe 1 config plr 0.0050 mask  dst-port 80 src-ip 10.10.10.10 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0050 mask  dst-port 80 dst-ip 10.10.10.10 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0050 mask  src-port 80 src-ip 10.10.10.10 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0050 mask  src-port 80 dst-ip 10.10.10.10 proto tcp`,
-	})
+	r.verifyCommands(t, concat(pfSetupCommands(
+		"dummynet out quick on eth0 inet proto tcp to 10.10.10.10 port 80 pipe 1",
+		"dummynet in quick on eth0 inet proto tcp from 10.10.10.10 port 80 pipe 1",
+		"dummynet on eth0 all pipe 2",
+	), []string{
+		"dnctl pipe 1 config plr 0.0050",
+		"dnctl pipe 2 config bw 20000Kbit/s",
+	}))
 }
 
 func TestPfctlProtoSetup(t *testing.T) {
@@ -94,87 +111,96 @@ func TestPfctlProtoSetup(t *testing.T) {
 	th := &pfctlThrottler{r}
 	c := defaultTestConfig
 	c.PacketLoss = 0.5
+	c.DefaultBandwidth = -1
 	c.TargetProtos = []string{"tcp", "udp", "icmp"}
 
 	th.setup(&c)
-	r.verifyCommands(t, []string{
-		"sudo pfctl -E",
-		`(cat /etc/pf.conf && echo "dummynet-anchor \"mop\"" && echo "anchor \"mop\"") | sudo pfctl -f -`,
-		`echo $'dummynet in all pipe 1' | sudo pfctl -a mop -f - `,
-		`sudo dnctl pipe 1 config plr 0.0050 mask  dst-port 80 src-ip 10.10.10.10 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0050 mask  dst-port 80 src-ip 10.10.10.10 proto udp`,
-		`sudo dnctl pipe 1 config plr 0.0050 mask  dst-port 80 src-ip 10.10.10.10 proto icmp`,
-		`sudo dnctl pipe 1 config plr 0.0050 mask  dst-port 80 dst-ip 10.10.10.10 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0050 mask  dst-port 80 dst-ip 10.10.10.10 proto udp`,
-		`sudo dnctl pipe 1 config plr 0.0050 mask  dst-port 80 dst-ip 10.10.10.10 proto icmp`,
-		`sudo dnctl pipe 1 config plr 0.0050 mask  src-port 80 src-ip 10.10.10.10 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0050 mask  src-port 80 src-ip 10.10.10.10 proto udp`,
-		`sudo dnctl pipe 1 config plr 0.0050 mask  src-port 80 src-ip 10.10.10.10 proto icmp`,
-		`sudo dnctl pipe 1 config plr 0.0050 mask  src-port 80 dst-ip 10.10.10.10 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0050 mask  src-port 80 dst-ip 10.10.10.10 proto udp`,
-		`sudo dnctl pipe 1 config plr 0.0050 mask  src-port 80 dst-ip 10.10.10.10 proto icmp`,
-	})
+	r.verifyCommands(t, concat(pfSetupCommands(
+		"dummynet out quick on eth0 inet proto tcp to 10.10.10.10 port 80 pipe 1",
+		"dummynet in quick on eth0 inet proto tcp from 10.10.10.10 port 80 pipe 1",
+		"dummynet out quick on eth0 inet proto udp to 10.10.10.10 port 80 pipe 1",
+		"dummynet in quick on eth0 inet proto udp from 10.10.10.10 port 80 pipe 1",
+		"dummynet out quick on eth0 inet proto icmp to 10.10.10.10 pipe 1",
+		"dummynet in quick on eth0 inet proto icmp from 10.10.10.10 pipe 1",
+	), []string{
+		"dnctl pipe 1 config plr 0.0050",
+	}))
 }
 
 func TestPfctlMultiplePortsAndIps(t *testing.T) {
 	r := newCmdRecorder()
 	th := &pfctlThrottler{r}
 	cfg := defaultTestConfig
-	cfg.TargetIps = []string{"1.1.1.1", "2.2.2.2"}
+	cfg.DefaultBandwidth = -1
+	cfg.TargetIps = []string{"1.1.1.1", "2.2.2.0/24"}
 	cfg.TargetPorts = []string{"80", "8080"}
 	cfg.TargetProtos = []string{"tcp"}
 	th.setup(&cfg)
-	r.verifyCommands(t, []string{
-		"sudo pfctl -E",
-		`(cat /etc/pf.conf && echo "dummynet-anchor \"mop\"" && echo "anchor \"mop\"") | sudo pfctl -f -`,
-		`echo $'dummynet in all pipe 1' | sudo pfctl -a mop -f - `,
-		`sudo dnctl pipe 1 config plr 0.0010 mask  dst-port 80 src-ip 1.1.1.1 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0010 mask  dst-port 80 dst-ip 1.1.1.1 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0010 mask  dst-port 80 src-ip 2.2.2.2 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0010 mask  dst-port 80 dst-ip 2.2.2.2 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0010 mask  src-port 80 src-ip 1.1.1.1 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0010 mask  src-port 80 dst-ip 1.1.1.1 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0010 mask  src-port 80 src-ip 2.2.2.2 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0010 mask  src-port 80 dst-ip 2.2.2.2 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0010 mask  dst-port 8080 src-ip 1.1.1.1 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0010 mask  dst-port 8080 dst-ip 1.1.1.1 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0010 mask  dst-port 8080 src-ip 2.2.2.2 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0010 mask  dst-port 8080 dst-ip 2.2.2.2 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0010 mask  src-port 8080 src-ip 1.1.1.1 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0010 mask  src-port 8080 dst-ip 1.1.1.1 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0010 mask  src-port 8080 src-ip 2.2.2.2 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0010 mask  src-port 8080 dst-ip 2.2.2.2 proto tcp`,
-	})
+	r.verifyCommands(t, concat(pfSetupCommands(
+		"dummynet out quick on eth0 inet proto tcp to 1.1.1.1 port { 80 8080 } pipe 1",
+		"dummynet in quick on eth0 inet proto tcp from 1.1.1.1 port { 80 8080 } pipe 1",
+		"dummynet out quick on eth0 inet proto tcp to 2.2.2.0/24 port { 80 8080 } pipe 1",
+		"dummynet in quick on eth0 inet proto tcp from 2.2.2.0/24 port { 80 8080 } pipe 1",
+	), []string{
+		"dnctl pipe 1 config plr 0.0010",
+	}))
 }
 
 func TestPfctlMixedIPv6Setup(t *testing.T) {
 	r := newCmdRecorder()
 	th := &pfctlThrottler{r}
 	cfg := defaultTestConfig
+	cfg.DefaultBandwidth = -1
 	cfg.TargetProtos = []string{"icmp", "tcp"}
 	cfg.PacketLoss = 0.2
 	cfg.TargetIps6 = []string{"2001:db8::1"}
 	th.setup(&cfg)
-	r.verifyCommands(t, []string{
-		`sudo pfctl -E`,
-		`(cat /etc/pf.conf && echo "dummynet-anchor \"mop\"" && echo "anchor \"mop\"") | sudo pfctl -f -`,
-		`echo $'dummynet in all pipe 1' | sudo pfctl -a mop -f - `,
-
-		`sudo dnctl pipe 1 config plr 0.0020 mask  dst-port 80 src-ip 10.10.10.10 proto icmp`,
-		`sudo dnctl pipe 1 config plr 0.0020 mask  dst-port 80 src-ip 10.10.10.10 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0020 mask  dst-port 80 dst-ip 10.10.10.10 proto icmp`,
-		`sudo dnctl pipe 1 config plr 0.0020 mask  dst-port 80 dst-ip 10.10.10.10 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0020 mask  src-port 80 src-ip 10.10.10.10 proto icmp`,
-		`sudo dnctl pipe 1 config plr 0.0020 mask  src-port 80 src-ip 10.10.10.10 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0020 mask  src-port 80 dst-ip 10.10.10.10 proto icmp`,
-		`sudo dnctl pipe 1 config plr 0.0020 mask  src-port 80 dst-ip 10.10.10.10 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0020 mask  dst-port 80 src-ip6 2001:db8::1 proto ipv6-icmp`,
-		`sudo dnctl pipe 1 config plr 0.0020 mask  dst-port 80 src-ip6 2001:db8::1 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0020 mask  dst-port 80 dst-ip6 2001:db8::1 proto ipv6-icmp`,
-		`sudo dnctl pipe 1 config plr 0.0020 mask  dst-port 80 dst-ip6 2001:db8::1 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0020 mask  src-port 80 src-ip6 2001:db8::1 proto ipv6-icmp`,
-		`sudo dnctl pipe 1 config plr 0.0020 mask  src-port 80 src-ip6 2001:db8::1 proto tcp`,
-		`sudo dnctl pipe 1 config plr 0.0020 mask  src-port 80 dst-ip6 2001:db8::1 proto ipv6-icmp`,
-		`sudo dnctl pipe 1 config plr 0.0020 mask  src-port 80 dst-ip6 2001:db8::1 proto tcp`,
-	})
+	r.verifyCommands(t, concat(pfSetupCommands(
+		"dummynet out quick on eth0 inet proto icmp to 10.10.10.10 pipe 1",
+		"dummynet in quick on eth0 inet proto icmp from 10.10.10.10 pipe 1",
+		"dummynet out quick on eth0 inet proto tcp to 10.10.10.10 port 80 pipe 1",
+		"dummynet in quick on eth0 inet proto tcp from 10.10.10.10 port 80 pipe 1",
+		"dummynet out quick on eth0 inet6 proto ipv6-icmp to 2001:db8::1 pipe 1",
+		"dummynet in quick on eth0 inet6 proto ipv6-icmp from 2001:db8::1 pipe 1",
+		"dummynet out quick on eth0 inet6 proto tcp to 2001:db8::1 port 80 pipe 1",
+		"dummynet in quick on eth0 inet6 proto tcp from 2001:db8::1 port 80 pipe 1",
+	), []string{
+		"dnctl pipe 1 config plr 0.0020",
+	}))
+}
+
+func TestPfctlFastLane(t *testing.T) {
+	r := newCmdRecorder()
+	th := &pfctlThrottler{r}
+	cfg := defaultTestConfig
+	cfg.Latency = 100
+	cfg.PacketLoss = 0
+	cfg.TargetIps6 = []string{"2001:db8::1"}
+	cfg.TargetProtos = []string{"tcp", "icmp"}
+	if err := th.setup(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	rules := []string{
+		"dummynet out quick on eth0 inet proto tcp to 10.10.10.10 port 80 pipe 1",
+		"dummynet in quick on eth0 inet proto tcp from 10.10.10.10 port 80 pipe 1",
+		"dummynet out quick on eth0 inet proto icmp to 10.10.10.10 pipe 1",
+		"dummynet in quick on eth0 inet proto icmp from 10.10.10.10 pipe 1",
+		"dummynet out quick on eth0 inet6 proto tcp to 2001:db8::1 port 80 pipe 1",
+		"dummynet in quick on eth0 inet6 proto tcp from 2001:db8::1 port 80 pipe 1",
+		"dummynet out quick on eth0 inet6 proto ipv6-icmp to 2001:db8::1 pipe 1",
+		"dummynet in quick on eth0 inet6 proto ipv6-icmp from 2001:db8::1 pipe 1",
+		"dummynet on eth0 all pipe 2",
+	}
+	if actual := pfDummynetRules(&cfg); strings.Join(actual, "\n") != strings.Join(rules, "\n") {
+		t.Errorf("Expected rules:\n%s\ngot:\n%s", strings.Join(rules, "\n"), strings.Join(actual, "\n"))
+	}
+	if last := r.commands[len(r.commands)-1]; last != "dnctl pipe 2 config bw 20000Kbit/s" {
+		t.Errorf("Expected the fast lane pipe to be configured last, got %s", last)
+	}
+
+	cfg.DefaultBandwidth = -1
+	if rules := pfDummynetRules(&cfg); len(rules) != 8 || strings.Contains(strings.Join(rules, "\n"), "pipe 2") {
+		t.Errorf("Expected only the targeted flows without a default bandwidth, got %v", rules)
+	}
 }
@@ -0,0 +1,164 @@
+package throttler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// pfState is what pf ran before comcast enabled it: whether it was enabled,
+// and its running ruleset, which a VPN client may well have loaded instead
+// of /etc/pf.conf.
+type pfState struct {
+	enabled bool
+	// token is the enable reference pfctl -E took for comcast, and tokens
+	// the ones taken before it.
+	token  string
+	tokens []string
+	// head holds the scrub and translation rules, and dummynet the dummynet
+	// ones such as the system's dummynet-anchor "com.apple/*", which have to
+	// come before the filter rules in that order when the ruleset is loaded
+	// again.
+	head     []string
+	dummynet []string
+	filter   []string
+}
+
+// currentPf reads pf's status and running ruleset, or nil if they can't be
+// read, as in a dry run.
+func currentPf(c commander) *pfState {
+	info, err := c.executeGetLines(args(pfctlInfo))
+	if err != nil || len(info) == 0 {
+		return nil
+	}
+	nat, err := c.executeGetLines(args(pfctlShowNat))
+	if err != nil {
+		return nil
+	}
+	rules, err := c.executeGetLines(args(pfctlShowRules))
+	if err != nil {
+		return nil
+	}
+	dummynet, err := c.executeGetLines(args(pfctlShowDummynet))
+	if err != nil {
+		return nil
+	}
+
+	state := &pfState{enabled: strings.Contains(strings.Join(info, "\n"), pfctlInfoEnabled), tokens: pfTokens(c)}
+	for _, rule := range rules {
+		if strings.Contains(rule, `anchor "mop"`) {
+			continue //Left over from an earlier setup
+		} else if strings.HasPrefix(rule, "scrub") {
+			state.head = append(state.head, rule)
+		} else {
+			state.filter = append(state.filter, rule)
+		}
+	}
+	state.head = append(state.head, nat...)
+	for _, rule := range dummynet {
+		if !strings.Contains(rule, `anchor "mop"`) {
+			state.dummynet = append(state.dummynet, rule)
+		}
+	}
+	return state
+}
+
+// pfTokens returns the enable references pfctl processes hold.
+func pfTokens(c commander) []string {
+	lines, _ := c.executeGetLines(args(pfctlShowTokens))
+	tokens := []string{}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields)-1; i++ {
+			if fields[i] != pfctl {
+				continue
+			}
+			if _, err := strconv.ParseUint(fields[i+1], 10, 64); err == nil {
+				tokens = append(tokens, fields[i+1])
+			}
+			break
+		}
+	}
+	return tokens
+}
+
+// newToken finds the enable reference pfctl -E just took, among the ones
+// that weren't held before.
+func newToken(c commander, before []string) string {
+	for _, token := range pfTokens(c) {
+		if !contains(before, token) {
+			return token
+		}
+	}
+	return ""
+}
+
+// mainRules adds comcast's dummynet anchor and anchor to the saved ruleset.
+func (s *pfState) mainRules() string {
+	return strings.Join(concat(s.head, s.dummynet, []string{pfctlDummynetAnchor}, s.filter, []string{pfctlAnchor}), "\n")
+}
+
+func (s *pfState) ruleset() string {
+	return strings.Join(concat(s.head, s.dummynet, s.filter), "\n")
+}
+
+// String renders the state for the state file: the status, the token if
+// there is one, and the ruleset in the order it loads in.
+func (s *pfState) String() string {
+	lines := []string{pfStateDisabled}
+	if s.enabled {
+		lines[0] = pfStateEnabled
+	}
+	if s.token != "" {
+		lines = append(lines, pfStateToken+s.token)
+	}
+	return strings.Join(concat(lines, s.head, s.dummynet, s.filter), "\n")
+}
+
+// readPfState reads what setup saved, or nil if it saved nothing.
+func readPfState(c commander) *pfState {
+	lines, err := c.executeGetLines(args(pfReadState, pfStateFile))
+	if err != nil || len(lines) == 0 {
+		return nil
+	}
+
+	state := &pfState{enabled: lines[0] == pfStateEnabled}
+	lines = lines[1:]
+	if len(lines) > 0 && strings.HasPrefix(lines[0], pfStateToken) {
+		state.token = strings.TrimPrefix(lines[0], pfStateToken)
+		lines = lines[1:]
+	}
+	state.filter = lines
+	return state
+}
+
+// restore empties comcast's anchor, loads the saved ruleset and gives back
+// the enable reference, so pf only stops if nothing else keeps it running.
+func (i *pfctlThrottler) restore(state *pfState) error {
+	if err := i.c.execute(args(pfctlFlushAnchor)); err != nil {
+		return fmt.Errorf("Could not remove firewall rules: %w", err)
+	}
+
+	if err := i.c.executeInput(args(pfctlLoad), state.ruleset()); err != nil {
+		return fmt.Errorf("Could not restore firewall rules: %w", err)
+	}
+
+	var err error
+	if state.token != "" {
+		err = i.c.execute(args(pfctlReleaseToken, state.token))
+	} else if !state.enabled {
+		err = i.c.execute(args(pfctlDisableFirewall))
+	}
+	if err != nil {
+		return fmt.Errorf("Could not disable firewall: %w", err)
+	}
+
+	if err := i.c.execute(args(dnctlTeardown)); err != nil {
+		return fmt.Errorf("Could not disable dnctl rules: %w", err)
+	}
+
+	if err := i.c.execute(args(pfDelState, pfStateFile)); err != nil {
+		return err
+	}
+	return i.c.execute(args(appliedDel, appliedFile))
+}
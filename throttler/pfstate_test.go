@@ -0,0 +1,180 @@
+package throttler
+
+import (
+	"strings"
+	"testing"
+)
+
+// enableRecorder lists the tokens pfctl -E takes once it has run.
+type enableRecorder struct {
+	*cmdRecorder
+	tokens []string
+}
+
+func (r *enableRecorder) execute(cmd []string) error {
+	if err := r.cmdRecorder.execute(cmd); err != nil {
+		return err
+	}
+	if r.commands[len(r.commands)-1] == pfctlEnableFirewall {
+		r.responses[pfctlShowTokens] = r.tokens
+	}
+	return nil
+}
+
+var pfVPNState = map[string][]string{
+	"pfctl -s info": {
+		"No ALTQ support in kernel",
+		"Status: Enabled for 0 days 01:02:03           Debug: Urgent",
+	},
+	"pfctl -sn": {
+		`nat-anchor "com.apple/*" all`,
+		`rdr-anchor "com.apple/*" all`,
+	},
+	"pfctl -sr": {
+		"scrub-anchor \"com.apple/*\" all fragment reassemble",
+		`anchor "com.apple/*" all`,
+		"block drop out quick on en0 all",
+		"pass out quick on utun3 all flags S/SA keep state",
+		`anchor "mop" all`,
+	},
+	"pfctl -s dummynet": {
+		`dummynet-anchor "com.apple/*" all`,
+		`dummynet-anchor "mop" all`,
+	},
+	"pfctl -s References": {
+		"TOKENS:",
+		"PID      Process Name                 TOKEN                 TIMESTAMP",
+		"412      VPNClient                    1688849860263936      5823 secs",
+	},
+}
+
+func TestPfctlSaveState(t *testing.T) {
+	r := &enableRecorder{newCmdRecorder(), []string{
+		"TOKENS:",
+		"PID      Process Name                 TOKEN                 TIMESTAMP",
+		"412      VPNClient                    1688849860263936      5823 secs",
+		"9001     pfctl                        18446742974200891999  0 secs",
+	}}
+	for cmd, lines := range pfVPNState {
+		r.responses[cmd] = lines
+	}
+	cfg := defaultTestConfig
+	cfg.Partition = PartitionOut
+	cfg.TargetPorts = nil
+	cfg.TargetProtos = nil
+	if err := (&pfctlThrottler{r}).setup(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	r.verifyCommands(t, []string{
+		"pfctl -s info",
+		"pfctl -sn",
+		"pfctl -sr",
+		"pfctl -s dummynet",
+		"pfctl -s References",
+		"pfctl -E",
+		"pfctl -s References",
+		`tee /var/run/comcast.pf <<< "enabled\ntoken 18446742974200891999\n` +
+			`scrub-anchor \"com.apple/*\" all fragment reassemble\nnat-anchor \"com.apple/*\" all\nrdr-anchor \"com.apple/*\" all\n` +
+			`dummynet-anchor \"com.apple/*\" all\n` +
+			`anchor \"com.apple/*\" all\nblock drop out quick on en0 all\npass out quick on utun3 all flags S/SA keep state"`,
+		`pfctl -f - <<< "scrub-anchor \"com.apple/*\" all fragment reassemble\nnat-anchor \"com.apple/*\" all\nrdr-anchor \"com.apple/*\" all\n` +
+			`dummynet-anchor \"com.apple/*\" all\ndummynet-anchor \"mop\"\n` +
+			`anchor \"com.apple/*\" all\nblock drop out quick on en0 all\npass out quick on utun3 all flags S/SA keep state\n` +
+			`anchor \"mop\""`,
+		`pfctl -a mop -f - <<< "block drop out quick inet to 10.10.10.10"`,
+	})
+}
+
+func TestPfctlRestoreState(t *testing.T) {
+	r := newCmdRecorder()
+	r.responses["cat /var/run/comcast.pf"] = []string{
+		"enabled",
+		"token 18446742974200891999",
+		`nat-anchor "com.apple/*" all`,
+		"pass out quick on utun3 all flags S/SA keep state",
+	}
+	if err := (&pfctlThrottler{r}).teardown(&defaultTestConfig); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	r.verifyCommands(t, []string{
+		"cat /var/run/comcast.pf",
+		"pfctl -a mop -F all",
+		`pfctl -f - <<< "nat-anchor \"com.apple/*\" all\npass out quick on utun3 all flags S/SA keep state"`,
+		"pfctl -X 18446742974200891999",
+		"dnctl -q flush",
+		"rm -f /var/run/comcast.pf",
+		"rm -f /var/run/comcast.applied",
+	})
+}
+
+func TestPfctlRestoreDisabled(t *testing.T) {
+	// Without a token pf is only disabled again if it was disabled before
+	r := newCmdRecorder()
+	r.responses["cat /var/run/comcast.pf"] = []string{"disabled"}
+	if err := (&pfctlThrottler{r}).teardown(&defaultTestConfig); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	r.verifyCommands(t, []string{
+		"cat /var/run/comcast.pf",
+		"pfctl -a mop -F all",
+		`pfctl -f - <<< ""`,
+		"pfctl -d",
+		"dnctl -q flush",
+		"rm -f /var/run/comcast.pf",
+		"rm -f /var/run/comcast.applied",
+	})
+
+	r = newCmdRecorder()
+	r.responses["cat /var/run/comcast.pf"] = []string{"enabled"}
+	if err := (&pfctlThrottler{r}).teardown(&defaultTestConfig); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	for _, cmd := range r.commands {
+		if cmd == pfctlDisableFirewall {
+			t.Errorf("Expected pf to be left enabled, got %v", r.commands)
+		}
+	}
+}
+
+func TestPfctlTeardownWithoutState(t *testing.T) {
+	r := newCmdRecorder()
+	if err := (&pfctlThrottler{r}).teardown(&defaultTestConfig); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	r.verifyCommands(t, []string{
+		"cat /var/run/comcast.pf",
+		"pfctl -f /etc/pf.conf",
+		"pfctl -d",
+		"dnctl -q flush",
+		"rm -f /var/run/comcast.applied",
+	})
+}
+
+func TestPfctlSetupWithPfEnabled(t *testing.T) {
+	// pf running for a VPN client isn't comcast's rules being set up
+	r := newCmdRecorder()
+	for cmd, lines := range pfVPNState {
+		r.responses[cmd] = lines
+	}
+	r.responses["pfctl -sa"] = []string{"Status: Enabled for 0 days 01:02:03           Debug: Urgent"}
+	r.responses["dnctl show"] = []string{}
+	cfg := defaultTestConfig
+	if err := setup(&pfctlThrottler{r}, &cfg); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.HasPrefix(strings.Join(r.commands, "\n"), "cat /var/run/comcast.pf\npfctl -a mop -sr\npfctl -a mop -s dummynet\ndnctl show\npfctl -s info\n") {
+		t.Errorf("Expected setup to save pf's state, got:\n%s", strings.Join(r.commands, "\n"))
+	}
+
+	r = newCmdRecorder()
+	r.responses["cat /var/run/comcast.pf"] = []string{"enabled"}
+	if err := setup(&pfctlThrottler{r}, &cfg); err != ErrAlreadySetup {
+		t.Errorf("Expected %v with the state saved, got %v", ErrAlreadySetup, err)
+	}
+
+	r = newCmdRecorder()
+	r.responses["dnctl show"] = []string{"00001: 20.000 Mbit/s    0 ms burst 0"}
+	if err := setup(&pfctlThrottler{r}, &cfg); err != ErrAlreadySetup {
+		t.Errorf("Expected %v with pipe 1 configured, got %v", ErrAlreadySetup, err)
+	}
+}
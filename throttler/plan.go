@@ -0,0 +1,138 @@
+package throttler
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Change actions.
+const (
+	ChangeAdd    = "add"
+	ChangeUpdate = "change"
+	ChangeRemove = "remove"
+)
+
+// Change is one step from the live packet rules towards the ones a Config
+// asks for.
+type Change struct {
+	Action string
+	// Rule names what changes, e.g. a tc class or an iptables rule, and
+	// Detail how it's shaped, before and after for a change.
+	Rule    string
+	Detail  string
+	Command []string
+	Input   string
+}
+
+func (c Change) String() string {
+	symbol := map[string]string{ChangeAdd: "+", ChangeUpdate: "~", ChangeRemove: "-"}[c.Action]
+	if c.Detail == "" {
+		return symbol + " " + c.Rule
+	}
+	return symbol + " " + c.Rule + " (" + c.Detail + ")"
+}
+
+// appliedFile keeps the config Apply set up with throttlers that aren't
+// planners, so applying it again changes nothing. Their teardown removes it.
+const (
+	appliedFile  = `/var/run/comcast.applied`
+	appliedRead  = `cat %s`
+	appliedWrite = `tee %s`
+	appliedDel   = `rm -f %s`
+)
+
+// planner is implemented by throttlers that can tell which of the commands
+// setting up cfg are already in effect, and which live rules it doesn't ask
+// for. Other throttlers replace all their rules when any are in place, unless
+// Apply set up the same config.
+type planner interface {
+	plan(cfg *Config, desired []command) ([]Change, error)
+}
+
+// Plan returns the changes that take the live packet rules to the ones cfg
+// asks for, reading them but changing nothing.
+func Plan(cfg *Config) ([]Change, error) {
+	return plan(cfg, &shellCommander{privilegeFor(cfg)}, func(c commander) (throttler, error) {
+		return newThrottler(cfg, c)
+	})
+}
+
+// Apply makes the changes Plan returns, so applying the same cfg again
+// changes nothing. It returns the changes made.
+func Apply(cfg *Config) ([]Change, error) {
+	changes, err := Plan(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return changes, apply(changes, newCommander(cfg))
+}
+
+func plan(cfg *Config, live commander, backend func(commander) (throttler, error)) ([]Change, error) {
+	t, err := backend(live)
+	if err != nil {
+		return nil, err
+	}
+
+	desired := &collectCommander{reader: live}
+	d, _ := backend(desired)
+	if err := d.setup(cfg); err != nil {
+		return nil, err
+	}
+
+	if p, ok := t.(planner); ok {
+		return p.plan(cfg, desired.commands)
+	}
+
+	applied := appliedConfig(cfg)
+	changes := []Change{}
+	if t.exists() {
+		if lines, err := live.executeGetLines(args(appliedRead, appliedFile)); err == nil && strings.Join(lines, "\n") == applied {
+			return changes, nil
+		}
+
+		removed := &collectCommander{reader: live}
+		r, _ := backend(removed)
+		if u, ok := r.(undoer); ok {
+			err = u.undo(cfg)
+		} else {
+			err = r.teardown(cfg)
+		}
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, commandChanges(ChangeRemove, removed.commands)...)
+	}
+	desired.commands = append(desired.commands, command{argv: args(appliedWrite, appliedFile), input: applied})
+	return append(changes, commandChanges(ChangeAdd, desired.commands)...), nil
+}
+
+// appliedConfig renders what cfg sets up for the applied file.
+func appliedConfig(cfg *Config) string {
+	saved := *cfg
+	saved.Stop, saved.DryRun = false, false
+	b, _ := json.Marshal(&saved)
+	return string(b)
+}
+
+func commandChanges(action string, cmds []command) []Change {
+	changes := []Change{}
+	for _, cmd := range cmds {
+		changes = append(changes, Change{Action: action, Rule: shellJoin(cmd.argv), Command: cmd.argv, Input: cmd.input})
+	}
+	return changes
+}
+
+func apply(changes []Change, c commander) error {
+	for _, change := range changes {
+		var err error
+		if change.Input != "" {
+			err = c.executeInput(change.Command, change.Input)
+		} else {
+			err = c.execute(change.Command)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
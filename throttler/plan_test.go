@@ -0,0 +1,201 @@
+package throttler
+
+import (
+	"strings"
+	"testing"
+)
+
+var tcLiveState = map[string][]string{
+	"tc qdisc show dev eth0": tcRootQDiscShow,
+	"tc class show dev eth0": {
+		"class htb 10:1 root prio 0 rate 20Mbit ceil 20Mbit burst 1600b cburst 1600b",
+		"class htb 10:10 root leaf 100: prio 0 rate 1Gbit ceil 1Gbit burst 1375b cburst 1375b",
+	},
+	"iptables -S -t mangle": {
+		"-P POSTROUTING ACCEPT",
+		"-A POSTROUTING -d 10.10.10.10/32 -p tcp -m tcp --dport 80 -j CLASSIFY --set-class 0010:0010",
+	},
+}
+
+func planWith(t *testing.T, cfg *Config, live map[string][]string) []Change {
+	r := newCmdRecorder()
+	r.responses = live
+	changes, err := plan(cfg, r, func(c commander) (throttler, error) { return &tcThrottler{c}, nil })
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	return changes
+}
+
+func verifyChanges(t *testing.T, changes []Change, expected []string) {
+	actual := []string{}
+	for _, change := range changes {
+		actual = append(actual, change.String())
+	}
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected changes:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+}
+
+func TestTcPlanFromScratch(t *testing.T) {
+	cfg := defaultTestConfig
+	changes := planWith(t, &cfg, map[string][]string{})
+	verifyChanges(t, changes, []string{
+		"+ qdisc 10: (htb default 1)",
+		"+ class 10:1 (htb rate 20000kbit)",
+		"+ class 10:10 (htb rate 1000000kbit)",
+		"+ qdisc 100: (netem loss 0.1%)",
+		"+ iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p tcp --dport 80 -d 10.10.10.10",
+	})
+
+	r := newCmdRecorder()
+	if err := apply(changes, r); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	r.verifyCommands(t, []string{
+		"tc qdisc add dev eth0 handle 10: root htb default 1",
+		"tc class add dev eth0 parent 10: classid 10:1 htb rate 20000kbit",
+		"tc class add dev eth0 parent 10: classid 10:10 htb rate 1000000kbit",
+		"tc qdisc add dev eth0 parent 10:10 handle 100: netem loss 0.10%",
+		"iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p tcp --dport 80 -d 10.10.10.10",
+	})
+}
+
+func TestTcPlanUpToDate(t *testing.T) {
+	cfg := defaultTestConfig
+	verifyChanges(t, planWith(t, &cfg, tcLiveState), []string{})
+}
+
+func TestTcPlanChanges(t *testing.T) {
+	cfg := defaultTestConfig
+	cfg.Latency = 100
+	cfg.TargetPorts = []string{"443"}
+	changes := planWith(t, &cfg, tcLiveState)
+	verifyChanges(t, changes, []string{
+		"- iptables -t mangle -D POSTROUTING -d 10.10.10.10/32 -p tcp -m tcp --dport 80 -j CLASSIFY --set-class 0010:0010",
+		"~ qdisc 100: (netem loss 0.1% -> netem delay 100ms loss 0.1%)",
+		"+ iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p tcp --dport 443 -d 10.10.10.10",
+	})
+	if cmd := strings.Join(changes[1].Command, " "); cmd != "tc qdisc change dev eth0 parent 10:10 handle 100: netem delay 100ms loss 0.10%" {
+		t.Errorf("Expected the netem qdisc to be changed in place, got %s", cmd)
+	}
+}
+
+func TestTcPlanStaleLinks(t *testing.T) {
+	cfg := defaultTestConfig
+	live := map[string][]string{
+		"tc qdisc show dev eth0": {
+			"qdisc htb 10: root refcnt 2 r2q 10 default 0x1 direct_packets_stat 0 direct_qlen 1000",
+			"qdisc netem 100: parent 10:10 limit 1000 loss 0.1%",
+			"qdisc netem 101: parent 10:11 limit 1000 delay 50ms  5ms",
+		},
+		"tc class show dev eth0": {
+			"class htb 10:1 root prio 0 rate 20Mbit ceil 20Mbit burst 1600b cburst 1600b",
+			"class htb 10:10 root leaf 100: prio 0 rate 1Gbit ceil 1Gbit burst 1375b cburst 1375b",
+			"class htb 10:11 root leaf 101: prio 0 rate 1Gbit ceil 1Gbit burst 1375b cburst 1375b",
+		},
+		"iptables -S -t mangle": {
+			"-A POSTROUTING -d 10.10.10.10/32 -p tcp -m tcp --dport 80 -j CLASSIFY --set-class 0010:0010",
+			"-A POSTROUTING -d 10.0.0.2/32 -p tcp -m tcp --dport 80 -j CLASSIFY --set-class 0010:0011",
+		},
+	}
+	verifyChanges(t, planWith(t, &cfg, live), []string{
+		"- iptables -t mangle -D POSTROUTING -d 10.0.0.2/32 -p tcp -m tcp --dport 80 -j CLASSIFY --set-class 0010:0011",
+		"- qdisc 101: (netem delay 50ms jitter 5ms)",
+		"- class 10:11 (htb rate 1000000kbit)",
+	})
+}
+
+func TestTcPlanPartition(t *testing.T) {
+	cfg := defaultTestConfig
+	cfg.Partition = PartitionOut
+	live := map[string][]string{
+		"tc qdisc show dev eth0": tcRootQDiscShow,
+		"iptables -S": {
+			"-A OUTPUT -d 10.10.10.10/32 -p tcp -m tcp --dport 80 -m comment --comment comcast-partition -j DROP",
+		},
+	}
+	changes := planWith(t, &cfg, live)
+	verifyChanges(t, changes, []string{
+		"- tc qdisc del dev eth0 handle 10: root",
+	})
+
+	cfg.PartitionReject = true
+	verifyChanges(t, planWith(t, &cfg, live), []string{
+		"- iptables -D OUTPUT -d 10.10.10.10/32 -p tcp -m tcp --dport 80 -m comment --comment comcast-partition -j DROP",
+		"- tc qdisc del dev eth0 handle 10: root",
+		"+ iptables -A OUTPUT -d 10.10.10.10 -p tcp --dport 80 -m comment --comment comcast-partition -j REJECT --reject-with tcp-reset",
+	})
+}
+
+func TestPlanReplacesRules(t *testing.T) {
+	cfg := defaultTestConfig
+	cfg.PacketLoss = 0
+	cfg.TargetIps = nil
+	r := newCmdRecorder()
+	r.responses = map[string][]string{"ipfw list": {"00001 pipe 1 ip from any to any via eth0"}}
+	changes, err := plan(&cfg, r, func(c commander) (throttler, error) { return &ipfwThrottler{c}, nil })
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	verifyChanges(t, changes, []string{
+		"- ipfw delete 1",
+		"- rm -f /var/run/comcast.applied",
+		"+ ipfw add 1 pipe 1 tcp from any to any dst-port 80 via eth0",
+		"+ ipfw add 1 pipe 2 ip from any to any via eth0",
+		"+ ipfw pipe 1 config",
+		"+ ipfw pipe 2 config bw 20000Kbit/s",
+		"+ tee /var/run/comcast.applied",
+	})
+
+	// Once applied, the same config changes nothing
+	r.responses["cat /var/run/comcast.applied"] = []string{changes[len(changes)-1].Input}
+	changes, err = plan(&cfg, r, func(c commander) (throttler, error) { return &ipfwThrottler{c}, nil })
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	verifyChanges(t, changes, []string{})
+
+	cfg.Latency = 100
+	changes, _ = plan(&cfg, r, func(c commander) (throttler, error) { return &ipfwThrottler{c}, nil })
+	if len(changes) == 0 || changes[0].Rule != "ipfw delete 1" {
+		t.Errorf("Expected another config to replace the rules, got %v", changes)
+	}
+}
+
+func TestPfctlPlanRestoresState(t *testing.T) {
+	// Replacing the rules puts back the ruleset saved before, rather than
+	// /etc/pf.conf
+	r := newCmdRecorder()
+	r.responses = map[string][]string{
+		"cat /var/run/comcast.pf": {"enabled", "token 18446742974200891999", "pass out quick on utun3 all flags S/SA keep state"},
+		"pfctl -a mop -sr":        {"block drop out quick inet from any to 10.10.10.10"},
+	}
+	cfg := defaultTestConfig
+	changes, err := plan(&cfg, r, func(c commander) (throttler, error) { return &pfctlThrottler{c}, nil })
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	removed := []string{}
+	for _, change := range changes {
+		if change.Action == ChangeRemove {
+			removed = append(removed, change.Rule)
+		}
+	}
+	verifyChanges(t, changes[:len(removed)], []string{
+		"- pfctl -a mop -F all",
+		"- pfctl -f -",
+		"- pfctl -X 18446742974200891999",
+		"- dnctl -q flush",
+		"- rm -f /var/run/comcast.pf",
+		"- rm -f /var/run/comcast.applied",
+	})
+}
+
+func TestRuleKey(t *testing.T) {
+	added := strings.Fields("-A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p tcp --match multiport --dports 80,443 -d 2001:db8::1")
+	listed := strings.Fields("-A POSTROUTING -d 2001:db8::1/128 -p tcp -m multiport --dports 80,443 -j CLASSIFY --set-class 0010:0010")
+	if ruleKey(ip6Tables, added) != ruleKey(ip6Tables, listed) {
+		t.Errorf("Expected %s to match %s", ruleKey(ip6Tables, added), ruleKey(ip6Tables, listed))
+	}
+}
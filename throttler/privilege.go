@@ -0,0 +1,87 @@
+package throttler
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Privilege strategies for Config.Privilege. Anything else is taken as a
+// custom command prefix.
+const (
+	PrivilegeAuto = "auto"
+	PrivilegeNone = "none"
+	PrivilegeSudo = "sudo"
+	PrivilegeDoas = "doas"
+)
+
+const (
+	procStatus  = `/proc/self/status`
+	capNetAdmin = 12
+)
+
+// privilegeFor returns the prefix that gives commands the privileges cfg
+// asks for.
+func privilegeFor(cfg *Config) []string {
+	return privilegePrefix(cfg.Privilege, isPrivileged(), func(cmd string) bool {
+		_, err := exec.LookPath(cmd)
+		return err == nil
+	})
+}
+
+// privilegePrefix returns the prefix to run commands with under strategy.
+// Picking automatically, nothing is needed if the process is already
+// privileged, otherwise it's sudo or doas, whichever exists.
+func privilegePrefix(strategy string, privileged bool, exists func(string) bool) []string {
+	switch strategy {
+	case PrivilegeNone:
+		return nil
+	case "", PrivilegeAuto:
+		if privileged {
+			return nil
+		}
+		for _, tool := range []string{PrivilegeSudo, PrivilegeDoas} {
+			if exists(tool) {
+				return []string{tool}
+			}
+		}
+		return nil
+	default:
+		return strings.Fields(strategy)
+	}
+}
+
+// isPrivileged reports whether the process can change packet rules as it is,
+// being root or, in a container say, having CAP_NET_ADMIN.
+func isPrivileged() bool {
+	if os.Geteuid() == 0 {
+		return true
+	}
+
+	f, err := os.Open(procStatus)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	caps, err := effectiveCaps(f)
+	return err == nil && caps&(1<<capNetAdmin) != 0
+}
+
+// effectiveCaps reads the CapEff bitmask from a /proc/<pid>/status file.
+func effectiveCaps(r io.Reader) (uint64, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "CapEff:" {
+			return strconv.ParseUint(fields[1], 16, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, io.ErrUnexpectedEOF
+}
@@ -0,0 +1,59 @@
+package throttler
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPrivilegePrefix(t *testing.T) {
+	exists := func(tools ...string) func(string) bool {
+		return func(cmd string) bool {
+			for _, tool := range tools {
+				if tool == cmd {
+					return true
+				}
+			}
+			return false
+		}
+	}
+
+	for _, test := range []struct {
+		strategy   string
+		privileged bool
+		exists     func(string) bool
+		expected   string
+	}{
+		{"", true, exists("sudo"), ""},
+		{"", false, exists("sudo", "doas"), "sudo"},
+		{PrivilegeAuto, false, exists("doas"), "doas"},
+		{"", false, exists(), ""},
+		{PrivilegeNone, false, exists("sudo"), ""},
+		{PrivilegeDoas, true, exists("sudo"), "doas"},
+		{"sudo -n -E", false, exists(), "sudo -n -E"},
+	} {
+		prefix := privilegePrefix(test.strategy, test.privileged, test.exists)
+		if strings.Join(prefix, " ") != test.expected {
+			t.Errorf("Expected %q for %q, got %q", test.expected, test.strategy, prefix)
+		}
+	}
+}
+
+func TestEffectiveCaps(t *testing.T) {
+	status := "Name:\tcomcast\nCapInh:\t0000000000000000\nCapPrm:\t00000000a80435fb\nCapEff:\t00000000a80435fb\n"
+	caps, err := effectiveCaps(strings.NewReader(status))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if caps&(1<<capNetAdmin) == 0 {
+		t.Errorf("Expected CAP_NET_ADMIN in %x", caps)
+	}
+
+	caps, _ = effectiveCaps(strings.NewReader("CapEff:\t00000000a80425fb\n"))
+	if caps&(1<<capNetAdmin) != 0 {
+		t.Errorf("Expected no CAP_NET_ADMIN in %x", caps)
+	}
+
+	if _, err := effectiveCaps(strings.NewReader("Name:\tcomcast\n")); err == nil {
+		t.Error("Expected an error without CapEff")
+	}
+}
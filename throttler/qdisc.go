@@ -0,0 +1,282 @@
+package throttler
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// tcTree is where comcast's classes go on a device: below its own root qdisc,
+// or grafted onto an HTB root qdisc someone else set up, which is left alone.
+type tcTree struct {
+	major string
+	graft bool
+	// own is whether comcast's root qdisc is in place, and foreign the kind
+	// of a root qdisc comcast has to replace, saving qdiscs to restore it.
+	own     bool
+	foreign string
+	// qdiscs as tc lists them.
+	qdiscs []string
+}
+
+// currentTree looks at the root qdisc on the device. A kernel default one
+// (handle 0:) is simply replaced. An HTB root with comcast's handle is only
+// comcast's own if its netem qdiscs hang below it and state doesn't say it
+// was grafted onto.
+func currentTree(cfg *Config, c commander, state func() []string) *tcTree {
+	lines, err := c.executeGetLines(args(tcShowQDisc, cfg.Device))
+	if err != nil {
+		return &tcTree{major: tcRootHandle, qdiscs: lines, own: true} //Erring on the side of yes if tc can't tell
+	}
+	return treeOf(lines, state)
+}
+
+// treeOf is currentTree for the qdiscs tc listed.
+func treeOf(lines []string, state func() []string) *tcTree {
+	tree := &tcTree{major: tcRootHandle, qdiscs: lines}
+	kind, handle := rootQDisc(lines)
+	switch {
+	case handle == "" || handle == "0:":
+	case kind == "htb" && handle == tcRootHandle && len(comcastLeaves(lines, handle)) > 0 && stateMode(state()) != tcStateGraft:
+		tree.own = true
+	case kind == "htb":
+		tree.major, tree.graft = handle, true
+	default:
+		tree.foreign = kind
+	}
+	return tree
+}
+
+// prepare adds comcast's root qdisc and default class, replacing a foreign
+// root qdisc after saving it, or checks comcast's classes can be grafted.
+func (tree *tcTree) prepare(cfg *Config, c commander) error {
+	switch {
+	case tree.graft:
+		if cfg.DefaultBandwidth > 0 {
+			return fmt.Errorf("Can't limit other traffic to %dkbit/s grafted onto the HTB root qdisc %s on %s, its default class isn't comcast's", cfg.DefaultBandwidth, tree.major, cfg.Device)
+		}
+		if err := checkGraft(cfg, c, tree); err != nil {
+			return err
+		}
+		if err := writeState(cfg, c, tcStateGraft); err != nil {
+			return err
+		}
+		return nil
+	case tree.foreign != "":
+		if err := checkRestorable(cfg, c, tree); err != nil {
+			return err
+		}
+		if err := writeState(cfg, c, tcStateRestore+"\n"+strings.Join(tree.qdiscs, "\n")); err != nil {
+			return err
+		}
+		if err := addRootQDisc(cfg, c, tcReplaceQDisc); err != nil {
+			return err
+		}
+	default:
+		if err := addRootQDisc(cfg, c, tcAddQDisc); err != nil {
+			return err
+		}
+	}
+
+	return addDefaultClass(cfg, c) //The default class for all traffic that isn't classified
+}
+
+// checkGraft makes sure the classes and netem handles comcast uses are free
+// below the HTB root qdisc, unless they're comcast's already.
+func checkGraft(cfg *Config, c commander, tree *tcTree) error {
+	classes, err := c.executeGetLines(args(tcShowClass, cfg.Device))
+	if err != nil {
+		return err
+	}
+	major := tree.major
+	ours := comcastLeaves(tree.qdiscs, major)
+
+	needed := map[string]bool{fmt.Sprintf("%s%x", major, tcTargetMinor): true, fmt.Sprintf("%x:", tcTargetHandle): true}
+	for i := range cfg.Links {
+		needed[fmt.Sprintf("%s%x", major, tcLinkMinor+i)] = true
+		needed[fmt.Sprintf("%x:", tcLinkHandle+i)] = true
+	}
+
+	for _, line := range concat(tree.qdiscs, classes) {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || !needed[fields[2]] {
+			continue
+		}
+		if fields[0] == "class" && contains(ours, fields[2]) {
+			continue
+		}
+		if fields[0] == "qdisc" && fields[1] == "netem" && len(fields) > 4 && contains(ours, fields[4]) {
+			continue
+		}
+		return fmt.Errorf("Can't graft onto the HTB root qdisc %s on %s, %s %s is taken", major, cfg.Device, fields[0], fields[2])
+	}
+	return nil
+}
+
+// checkRestorable refuses root qdiscs that teardown couldn't put back as
+// they were: ones with classes of their own making or with filters.
+func checkRestorable(cfg *Config, c commander, tree *tcTree) error {
+	switch tree.foreign {
+	case "hfsc", "drr", "qfq", "cbq":
+		return fmt.Errorf("Can't restore the classes of the %s root qdisc on %s afterwards, remove it first", tree.foreign, cfg.Device)
+	}
+
+	_, handle := rootQDisc(tree.qdiscs)
+	filters, err := c.executeGetLines(args(tcShowFilters, cfg.Device, handle))
+	if err == nil && len(filters) > 0 {
+		return fmt.Errorf("Can't restore the filters of the %s root qdisc on %s afterwards, remove them first", tree.foreign, cfg.Device)
+	}
+	return nil
+}
+
+// rootQDisc returns the kind and handle of the root qdisc tc lists.
+func rootQDisc(lines []string) (string, string) {
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && fields[0] == "qdisc" && fields[3] == "root" {
+			return fields[1], fields[2]
+		}
+	}
+	return "", ""
+}
+
+// comcastLeaves returns the classes below major that have comcast's netem
+// qdiscs, for the target or a link, as their leaves.
+func comcastLeaves(lines []string, major string) []string {
+	leaves := []string{}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[0] != "qdisc" || fields[1] != "netem" || fields[3] != "parent" || !strings.HasPrefix(fields[4], major) {
+			continue
+		}
+
+		minor, err := strconv.ParseUint(strings.TrimPrefix(fields[4], major), 16, 16)
+		if err != nil {
+			continue
+		}
+		handle, err := strconv.ParseUint(strings.TrimSuffix(fields[2], ":"), 16, 16)
+		if err != nil {
+			continue
+		}
+		if (minor == tcTargetMinor && handle == tcTargetHandle) || (minor >= tcLinkMinor && handle == tcLinkHandle+minor-tcLinkMinor) {
+			leaves = append(leaves, fields[4])
+		}
+	}
+	return leaves
+}
+
+// ownsQDisc is whether the qdisc is comcast's: its root qdisc or one below
+// it, or of a grafted tree one hanging off comcast's classes.
+func (tree *tcTree) ownsQDisc(handle, parent string) bool {
+	if tree.graft {
+		return contains(comcastLeaves(tree.qdiscs, tree.major), parent)
+	}
+	return handle == tree.major || strings.HasPrefix(parent, tree.major)
+}
+
+// ownsClass is whether the class is comcast's, of its own tree or grafted.
+func (tree *tcTree) ownsClass(id string) bool {
+	if tree.graft {
+		return contains(comcastLeaves(tree.qdiscs, tree.major), id)
+	}
+	return strings.HasPrefix(id, tree.major)
+}
+
+// delTree removes comcast's classes and qdiscs, along with the state file:
+// its grafted classes, or its root qdisc, restoring the one it replaced.
+func delTree(cfg *Config, c commander, tree *tcTree, state []string) error {
+	if tree.graft {
+		for _, leaf := range comcastLeaves(tree.qdiscs, tree.major) {
+			if err := c.execute(concat(args(tcDelClass), args(tcDelClassID, cfg.Device, leaf))); err != nil {
+				return err
+			}
+		}
+	} else if tree.own {
+		if err := delRootQDisc(cfg, c); err != nil {
+			return err
+		}
+		if stateMode(state) == tcStateRestore {
+			for _, cmd := range restoreCommands(cfg, state[1:]) {
+				if err := c.execute(cmd); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if state == nil {
+		return nil
+	}
+	return delState(cfg, c)
+}
+
+// restoreCommands turns qdiscs as tc lists them back into the commands that
+// add them. Qdiscs their parent adds by itself, with handle 0:, are left out,
+// and the ones the root qdisc added are replaced.
+func restoreCommands(cfg *Config, lines []string) [][]string {
+	cmds := [][]string{}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != "qdisc" || fields[1] == "ingress" || fields[1] == "clsact" {
+			continue
+		}
+
+		kind, handle := fields[1], fields[2]
+		_, parent, params := tcObject(fields[3:])
+		if parent == "root" {
+			cmds = append(cmds, concat(args(tcAddQDisc), args(tcRestoreRoot, cfg.Device, handle, kind), params))
+		} else if handle != "0:" {
+			cmds = append(cmds, concat(args(tcReplaceQDisc), args(tcRestoreChild, cfg.Device, parent, handle, kind), params))
+		}
+	}
+	return cmds
+}
+
+// readState reads what setup saved about the root qdisc it found, if any. The
+// state builds privileged commands, so only a regular file owned by whoever
+// wrote it counts.
+func readState(cfg *Config, c commander) []string {
+	dir, owner := runDir(cfg)
+	lines, err := c.executeGetLines(args(tcReadState, stateFile(dir, cfg), owner))
+	if err != nil || len(lines) == 0 {
+		return nil
+	}
+	return lines
+}
+
+func writeState(cfg *Config, c commander, state string) error {
+	dir, _ := runDir(cfg)
+	return c.executeInput(args(tcWriteState, stateFile(dir, cfg)), state)
+}
+
+func delState(cfg *Config, c commander) error {
+	dir, _ := runDir(cfg)
+	return c.execute(args(tcDelState, stateFile(dir, cfg)))
+}
+
+// stateFile keeps what setup found on the device, for teardown.
+func stateFile(dir string, cfg *Config) string {
+	return fmt.Sprintf(tcStateFile, dir, cfg.Device)
+}
+
+var runDir = func(cfg *Config) (string, int) {
+	return stateDir(os.Geteuid(), len(privilegeFor(cfg)) > 0, os.Getenv("XDG_RUNTIME_DIR"))
+}
+
+// stateDir returns where the state goes and whose it is: /run, root's, when
+// root or a privilege prefix writes it. Someone with just CAP_NET_ADMIN can't
+// write there, so theirs goes in their own runtime directory.
+func stateDir(euid int, prefixed bool, runtime string) (string, int) {
+	if euid != 0 && !prefixed && runtime != "" {
+		return runtime, euid
+	}
+	return tcRunDir, 0
+}
+
+func stateMode(state []string) string {
+	if len(state) == 0 {
+		return ""
+	}
+	return state[0]
+}
@@ -0,0 +1,266 @@
+package throttler
+
+import (
+	"strings"
+	"testing"
+)
+
+var tcForeignHTBShow = []string{
+	"qdisc htb 1: root refcnt 2 r2q 10 default 0x30 direct_packets_stat 0 direct_qlen 1000",
+	"qdisc fq_codel 8002: parent 1:30 limit 10240p flows 1024 quantum 1514 target 5ms interval 100ms",
+}
+
+// graftConfig leaves the default class alone, which isn't comcast's to limit
+// below someone else's root qdisc.
+var graftConfig = func() Config {
+	cfg := defaultTestConfig
+	cfg.DefaultBandwidth = -1
+	return cfg
+}()
+
+// tcReadEth0State reads the state saved for eth0.
+const tcReadEth0State = "find /run/comcast-eth0.tc -maxdepth 0 -type f -user 0 -exec cat {} ;"
+
+func init() {
+	runDir = func(*Config) (string, int) { return tcRunDir, 0 }
+}
+
+func TestStateDir(t *testing.T) {
+	for _, test := range []struct {
+		euid     int
+		prefixed bool
+		dir      string
+		owner    int
+	}{
+		{0, false, "/run", 0},
+		{1000, true, "/run", 0},
+		{1000, false, "/run/user/1000", 1000},
+	} {
+		if dir, owner := stateDir(test.euid, test.prefixed, "/run/user/1000"); dir != test.dir || owner != test.owner {
+			t.Errorf("Expected %s owned by %d for %+v, got %s owned by %d", test.dir, test.owner, test, dir, owner)
+		}
+	}
+	if dir, _ := stateDir(1000, false, ""); dir != "/run" {
+		t.Errorf("Expected /run without a runtime directory, got %s", dir)
+	}
+}
+
+func TestTcGraftSetup(t *testing.T) {
+	r := newCmdRecorder()
+	r.responses = map[string][]string{
+		"tc qdisc show dev eth0": tcForeignHTBShow,
+		"tc class show dev eth0": {"class htb 1:30 root leaf 8002: prio 0 rate 100Mbit ceil 100Mbit burst 1600b cburst 1600b"},
+	}
+	th := &tcThrottler{r}
+	cfg := graftConfig
+	if err := th.setup(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	r.verifyCommands(t, []string{
+		"tc qdisc show dev eth0",
+		"tc class show dev eth0",
+		`tee /run/comcast-eth0.tc <<< "graft"`,
+		"tc class add dev eth0 parent 1: classid 1:10 htb rate 1000000kbit",
+		"tc qdisc add dev eth0 parent 1:10 handle 100: netem loss 0.10%",
+		"iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 1:10 -p tcp --dport 80 -d 10.10.10.10",
+	})
+}
+
+func TestTcGraftTaken(t *testing.T) {
+	r := newCmdRecorder()
+	r.responses = map[string][]string{
+		"tc qdisc show dev eth0": tcForeignHTBShow,
+		"tc class show dev eth0": {"class htb 1:10 root prio 0 rate 100Mbit ceil 100Mbit burst 1600b cburst 1600b"},
+	}
+	cfg := graftConfig
+	err := (&tcThrottler{r}).setup(&cfg)
+	if err == nil || !strings.Contains(err.Error(), "class 1:10 is taken") {
+		t.Errorf("Expected the taken class to be reported, got %v", err)
+	}
+
+	err = (&tcThrottler{r}).setup(&defaultTestConfig)
+	if err == nil || !strings.Contains(err.Error(), "Can't limit other traffic") {
+		t.Errorf("Expected the default bandwidth to be refused, got %v", err)
+	}
+}
+
+func TestTcGraftTeardown(t *testing.T) {
+	r := newCmdRecorder()
+	r.cmdBlackList = []string{ip6Tables}
+	r.responses = map[string][]string{
+		tcReadEth0State:          {"graft"},
+		"tc qdisc show dev eth0": append(tcForeignHTBShow, "qdisc netem 100: parent 1:10 limit 1000 loss 0.1%"),
+		"iptables -S -t mangle": {
+			"-A POSTROUTING -d 10.10.10.10/32 -p tcp -m tcp --dport 80 -j CLASSIFY --set-class 0001:0010",
+			"-A POSTROUTING -d 10.0.0.9/32 -j CLASSIFY --set-class 0001:0030",
+		},
+	}
+	if err := (&tcThrottler{r}).teardown(&defaultTestConfig); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	r.verifyCommands(t, []string{
+		tcReadEth0State,
+		"tc qdisc show dev eth0",
+		"iptables -S -t mangle",
+		"iptables -t mangle -D POSTROUTING -d 10.10.10.10/32 -p tcp -m tcp --dport 80 -j CLASSIFY --set-class 0001:0010",
+		"iptables -S",
+		"tc class del dev eth0 classid 1:10",
+		"rm -f /run/comcast-eth0.tc",
+	})
+}
+
+func TestTcGraftOntoRootHandle(t *testing.T) {
+	// Someone else's HTB root with comcast's handle, grafted onto before
+	r := newCmdRecorder()
+	r.responses = map[string][]string{
+		tcReadEth0State:          {"graft"},
+		"tc qdisc show dev eth0": tcRootQDiscShow,
+	}
+	tree := currentTree(&defaultTestConfig, r, func() []string { return readState(&defaultTestConfig, r) })
+	if !tree.graft || tree.major != "10:" {
+		t.Errorf("Expected to graft onto 10:, got %+v", tree)
+	}
+
+	r.responses[tcReadEth0State] = nil
+	tree = currentTree(&defaultTestConfig, r, func() []string { return readState(&defaultTestConfig, r) })
+	if tree.graft || !tree.own {
+		t.Errorf("Expected comcast's own root qdisc, got %+v", tree)
+	}
+}
+
+func TestTcRestoreRoot(t *testing.T) {
+	fqCodel := "qdisc fq_codel 8001: root refcnt 2 limit 10240p flows 1024 quantum 1514 target 5ms interval 100ms memory_limit 32Mb ecn drop_batch 64"
+	r := newCmdRecorder()
+	r.responses = map[string][]string{"tc qdisc show dev eth0": {fqCodel}}
+	cfg := defaultTestConfig
+	cfg.TargetProtos = nil
+	cfg.TargetPorts = nil
+	if err := (&tcThrottler{r}).setup(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	r.verifyCommands(t, []string{
+		"tc qdisc show dev eth0",
+		"tc filter show dev eth0 parent 8001:",
+		`tee /run/comcast-eth0.tc <<< "restore\n` + fqCodel + `"`,
+		"tc qdisc replace dev eth0 handle 10: root htb default 1",
+		"tc class add dev eth0 parent 10: classid 10:1 htb rate 20000kbit",
+		"tc class add dev eth0 parent 10: classid 10:10 htb rate 1000000kbit",
+		"tc qdisc add dev eth0 parent 10:10 handle 100: netem loss 0.10%",
+		"iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -d 10.10.10.10",
+	})
+
+	r = newCmdRecorder()
+	r.cmdBlackList = []string{ip4Tables, ip6Tables}
+	r.responses = map[string][]string{
+		tcReadEth0State:          {"restore", fqCodel},
+		"tc qdisc show dev eth0": tcRootQDiscShow,
+	}
+	if err := (&tcThrottler{r}).teardown(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	r.verifyCommands(t, []string{
+		tcReadEth0State,
+		"tc qdisc show dev eth0",
+		"tc qdisc del dev eth0 handle 10: root",
+		"tc qdisc add dev eth0 root handle 8001: fq_codel limit 10240p flows 1024 quantum 1514 target 5ms interval 100ms memory_limit 32Mb ecn drop_batch 64",
+		"rm -f /run/comcast-eth0.tc",
+	})
+}
+
+func TestTcRestoreRefused(t *testing.T) {
+	r := newCmdRecorder()
+	r.responses = map[string][]string{"tc qdisc show dev eth0": {"qdisc hfsc 1: root refcnt 2 default 10"}}
+	if err := (&tcThrottler{r}).setup(&defaultTestConfig); err == nil {
+		t.Error("Expected an error replacing an HFSC root qdisc")
+	}
+
+	r = newCmdRecorder()
+	r.responses = map[string][]string{
+		"tc qdisc show dev eth0":            {"qdisc prio 1: root refcnt 2 bands 3 priomap 1 2 2 2 1 2 0 0 1 1 1 1 1 1 1 1"},
+		"tc filter show dev eth0 parent 1:": {"filter protocol ip pref 1 u32 chain 0"},
+	}
+	if err := (&tcThrottler{r}).setup(&defaultTestConfig); err == nil {
+		t.Error("Expected an error replacing a root qdisc with filters")
+	}
+}
+
+func TestRestoreCommands(t *testing.T) {
+	cfg := &Config{Device: "eth0"}
+	cmds := restoreCommands(cfg, []string{
+		"qdisc mq 8001: root",
+		"qdisc fq_codel 0: parent 8001:2 limit 10240p flows 1024",
+		"qdisc cake 8003: parent 8001:1 bandwidth unlimited diffserv3",
+		"qdisc ingress ffff: parent ffff:fff1 ----------------",
+	})
+	actual := []string{}
+	for _, cmd := range cmds {
+		actual = append(actual, strings.Join(cmd, " "))
+	}
+	expected := []string{
+		"tc qdisc add dev eth0 root handle 8001: mq",
+		"tc qdisc replace dev eth0 parent 8001:1 handle 8003: cake bandwidth unlimited diffserv3",
+	}
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+}
+
+func TestTcPlanGrafted(t *testing.T) {
+	cfg := graftConfig
+	live := map[string][]string{
+		tcReadEth0State:          {"graft"},
+		"tc qdisc show dev eth0": append(tcForeignHTBShow, "qdisc netem 100: parent 1:10 limit 1000 loss 0.1%"),
+		"tc class show dev eth0": {
+			"class htb 1:30 root leaf 8002: prio 0 rate 100Mbit ceil 100Mbit burst 1600b cburst 1600b",
+			"class htb 1:10 root leaf 100: prio 0 rate 1Gbit ceil 1Gbit burst 1375b cburst 1375b",
+		},
+		"iptables -S -t mangle": {
+			"-A POSTROUTING -d 10.10.10.10/32 -p tcp -m tcp --dport 80 -j CLASSIFY --set-class 0001:0010",
+			"-A POSTROUTING -d 10.0.0.9/32 -j CLASSIFY --set-class 0001:0030",
+		},
+	}
+	verifyChanges(t, planWith(t, &cfg, live), []string{})
+
+	cfg.Partition = PartitionOut
+	verifyChanges(t, planWith(t, &cfg, live), []string{
+		"- iptables -t mangle -D POSTROUTING -d 10.10.10.10/32 -p tcp -m tcp --dport 80 -j CLASSIFY --set-class 0001:0010",
+		"- tc class del dev eth0 classid 1:10",
+		"- rm -f /run/comcast-eth0.tc",
+		"+ iptables -A OUTPUT -d 10.10.10.10 -p tcp --dport 80 -m comment --comment comcast-partition -j DROP",
+	})
+}
+
+func TestTcGraftStats(t *testing.T) {
+	r := newCmdRecorder()
+	r.cmdBlackList = []string{ip6Tables}
+	r.responses = map[string][]string{
+		tcReadEth0State:          {"graft"},
+		"tc qdisc show dev eth0": append(tcForeignHTBShow, "qdisc netem 100: parent 1:10 limit 1000 loss 0.1%"),
+		"tc -s -j qdisc show dev eth0": {`[{"kind":"htb","handle":"1:","root":true,"bytes":900},` +
+			`{"kind":"fq_codel","handle":"8002:","parent":"1:30","bytes":700},` +
+			`{"kind":"netem","handle":"100:","parent":"1:10","bytes":200,"drops":3}]`},
+		"tc -s class show dev eth0": {
+			"class htb 1:30 root leaf 8002: prio 0 rate 100Mbit ceil 100Mbit burst 1600b cburst 1600b",
+			" Sent 700 bytes 7 pkt (dropped 0, overlimits 0 requeues 0)",
+			"class htb 1:10 root leaf 100: prio 0 rate 1Gbit ceil 1Gbit burst 1375b cburst 1375b",
+			" Sent 200 bytes 2 pkt (dropped 3, overlimits 0 requeues 0)",
+		},
+		"iptables -t mangle -S POSTROUTING -v": {
+			"-A POSTROUTING -d 10.10.10.10/32 -c 2 200 -j CLASSIFY --set-class 0001:0010",
+			"-A POSTROUTING -d 10.0.0.9/32 -c 7 700 -j CLASSIFY --set-class 0001:0030",
+		},
+	}
+	st, err := (&tcThrottler{r}).stats(&defaultTestConfig)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(st.Qdiscs) != 1 || st.Qdiscs[0].Handle != "100:" || st.Qdiscs[0].Drops != 3 {
+		t.Errorf("Expected only comcast's netem qdisc, got %+v", st.Qdiscs)
+	}
+	if len(st.Classes) != 1 || st.Classes[0].Class != "1:10" || st.Classes[0].Bytes != 200 {
+		t.Errorf("Expected only comcast's class, got %+v", st.Classes)
+	}
+	if len(st.Rules) != 1 || st.Rules[0].Packets != 2 {
+		t.Errorf("Expected only comcast's rule, got %+v", st.Rules)
+	}
+}
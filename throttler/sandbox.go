@@ -0,0 +1,299 @@
+package throttler
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+const (
+	cgroupRoot     = `/sys/fs/cgroup`
+	cgroupCreate   = `mkdir %s`
+	cgroupAddProc  = `tee %s/cgroup.procs`
+	cgroupRemove   = `rmdir %s`
+	netnsAdd       = `ip netns add %s`
+	netnsDel       = `ip netns del %s`
+	netnsExec      = `ip netns exec %s`
+	vethAdd        = `ip link add %s type veth peer name %s`
+	vethSetNetns   = `ip link set %s netns %s`
+	ipAddrAdd      = `ip addr add %s dev %s`
+	ipAddrShow     = `ip -o -4 addr show`
+	ipLinkUp       = `ip link set %s up`
+	ipRouteDefault = `ip route add default via %s`
+	ipForwardPath  = `/proc/sys/net/ipv4/ip_forward`
+	ipForwardSet   = `sysctl -q -w net.ipv4.ip_forward=%s`
+	iptNatAdd      = `iptables -t nat -A POSTROUTING -s %s -j MASQUERADE`
+	iptNatDel      = `iptables -t nat -D POSTROUTING -s %s -j MASQUERADE`
+	iptFwdAdd      = `iptables -I FORWARD %s %s -j ACCEPT`
+	iptFwdDel      = `iptables -D FORWARD %s %s -j ACCEPT`
+)
+
+// Cgroup is a cgroup v2 group that packet rules can be scoped to via
+// Config.TargetCgroups, so only the processes in it are impaired.
+type Cgroup struct {
+	// Path is the group's path relative to the cgroup v2 mount, as used by
+	// `iptables -m cgroup --path`.
+	Path string
+	c    commander
+}
+
+// NewCgroup returns a Cgroup at path, honouring cfg.DryRun.
+func NewCgroup(cfg *Config, path string) *Cgroup {
+	return &Cgroup{Path: path, c: newCommander(cfg)}
+}
+
+func (g *Cgroup) dir() string {
+	return cgroupRoot + "/" + strings.TrimPrefix(g.Path, "/")
+}
+
+// Create makes the group.
+func (g *Cgroup) Create() error {
+	return g.c.execute(args(cgroupCreate, g.dir()))
+}
+
+// Add moves the process pid into the group.
+func (g *Cgroup) Add(pid int) error {
+	return g.c.executeInput(args(cgroupAddProc, g.dir()), strconv.Itoa(pid))
+}
+
+// Remove deletes the group, which fails while processes remain in it.
+func (g *Cgroup) Remove() error {
+	return g.c.execute(args(cgroupRemove, g.dir()))
+}
+
+// CgroupOf returns the cgroup v2 path of process pid, relative to the cgroup
+// mount, so its traffic can be targeted with Config.TargetCgroups.
+func CgroupOf(pid int) (string, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	path, err := parseProcCgroup(f)
+	if err != nil {
+		return "", fmt.Errorf("process %d: %s", pid, err)
+	}
+	return path, nil
+}
+
+// parseProcCgroup finds the unified hierarchy entry, `0::/some/path`, in a
+// /proc/<pid>/cgroup file.
+func parseProcCgroup(r io.Reader) (string, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "0::") {
+			continue
+		}
+
+		path := strings.TrimPrefix(strings.TrimPrefix(line, "0::"), "/")
+		if path == "" {
+			return "", errors.New("in the root cgroup, which can't be targeted on its own")
+		}
+		return path, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("not in a cgroup v2 hierarchy")
+}
+
+// Netns is a network namespace connected to the host through a veth pair.
+// Packet rules set up inside it only affect the traffic of processes in the
+// namespace.
+type Netns struct {
+	Name       string
+	HostDevice string
+	Subnet     string
+	hostAddr   string
+	nsAddr     string
+	nsDevice   string
+	slot       int
+	ipForward  string
+	privilege  []string
+	c          commander
+}
+
+// NewNetns returns a Netns whose name and devices are derived from id,
+// normally the pid of the process creating it. Its /30 subnet is the first
+// one from id's on that Create finds free. It honours cfg.DryRun.
+func NewNetns(cfg *Config, id int) *Netns {
+	n := newNetns(id, newCommander(cfg))
+	n.privilege = privilegeFor(cfg)
+	return n
+}
+
+// Namespaces get a /30 each out of 10.200.0.0/16
+const netnsSlots = 16384
+
+func newNetns(id int, c commander) *Netns {
+	n := &Netns{
+		Name:       fmt.Sprintf("comcast-%d", id),
+		HostDevice: fmt.Sprintf("cc%dh", id),
+		nsDevice:   fmt.Sprintf("cc%dn", id),
+		c:          c,
+	}
+	n.useSlot(id % netnsSlots)
+	return n
+}
+
+func (n *Netns) useSlot(slot int) {
+	n.slot = slot
+	base := slot * 4
+	prefix := fmt.Sprintf("10.200.%d.", base/256)
+	n.Subnet = fmt.Sprintf("%s%d/30", prefix, base%256)
+	n.hostAddr = fmt.Sprintf("%s%d", prefix, base%256+1)
+	n.nsAddr = fmt.Sprintf("%s%d", prefix, base%256+2)
+}
+
+// pickSubnet moves the namespace to the first /30 from its own on that no
+// host address is in yet, as ids netnsSlots apart, or another run's
+// leftovers, would otherwise share one.
+func (n *Netns) pickSubnet() error {
+	lines, err := n.c.executeGetLines(args(ipAddrShow))
+	if err != nil {
+		return err
+	}
+
+	taken := map[int]bool{}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] != "inet" {
+				continue
+			}
+			var b, d, bits int
+			if _, err := fmt.Sscanf(fields[i+1], "10.200.%d.%d/%d", &b, &d, &bits); err == nil {
+				taken[(b*256+d)/4] = true
+			}
+		}
+	}
+
+	for i := 0; i < netnsSlots; i++ {
+		if slot := (n.slot + i) % netnsSlots; !taken[slot] {
+			n.useSlot(slot)
+			return nil
+		}
+	}
+	return errors.New("no free /30 left in 10.200.0.0/16 for the namespace")
+}
+
+func (n *Netns) inNetns(cmd []string) []string {
+	return concat(args(netnsExec, n.Name), cmd)
+}
+
+// Create sets up the namespace with a default route and NAT through the host.
+func (n *Netns) Create() error {
+	if b, err := ioutil.ReadFile(ipForwardPath); err == nil {
+		n.ipForward = strings.TrimSpace(string(b))
+	}
+
+	if err := n.pickSubnet(); err != nil {
+		return err
+	}
+
+	cmds := [][]string{
+		args(netnsAdd, n.Name),
+		args(vethAdd, n.HostDevice, n.nsDevice),
+		args(vethSetNetns, n.nsDevice, n.Name),
+		args(ipAddrAdd, n.hostAddr+"/30", n.HostDevice),
+		args(ipLinkUp, n.HostDevice),
+		n.inNetns(args(ipAddrAdd, n.nsAddr+"/30", n.nsDevice)),
+		n.inNetns(args(ipLinkUp, n.nsDevice)),
+		n.inNetns(args(ipLinkUp, "lo")),
+		n.inNetns(args(ipRouteDefault, n.hostAddr)),
+	}
+	if n.ipForward != "1" {
+		cmds = append(cmds, args(ipForwardSet, "1"))
+	}
+	cmds = append(cmds,
+		args(iptFwdAdd, "-i", n.HostDevice),
+		args(iptFwdAdd, "-o", n.HostDevice),
+		args(iptNatAdd, n.Subnet),
+	)
+
+	for _, cmd := range cmds {
+		if err := n.c.execute(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Command wraps argv so it runs inside the namespace as the current user,
+// switching back to them when sudo or doas got into it.
+func (n *Netns) Command(argv []string) []string {
+	cmd := concat(n.privilege, args(netnsExec, n.Name))
+	if uid := os.Getuid(); uid != 0 && len(n.privilege) > 0 {
+		switch n.privilege[0] {
+		case PrivilegeSudo:
+			cmd = append(cmd, PrivilegeSudo, "-u", "#"+strconv.Itoa(uid), "-g", "#"+strconv.Itoa(os.Getgid()), "--")
+		case PrivilegeDoas:
+			if u, err := user.Current(); err == nil {
+				cmd = append(cmd, PrivilegeDoas, "-u", u.Username, "--")
+			}
+		}
+	}
+	return append(cmd, argv...)
+}
+
+// Setup sets up the packet rules for cfg on the namespace's end of the veth
+// pair, where they shape what its processes send like they would on a device
+// and target addresses are the real destinations. Removing the namespace
+// removes them too.
+func (n *Netns) Setup(cfg *Config) error {
+	inside := *cfg
+	inside.Device = n.nsDevice
+	return setup(&tcThrottler{&nsCommander{n.c, n.Name}}, &inside)
+}
+
+// nsCommander runs commands inside a network namespace.
+type nsCommander struct {
+	c  commander
+	ns string
+}
+
+func (c *nsCommander) execute(cmd []string) error {
+	return c.c.execute(concat(args(netnsExec, c.ns), cmd))
+}
+
+func (c *nsCommander) executeGetLines(cmd []string) ([]string, error) {
+	return c.c.executeGetLines(concat(args(netnsExec, c.ns), cmd))
+}
+
+func (c *nsCommander) executeInput(cmd []string, input string) error {
+	return c.c.executeInput(concat(args(netnsExec, c.ns), cmd), input)
+}
+
+func (c *nsCommander) commandExists(cmd string) bool {
+	return c.c.commandExists(cmd)
+}
+
+// Remove deletes the namespace, its veth pair and the host's NAT rules,
+// carrying on past failures so as much as possible is cleaned up.
+func (n *Netns) Remove() error {
+	cmds := [][]string{
+		args(iptNatDel, n.Subnet),
+		args(iptFwdDel, "-o", n.HostDevice),
+		args(iptFwdDel, "-i", n.HostDevice),
+		args(netnsDel, n.Name),
+	}
+	if n.ipForward == "0" {
+		cmds = append(cmds, args(ipForwardSet, "0"))
+	}
+
+	var firstErr error
+	for _, cmd := range cmds {
+		if err := n.c.execute(cmd); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
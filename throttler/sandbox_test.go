@@ -0,0 +1,125 @@
+package throttler
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCgroupLifecycle(t *testing.T) {
+	r := newCmdRecorder()
+	g := &Cgroup{Path: "comcast-42", c: r}
+	g.Create()
+	g.Add(4242)
+	g.Remove()
+	r.verifyCommands(t, []string{
+		"mkdir /sys/fs/cgroup/comcast-42",
+		`tee /sys/fs/cgroup/comcast-42/cgroup.procs <<< "4242"`,
+		"rmdir /sys/fs/cgroup/comcast-42",
+	})
+}
+
+func TestNetnsLifecycle(t *testing.T) {
+	r := newCmdRecorder()
+	n := newNetns(300, r)
+	n.ipForward = "1"
+
+	if n.HostDevice != "cc300h" || n.Subnet != "10.200.4.176/30" {
+		t.Fatalf("Unexpected device %s and subnet %s", n.HostDevice, n.Subnet)
+	}
+
+	n.Remove()
+	r.verifyCommands(t, []string{
+		"iptables -t nat -D POSTROUTING -s 10.200.4.176/30 -j MASQUERADE",
+		"iptables -D FORWARD -o cc300h -j ACCEPT",
+		"iptables -D FORWARD -i cc300h -j ACCEPT",
+		"ip netns del comcast-300",
+	})
+}
+
+func TestNetnsSkipsTakenSubnet(t *testing.T) {
+	r := newCmdRecorder()
+	r.responses["ip -o -4 addr show"] = []string{
+		"1: lo    inet 127.0.0.1/8 scope host lo\\       valid_lft forever preferred_lft forever",
+		"9: cc16684h    inet 10.200.4.177/30 scope global cc16684h\\       valid_lft forever preferred_lft forever",
+		"11: cc301h    inet 10.200.4.181/30 scope global cc301h\\       valid_lft forever preferred_lft forever",
+	}
+	n := newNetns(300, r)
+	n.pickSubnet()
+
+	if n.Subnet != "10.200.4.184/30" || n.hostAddr != "10.200.4.185" || n.nsAddr != "10.200.4.186" {
+		t.Fatalf("Expected the next free subnet, got %s (%s, %s)", n.Subnet, n.hostAddr, n.nsAddr)
+	}
+}
+
+func TestNetnsSubnetWrapsAround(t *testing.T) {
+	r := newCmdRecorder()
+	r.responses["ip -o -4 addr show"] = []string{
+		"9: cc16383h    inet 10.200.255.253/30 scope global cc16383h",
+	}
+	n := newNetns(16383, r)
+	n.pickSubnet()
+
+	if n.Subnet != "10.200.0.0/30" {
+		t.Fatalf("Expected the first subnet, got %s", n.Subnet)
+	}
+}
+
+func TestNetnsSetup(t *testing.T) {
+	r := newCmdRecorder()
+	n := newNetns(300, r)
+	cfg := defaultTestConfig
+	cfg.DefaultBandwidth = -1
+	cfg.TargetProtos = []string{"tcp"}
+	if err := n.Setup(&cfg); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	r.verifyCommands(t, []string{
+		"ip netns exec comcast-300 tc qdisc show",
+		"ip netns exec comcast-300 iptables -S",
+		"ip netns exec comcast-300 ip6tables -S",
+		"ip netns exec comcast-300 tc qdisc show dev cc300n",
+		"ip netns exec comcast-300 tc qdisc add dev cc300n handle 10: root htb default 1",
+		"ip netns exec comcast-300 tc class add dev cc300n parent 10: classid 10:1 htb rate 1000000kbit",
+		"ip netns exec comcast-300 tc class add dev cc300n parent 10: classid 10:10 htb rate 1000000kbit",
+		"ip netns exec comcast-300 tc qdisc add dev cc300n parent 10:10 handle 100: netem loss 0.10%",
+		"ip netns exec comcast-300 iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p tcp --dport 80 -d 10.10.10.10",
+	})
+	if cfg.Device != "eth0" {
+		t.Errorf("Expected the config's device to be left alone, got %s", cfg.Device)
+	}
+}
+
+func TestTcCgroupSetup(t *testing.T) {
+	r := newCmdRecorder()
+	th := &tcThrottler{r}
+	cfg := defaultTestConfig
+	cfg.TargetIps = []string{}
+	cfg.TargetPorts = []string{}
+	cfg.TargetProtos = []string{"tcp"}
+	cfg.PacketLoss = -1
+	cfg.TargetCgroups = []string{"comcast-42"}
+	th.setup(&cfg)
+	r.verifyCommands(t, []string{
+		"tc qdisc show dev eth0",
+		"tc qdisc add dev eth0 handle 10: root htb default 1",
+		"tc class add dev eth0 parent 10: classid 10:1 htb rate 20000kbit",
+		"tc class add dev eth0 parent 10: classid 10:10 htb rate 1000000kbit",
+		"tc qdisc add dev eth0 parent 10:10 handle 100: netem",
+		"iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p tcp -m cgroup --path comcast-42",
+		"ip6tables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p tcp -m cgroup --path comcast-42",
+	})
+}
+
+func TestParseProcCgroup(t *testing.T) {
+	path, err := parseProcCgroup(strings.NewReader("1:name=systemd:/\n0::/system.slice/nginx.service\n"))
+	if err != nil || path != "system.slice/nginx.service" {
+		t.Fatalf("Expected system.slice/nginx.service, got %q (%v)", path, err)
+	}
+
+	if _, err := parseProcCgroup(strings.NewReader("0::/\n")); err == nil {
+		t.Fatal("Expected an error for the root cgroup")
+	}
+	if _, err := parseProcCgroup(strings.NewReader("4:memory:/foo\n")); err == nil {
+		t.Fatal("Expected an error without a cgroup v2 entry")
+	}
+}
@@ -0,0 +1,245 @@
+package throttler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Server exposes packet rule setup and teardown over a small JSON HTTP API so
+// that other processes can drive comcast without shelling out to it:
+//
+//	GET    /status  report whether rules are applied and with what config
+//	POST   /config  apply a config
+//	PUT    /config  replace the applied config (or apply one if idle)
+//	DELETE /config  tear the applied config down
+//	GET    /metrics Prometheus metrics for the applied config
+//
+// Requests are serialized, so at most one setup or teardown runs at a time.
+type Server struct {
+	mu      sync.Mutex
+	cfg     *Config
+	backend func(*Config) (throttler, error)
+}
+
+// Status describes the state of a Server.
+type Status struct {
+	Active bool    `json:"active"`
+	Config *Config `json:"config,omitempty"`
+	Check  string  `json:"check,omitempty"`
+}
+
+type errorResponse struct {
+	Error    string `json:"error"`
+	Command  string `json:"command,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+	Stdout   string `json:"stdout,omitempty"`
+	Stderr   string `json:"stderr,omitempty"`
+}
+
+// newErrorResponse describes err, with the details of the system command
+// that failed if that's what it was.
+func newErrorResponse(err error) errorResponse {
+	resp := errorResponse{Error: err.Error()}
+	var cerr *CommandError
+	if errors.As(err, &cerr) {
+		resp.Command = cerr.Command
+		resp.ExitCode = &cerr.ExitCode
+		resp.Stdout = cerr.Stdout
+		resp.Stderr = cerr.Stderr
+	}
+	return resp
+}
+
+// NewServer returns a Server that applies configs with the backend for the
+// running OS.
+func NewServer() *Server {
+	return &Server{
+		backend: func(cfg *Config) (throttler, error) {
+			return newThrottler(cfg, newCommander(cfg))
+		},
+	}
+}
+
+// DefaultConfig returns a Config with the same defaults as the command line,
+// i.e. no latency, bandwidth limits or targets beyond tcp, udp and icmp.
+func DefaultConfig() Config {
+	return Config{
+		Latency:          -1,
+		TargetBandwidth:  -1,
+		DefaultBandwidth: -1,
+		TargetProtos:     []string{"tcp", "udp", "icmp"},
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/status":
+		if r.Method != http.MethodGet {
+			s.methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		s.respond(w, http.StatusOK, s.Status())
+	case "/config":
+		s.serveConfig(w, r)
+	case "/metrics":
+		s.serveMetrics(w)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveConfig(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	switch r.Method {
+	case http.MethodPost, http.MethodPut:
+		cfg := DefaultConfig()
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			s.respond(w, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("invalid config: %s", err)})
+			return
+		}
+		if r.Method == http.MethodPost {
+			err = s.Apply(&cfg)
+		} else {
+			err = s.Update(&cfg)
+		}
+	case http.MethodDelete:
+		err = s.Close()
+	default:
+		s.methodNotAllowed(w, http.MethodPost, http.MethodPut, http.MethodDelete)
+		return
+	}
+
+	switch err {
+	case nil:
+		s.respond(w, http.StatusOK, s.Status())
+	case ErrAlreadySetup, ErrNotSetup:
+		s.respond(w, http.StatusConflict, newErrorResponse(err))
+	default:
+		s.respond(w, http.StatusInternalServerError, newErrorResponse(err))
+	}
+}
+
+func (s *Server) serveMetrics(w http.ResponseWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var t throttler
+	if s.cfg != nil {
+		var err error
+		if t, err = s.backend(s.cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := writeMetrics(&buf, t, s.cfg); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", metricsContentType)
+	buf.WriteTo(w)
+}
+
+func (s *Server) methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	for _, m := range allowed {
+		w.Header().Add("Allow", m)
+	}
+	s.respond(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+}
+
+func (s *Server) respond(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
+
+// Status reports the config currently applied by the server, if any.
+func (s *Server) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cfg == nil {
+		return Status{}
+	}
+
+	st := Status{Active: true, Config: s.cfg}
+	if t, err := s.backend(s.cfg); err == nil {
+		st.Check = checkCommand(t, s.cfg)
+	}
+	return st
+}
+
+// Apply sets up cfg, returning ErrAlreadySetup if a config is already
+// applied.
+func (s *Server) Apply(cfg *Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cfg != nil {
+		return ErrAlreadySetup
+	}
+	return s.apply(cfg)
+}
+
+// Update replaces the applied config with cfg, tearing the old one down
+// first.
+func (s *Server) Update(cfg *Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cfg != nil {
+		if err := s.teardown(); err != nil {
+			return err
+		}
+	}
+	return s.apply(cfg)
+}
+
+// Close tears down the applied config, returning ErrNotSetup if there is
+// none. Daemons should call it on exit.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cfg == nil {
+		return ErrNotSetup
+	}
+	return s.teardown()
+}
+
+func (s *Server) apply(cfg *Config) error {
+	t, err := s.backend(cfg)
+	if err != nil {
+		return err
+	}
+
+	if err := setup(t, cfg); err != nil {
+		// Don't leave behind what a setup failing partway got to, but rules
+		// that were there already aren't ours to remove
+		if err != ErrAlreadySetup {
+			teardown(t, cfg)
+		}
+		return err
+	}
+	s.cfg = cfg
+	return nil
+}
+
+func (s *Server) teardown() error {
+	t, err := s.backend(s.cfg)
+	if err != nil {
+		return err
+	}
+
+	if err := teardown(t, s.cfg); err != nil {
+		return err
+	}
+	s.cfg = nil
+	return nil
+}
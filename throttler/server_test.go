@@ -0,0 +1,196 @@
+package throttler
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type fakeThrottler struct {
+	active    bool
+	setups    int
+	teardowns int
+	setupErr  error
+}
+
+func (f *fakeThrottler) setup(*Config) error {
+	if f.setupErr != nil {
+		// Like a setup failing partway, it leaves some rules behind
+		f.active = true
+		return f.setupErr
+	}
+	f.active = true
+	f.setups++
+	return nil
+}
+
+func (f *fakeThrottler) teardown(*Config) error {
+	f.active = false
+	f.teardowns++
+	return nil
+}
+
+func (f *fakeThrottler) exists() bool {
+	return f.active
+}
+
+func (f *fakeThrottler) check() []string {
+	return []string{"fake", "check"}
+}
+
+func newTestServer() (*Server, *fakeThrottler) {
+	f := &fakeThrottler{}
+	s := &Server{backend: func(*Config) (throttler, error) { return f, nil }}
+	return s, f
+}
+
+func doRequest(t *testing.T, s *Server, method, path, body string) (int, Status) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+
+	var st Status
+	if rec.Code == http.StatusOK {
+		if err := json.NewDecoder(rec.Body).Decode(&st); err != nil {
+			t.Fatalf("Could not decode response: %s", err)
+		}
+	}
+	return rec.Code, st
+}
+
+func TestServerApplyAndTeardown(t *testing.T) {
+	s, f := newTestServer()
+
+	code, st := doRequest(t, s, http.MethodPost, "/config", `{"device":"eth1","latency":250,"privilege":"none"}`)
+	if code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if !st.Active || st.Config.Device != "eth1" || st.Config.Latency != 250 {
+		t.Fatalf("Unexpected status after apply: %+v", st)
+	}
+	if st.Config.TargetBandwidth != -1 || len(st.Config.TargetProtos) != 3 {
+		t.Fatalf("Expected unset fields to take command line defaults, got %+v", st.Config)
+	}
+	if st.Check != "fake check" {
+		t.Fatalf("Expected check command in status, got %q", st.Check)
+	}
+
+	if code, _ := doRequest(t, s, http.MethodPost, "/config", `{"device":"eth1"}`); code != http.StatusConflict {
+		t.Fatalf("Expected status 409 when applying twice, got %d", code)
+	}
+
+	code, st = doRequest(t, s, http.MethodDelete, "/config", "")
+	if code != http.StatusOK || st.Active {
+		t.Fatalf("Expected inactive status after teardown, got %d %+v", code, st)
+	}
+	if f.setups != 1 || f.teardowns != 1 {
+		t.Fatalf("Expected 1 setup and 1 teardown, got %d and %d", f.setups, f.teardowns)
+	}
+
+	if code, _ := doRequest(t, s, http.MethodDelete, "/config", ""); code != http.StatusConflict {
+		t.Fatalf("Expected status 409 when tearing down twice, got %d", code)
+	}
+}
+
+func TestServerIgnoresPrivilege(t *testing.T) {
+	s, _ := newTestServer()
+	var privilege string
+	s.backend = func(cfg *Config) (throttler, error) {
+		privilege = cfg.Privilege
+		return &fakeThrottler{}, nil
+	}
+
+	if code, _ := doRequest(t, s, http.MethodPost, "/config", `{"device":"eth1","privilege":"/tmp/payload"}`); code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	if privilege != "" || s.cfg.Privilege != "" {
+		t.Errorf("Expected the privilege from the request to be ignored, got %q", privilege)
+	}
+}
+
+func TestServerUpdate(t *testing.T) {
+	s, f := newTestServer()
+
+	if code, _ := doRequest(t, s, http.MethodPut, "/config", `{"device":"eth0"}`); code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", code)
+	}
+	code, st := doRequest(t, s, http.MethodPut, "/config", `{"device":"eth0","packet_loss":10}`)
+	if code != http.StatusOK || st.Config.PacketLoss != 10 {
+		t.Fatalf("Unexpected status after update: %d %+v", code, st)
+	}
+	if f.setups != 2 || f.teardowns != 1 {
+		t.Fatalf("Expected 2 setups and 1 teardown, got %d and %d", f.setups, f.teardowns)
+	}
+}
+
+func TestServerBadRequests(t *testing.T) {
+	s, _ := newTestServer()
+
+	if code, _ := doRequest(t, s, http.MethodPost, "/config", `{"latency":"high"}`); code != http.StatusBadRequest {
+		t.Fatalf("Expected status 400 for an invalid config, got %d", code)
+	}
+	if code, _ := doRequest(t, s, http.MethodPost, "/status", ""); code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected status 405, got %d", code)
+	}
+	if code, _ := doRequest(t, s, http.MethodGet, "/nope", ""); code != http.StatusNotFound {
+		t.Fatalf("Expected status 404, got %d", code)
+	}
+}
+
+func TestServerTearsDownFailedSetup(t *testing.T) {
+	s, f := newTestServer()
+	f.setupErr = errors.New("exit status 2")
+
+	if err := s.Apply(&Config{}); err == nil {
+		t.Fatal("Expected the setup error")
+	}
+	if f.active || f.teardowns != 1 {
+		t.Errorf("Expected the partial rules torn down, got active %v after %d teardowns", f.active, f.teardowns)
+	}
+	if code, st := doRequest(t, s, http.MethodGet, "/status", ""); code != http.StatusOK || st.Active {
+		t.Errorf("Expected nothing applied, got %d %+v", code, st)
+	}
+}
+
+func TestServerLeavesExistingRules(t *testing.T) {
+	s, f := newTestServer()
+	f.active = true
+
+	if err := s.Apply(&Config{}); err != ErrAlreadySetup {
+		t.Fatalf("Expected ErrAlreadySetup, got %v", err)
+	}
+	if !f.active || f.teardowns != 0 {
+		t.Error("Expected the existing rules left alone")
+	}
+}
+
+func TestServerCommandError(t *testing.T) {
+	s, f := newTestServer()
+	f.setupErr = &CommandError{
+		Command:  "tc qdisc add dev eth0 handle 10: root htb default 1",
+		ExitCode: 2,
+		Stderr:   "RTNETLINK answers: File exists\n",
+		Err:      errors.New("exit status 2"),
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/config", strings.NewReader(`{}`))
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected status 500, got %d", rec.Code)
+	}
+
+	var resp errorResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatalf("Could not decode response: %s", err)
+	}
+	if resp.Command != "tc qdisc add dev eth0 handle 10: root htb default 1" || resp.ExitCode == nil || *resp.ExitCode != 2 || resp.Stderr != "RTNETLINK answers: File exists\n" {
+		t.Errorf("Expected the command's details, got %+v", resp)
+	}
+	if resp.Error != "`tc qdisc add dev eth0 handle 10: root htb default 1` failed: exit status 2: RTNETLINK answers: File exists" {
+		t.Errorf("Unexpected error message %q", resp.Error)
+	}
+}
@@ -1,39 +1,88 @@
 package throttler
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
-	"syscall"
+	"time"
 )
 
 const (
 	tcRootQDisc    = `dev %s handle 10: root`
 	tcRootExtra    = `default 1`
 	tcDefaultClass = `dev %s parent 10: classid 10:1`
-	tcTargetClass  = `dev %s parent 10: classid 10:10`
-	tcNetemRule    = `dev %s parent 10:10 handle 100:`
+	tcTargetClass  = `dev %s parent %s classid %s10`
+	tcNetemRule    = `dev %s parent %s10 handle 100:`
+	tcLinkClass    = `dev %s parent %s classid %s%x`
+	tcLinkNetem    = `dev %s parent %s%x handle %x:`
+	tcTargetMinor  = 0x10
+	tcTargetHandle = 0x100
+	tcLinkMinor    = 0x11
+	tcLinkHandle   = 0x101
+	tcTargetID     = `%s10`
 	tcRate         = `rate %vkbit`
 	tcDelay        = `delay %vms`
+	tcJitter       = `%vms`
 	tcLoss         = `loss %v%%`
-	tcAddClass     = `sudo tc class add`
-	tcDelClass     = `sudo tc class del`
-	tcAddQDisc     = `sudo tc qdisc add`
-	tcDelQDisc     = `sudo tc qdisc del`
-	iptAddTarget   = `sudo %s -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10`
-	iptDelTarget   = `sudo %s -D POSTROUTING -t mangle -j CLASSIFY --set-class 10:10`
+	tcAddClass     = `tc class add`
+	tcDelClass     = `tc class del`
+	tcAddQDisc     = `tc qdisc add`
+	tcChangeClass  = `tc class change`
+	tcChangeQDisc  = `tc qdisc change`
+	tcDelQDisc     = `tc qdisc del`
+	tcReplaceQDisc = `tc qdisc replace`
+	tcRestoreRoot  = `dev %s root handle %s %s`
+	tcRestoreChild = `dev %s parent %s handle %s %s`
+	tcShowFilters  = `tc filter show dev %s parent %s`
+	tcRunDir       = `/run`
+	tcStateFile    = `%s/comcast-%s.tc`
+	tcReadState    = `find %s -maxdepth 0 -type f -user %d -exec cat {} ;`
+	tcWriteState   = `tee %s`
+	tcDelState     = `rm -f %s`
+	tcStateGraft   = `graft`
+	tcStateRestore = `restore`
+	iptAddTarget   = `%s -A POSTROUTING -t mangle -j CLASSIFY --set-class %s`
 	iptDestIP      = `-d %s`
 	iptProto       = `-p %s`
 	iptDestPorts   = `--match multiport --dports %s`
 	iptDestPort    = `--dport %s`
-	iptDelSearch   = `class 0010:0010`
-	iptList        = `sudo %s -S -t mangle`
+	iptCgroup      = `-m cgroup --path %s`
+	iptUidOwner    = `-m owner --uid-owner %s`
+	iptGidOwner    = `-m owner --gid-owner %s`
+	iptDelSearch   = `--set-class 0010:`
+	iptClassSearch = `--set-class %04x:%04x`
+	iptList        = `%s -S -t mangle`
 	ip4Tables      = `iptables`
 	ip6Tables      = `ip6tables`
-	iptDel         = `sudo %s -t mangle -D`
-	tcExists       = `sudo tc qdisc show | grep "netem"`
-	tcCheck        = `sudo tc -s qdisc`
+	iptDel         = `%s -t mangle -D`
+	tcExists       = `tc qdisc show`
+	tcExistsSearch = `netem`
+	tcCheck        = `tc -s qdisc`
+	tcQDiscStats   = `tc -s -j qdisc show dev %s`
+	tcClassStats   = `tc -s class show dev %s`
+	iptStats       = `%s -t mangle -S POSTROUTING -v`
+	tcRootHandle   = `10:`
+	tcShowQDisc    = `tc qdisc show dev %s`
+	tcShowClass    = `tc class show dev %s`
+	tcDelChild     = `dev %s parent %s handle %s`
+	tcDelClassID   = `dev %s classid %s`
+	iptBlockOut    = `%s -A OUTPUT -d %s`
+	iptBlockIn     = `%s -A INPUT -s %s`
+	iptSrcPorts    = `--match multiport --sports %s`
+	iptSrcPort     = `--sport %s`
+	iptBlockTag    = `-m comment --comment comcast-partition`
+	iptBlockSearch = `--comment comcast-partition`
+	iptDrop        = `-j DROP`
+	iptReject      = `-j REJECT`
+	iptRejectTCP   = `--reject-with tcp-reset`
+	iptBlockList   = `%s -S`
+	iptBlockDel    = `%s -D`
+	iptMatchSet    = `-m set --match-set %s dst`
+	iptMultiport   = 15 //Ports a multiport match takes, counting ranges twice
+	iptBatchMin    = 16 //Rules that go through iptables-restore rather than one by one
 )
 
 type tcThrottler struct {
@@ -41,166 +90,252 @@ type tcThrottler struct {
 }
 
 func (t *tcThrottler) setup(cfg *Config) error {
-	err := addRootQDisc(cfg, t.c) //The root node to append the filters
+	if cfg.Partition != "" {
+		return addPartitionRules(cfg, t.c) //Blackholing needs no shaping at all
+	}
+
+	tree := currentTree(cfg, t.c, func() []string { return readState(cfg, t.c) })
+	err := tree.prepare(cfg, t.c) //The root node to append the filters, unless there's one to graft onto
 	if err != nil {
 		return err
 	}
 
-	err = addDefaultClass(cfg, t.c) //The default class for all traffic that isn't classified
+	if len(cfg.Links) > 0 {
+		return addLinks(cfg, t.c, tree.major) //One class and network emulator rule per destination
+	}
+
+	err = addTargetClass(cfg, t.c, tcAddClass, tree.major) //The class that the network emulator rule is assigned
 	if err != nil {
 		return err
 	}
 
-	err = addTargetClass(cfg, t.c) //The class that the network emulator rule is assigned
+	err = addNetemRule(cfg, t.c, tcAddQDisc, tree.major) //The network emulator rule that contains the desired behavior
 	if err != nil {
 		return err
 	}
 
-	err = addNetemRule(cfg, t.c) //The network emulator rule that contains the desired behavior
-	if err != nil {
+	return addIptablesRules(cfg, t.c, tree.major) //The network emulator rule that contains the desired behavior
+}
+
+// change updates the shaping of the target class, or of each link, in place,
+// leaving the rules that classify traffic into them alone.
+func (t *tcThrottler) change(cfg *Config) error {
+	major := currentTree(cfg, t.c, func() []string { return readState(cfg, t.c) }).major
+	if len(cfg.Links) > 0 {
+		for i, link := range cfg.Links {
+			if err := addLinkRules(cfg, t.c, i, link, tcChangeClass, tcChangeQDisc, major); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := addTargetClass(cfg, t.c, tcChangeClass, major); err != nil {
 		return err
 	}
 
-	return addIptablesRules(cfg, t.c) //The network emulator rule that contains the desired behavior
+	return addNetemRule(cfg, t.c, tcChangeQDisc, major)
 }
 
-func addRootQDisc(cfg *Config, c commander) error {
+func addRootQDisc(cfg *Config, c commander, op string) error {
 	//Add the root QDisc
-	root := fmt.Sprintf(tcRootQDisc, cfg.Device)
-	strs := []string{tcAddQDisc, root, "htb", tcRootExtra}
-	cmd := strings.Join(strs, " ")
+	root := args(tcRootQDisc, cfg.Device)
+	cmd := concat(args(op), root, []string{"htb"}, args(tcRootExtra))
 
 	return c.execute(cmd)
 }
 
 func addDefaultClass(cfg *Config, c commander) error {
 	//Add the default Class
-	def := fmt.Sprintf(tcDefaultClass, cfg.Device)
-	rate := ""
+	def := args(tcDefaultClass, cfg.Device)
+	rate := []string{}
 
 	if cfg.DefaultBandwidth > 0 {
-		rate = fmt.Sprintf(tcRate, cfg.DefaultBandwidth)
+		rate = args(tcRate, cfg.DefaultBandwidth)
 	} else {
-		rate = fmt.Sprintf(tcRate, 1000000)
+		rate = args(tcRate, 1000000)
 	}
 
-	strs := []string{tcAddClass, def, "htb", rate}
-	cmd := strings.Join(strs, " ")
+	cmd := concat(args(tcAddClass), def, []string{"htb"}, rate)
 
 	return c.execute(cmd)
 }
 
-func addTargetClass(cfg *Config, c commander) error {
+func addTargetClass(cfg *Config, c commander, op, major string) error {
 	//Add the target Class
-	tar := fmt.Sprintf(tcTargetClass, cfg.Device)
-	rate := ""
+	tar := args(tcTargetClass, cfg.Device, major, major)
+	rate := []string{}
 
 	if cfg.TargetBandwidth > -1 {
-		rate = fmt.Sprintf(tcRate, cfg.TargetBandwidth)
+		rate = args(tcRate, cfg.TargetBandwidth)
 	} else {
-		rate = fmt.Sprintf(tcRate, 1000000)
+		rate = args(tcRate, 1000000)
 	}
 
-	strs := []string{tcAddClass, tar, "htb", rate}
-	cmd := strings.Join(strs, " ")
+	cmd := concat(args(op), tar, []string{"htb"}, rate)
 
 	return c.execute(cmd)
 }
 
-func addNetemRule(cfg *Config, c commander) error {
+func addNetemRule(cfg *Config, c commander, op, major string) error {
 	//Add the Network Emulator rule
-	net := fmt.Sprintf(tcNetemRule, cfg.Device)
-	strs := []string{tcAddQDisc, net, "netem"}
+	net := args(tcNetemRule, cfg.Device, major)
+	cmd := concat(args(op), net, []string{"netem"})
 
 	if cfg.Latency > 0 {
-		strs = append(strs, fmt.Sprintf(tcDelay, cfg.Latency))
+		cmd = append(cmd, args(tcDelay, cfg.Latency)...)
 	}
 
 	if cfg.TargetBandwidth > -1 {
-		strs = append(strs, fmt.Sprintf(tcRate, cfg.TargetBandwidth))
+		cmd = append(cmd, args(tcRate, cfg.TargetBandwidth)...)
 	}
 
 	if cfg.PacketLoss > 0 {
-		strs = append(strs, fmt.Sprintf(tcLoss, strconv.FormatFloat(cfg.PacketLoss, 'f', 2, 64)))
+		cmd = append(cmd, args(tcLoss, strconv.FormatFloat(cfg.PacketLoss, 'f', 2, 64))...)
 	}
 
-	cmd := strings.Join(strs, " ")
-
 	return c.execute(cmd)
 }
 
-func addIptablesRules(cfg *Config, c commander) error {
+func addIptablesRules(cfg *Config, c commander, major string) error {
+	tcTargetID := args(tcTargetID, major)[0]
 	var err error
 	if len(cfg.TargetIps) == 0 && len(cfg.TargetIps6) == 0 {
 		if err == nil {
-			err = addIptablesRulesForAddrs(cfg, c, ip4Tables, cfg.TargetIps)
+			err = addIptablesRulesForAddrs(cfg, c, ip4Tables, tcTargetID, cfg.TargetIps)
 		}
 		if err == nil {
-			err = addIptablesRulesForAddrs(cfg, c, ip6Tables, cfg.TargetIps6)
+			err = addIptablesRulesForAddrs(cfg, c, ip6Tables, tcTargetID, cfg.TargetIps6)
 		}
 		return err
 	}
 	if err == nil && len(cfg.TargetIps) > 0 {
-		err = addIptablesRulesForAddrs(cfg, c, ip4Tables, cfg.TargetIps)
+		err = addIptablesRulesForAddrs(cfg, c, ip4Tables, tcTargetID, cfg.TargetIps)
 	}
 	if err == nil && len(cfg.TargetIps6) > 0 {
-		err = addIptablesRulesForAddrs(cfg, c, ip6Tables, cfg.TargetIps6)
+		err = addIptablesRulesForAddrs(cfg, c, ip6Tables, tcTargetID, cfg.TargetIps6)
 	}
 	return err
 }
 
-func addIptablesRulesForAddrs(cfg *Config, c commander, command string, addrs []string) error {
-	rules := []string{}
-	ports := ""
-
-	if len(cfg.TargetPorts) > 0 {
-		if len(cfg.TargetPorts) > 1 {
-			prts := strings.Join(cfg.TargetPorts, ",")
-			ports = fmt.Sprintf(iptDestPorts, prts)
-		} else {
-			ports = fmt.Sprintf(iptDestPort, cfg.TargetPorts[0])
-		}
-	}
+func addIptablesRulesForAddrs(cfg *Config, c commander, command string, class string, addrs []string) error {
+	rules := [][]string{}
+	ports := portMatches(cfg.TargetPorts, iptDestPorts, iptDestPort)
 
-	addTargetCmd := fmt.Sprintf(iptAddTarget, command)
+	addTargetCmd := args(iptAddTarget, command, class)
 
 	if len(cfg.TargetProtos) > 0 {
 		for _, ptc := range cfg.TargetProtos {
-			proto := fmt.Sprintf(iptProto, ptc)
-			rule := addTargetCmd + " " + proto
+			rule := concat(addTargetCmd, args(iptProto, ptc))
 
-			if ptc != "icmp" {
-				if ports != "" {
-					rule += " " + ports
-				}
+			if ptc == "icmp" {
+				rules = append(rules, rule)
+				continue
+			}
+			for _, prts := range ports {
+				rules = append(rules, concat(rule, prts))
 			}
-
-			rules = append(rules, rule)
 		}
 	} else {
-		rules = []string{addTargetCmd}
+		rules = [][]string{addTargetCmd}
+	}
+
+	if owners := ownerMatches(cfg); len(owners) > 0 {
+		ownerRules := [][]string{}
+		for _, rule := range rules {
+			for _, owner := range owners {
+				ownerRules = append(ownerRules, concat(rule, owner))
+			}
+		}
+		rules = ownerRules
 	}
 
 	if len(addrs) > 0 {
-		iprules := []string{}
-		for _, ip := range addrs {
-			dest := fmt.Sprintf(iptDestIP, ip)
-			if len(rules) > 0 {
-				for _, rule := range rules {
-					r := rule + " " + dest
-					iprules = append(iprules, r)
-				}
-			} else {
-				iprules = append(iprules, dest)
+		dests := [][]string{}
+		if set := targetSet(c, command, addrs); set != "" {
+			//One rule matching the set instead of one for each address
+			if err := addTargetSet(c, set, addrs); err != nil {
+				return err
 			}
+			dests = append(dests, args(iptMatchSet, set))
+		} else {
+			for _, ip := range addrs {
+				dests = append(dests, args(iptDestIP, ip))
+			}
+		}
+
+		iprules := [][]string{}
+		for _, dest := range dests {
+			for _, rule := range rules {
+				iprules = append(iprules, concat(rule, dest))
+			}
+		}
+		rules = iprules
+	}
+
+	return executeRules(c, command, rules)
+}
+
+// portMatches returns the port match for ports, or a multiport match for each
+// run of ports that fits into one. Without ports it's a single empty match.
+func portMatches(ports []string, multi, single string) [][]string {
+	if len(ports) == 0 {
+		return [][]string{nil}
+	}
+	if len(ports) == 1 {
+		return [][]string{args(single, ports[0])}
+	}
+
+	matches := [][]string{}
+	run, count := []string{}, 0
+	for _, port := range ports {
+		n := 1
+		if strings.Contains(port, ":") {
+			n = 2
 		}
-		if len(iprules) > 0 {
-			rules = iprules
+		if count+n > iptMultiport {
+			matches = append(matches, args(multi, strings.Join(run, ",")))
+			run, count = []string{}, 0
 		}
+		run, count = append(run, port), count+n
 	}
+	return append(matches, args(multi, strings.Join(run, ",")))
+}
 
+// executeRules adds the rules of one iptables tool, through a single
+// iptables-restore once there are many.
+func executeRules(c commander, tool string, rules [][]string) error {
+	if len(rules) < iptBatchMin {
+		for _, rule := range rules {
+			if err := c.execute(rule); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	run := []command{}
 	for _, rule := range rules {
-		if err := c.execute(rule); err != nil {
+		run = append(run, command{argv: rule})
+	}
+	restore := iptablesRestore(tool, run)
+	return c.executeInput(restore.argv, restore.input)
+}
+
+func addLinks(cfg *Config, c commander, major string) error {
+	for i, link := range cfg.Links {
+		minor := tcLinkMinor + i
+
+		if err := addLinkRules(cfg, c, i, link, tcAddClass, tcAddQDisc, major); err != nil {
+			return err
+		}
+
+		//Classify traffic to the destination into it
+		command := ip4Tables
+		if !isIPv4(link.Dest) {
+			command = ip6Tables
+		}
+		if err := addIptablesRulesForAddrs(cfg, c, command, fmt.Sprintf("%s%x", major, minor), []string{link.Dest}); err != nil {
 			return err
 		}
 	}
@@ -208,64 +343,305 @@ func addIptablesRulesForAddrs(cfg *Config, c commander, command string, addrs []
 	return nil
 }
 
-func (t *tcThrottler) teardown(cfg *Config) error {
-	if err := delIptablesRules(cfg, t.c); err != nil {
+// addLinkRules adds, or changes with the tc change verbs, the Class and
+// Network Emulator rule of the i'th link.
+func addLinkRules(cfg *Config, c commander, i int, link Link, classOp, qdiscOp, major string) error {
+	minor := tcLinkMinor + i
+
+	//The Class for this destination
+	class := args(tcLinkClass, cfg.Device, major, major, minor)
+	rate := args(tcRate, 1000000)
+	if link.Bandwidth > 0 {
+		rate = args(tcRate, link.Bandwidth)
+	}
+	if err := c.execute(concat(args(classOp), class, []string{"htb"}, rate)); err != nil {
 		return err
 	}
 
-	// The root node to append the filters
-	if err := delRootQDisc(cfg, t.c); err != nil {
+	//Its Network Emulator rule
+	net := args(tcLinkNetem, cfg.Device, major, minor, tcLinkHandle+i)
+	cmd := concat(args(qdiscOp), net, []string{"netem"})
+
+	if link.Latency > 0 {
+		cmd = append(cmd, args(tcDelay, link.Latency)...)
+		if link.Jitter > 0 {
+			cmd = append(cmd, args(tcJitter, link.Jitter)...)
+		}
+	}
+
+	if link.Bandwidth > 0 {
+		cmd = append(cmd, args(tcRate, link.Bandwidth)...)
+	}
+
+	if link.PacketLoss > 0 {
+		cmd = append(cmd, args(tcLoss, strconv.FormatFloat(link.PacketLoss, 'f', 2, 64))...)
+	}
+
+	return c.execute(cmd)
+}
+
+// ownerMatches returns the matches selecting traffic by the process sending
+// it. Traffic matching any of them is targeted.
+func ownerMatches(cfg *Config) [][]string {
+	matches := [][]string{}
+	for _, cg := range cfg.TargetCgroups {
+		matches = append(matches, args(iptCgroup, cg))
+	}
+	for _, uid := range cfg.TargetUids {
+		matches = append(matches, args(iptUidOwner, uid))
+	}
+	for _, gid := range cfg.TargetGids {
+		matches = append(matches, args(iptGidOwner, gid))
+	}
+	return matches
+}
+
+// addPartitionRules drops (or rejects) traffic to and/or from the targets in
+// the filter table, tagging the rules so teardown can find them.
+func addPartitionRules(cfg *Config, c commander) error {
+	if err := checkPartition(cfg); err != nil {
 		return err
 	}
+
+	for _, command := range []string{ip4Tables, ip6Tables} {
+		addrs := cfg.TargetIps
+		if command == ip6Tables {
+			addrs = cfg.TargetIps6
+		}
+
+		if err := executeRules(c, command, partitionRules(cfg, command, addrs)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func delIptablesRules(cfg *Config, c commander) error {
+func partitionRules(cfg *Config, command string, addrs []string) [][]string {
+	in, out := partitionDirections(cfg)
+
+	dports := portMatches(cfg.TargetPorts, iptDestPorts, iptDestPort)
+	sports := portMatches(cfg.TargetPorts, iptSrcPorts, iptSrcPort)
+
+	protos := cfg.TargetProtos
+	if len(protos) == 0 {
+		protos = []string{""}
+	}
+
+	rules := [][]string{}
+	for _, addr := range addrs {
+		for _, ptc := range protos {
+			verdict := args(iptDrop)
+			if cfg.PartitionReject {
+				verdict = args(iptReject)
+				if ptc == "tcp" {
+					verdict = append(verdict, args(iptRejectTCP)...)
+				}
+			}
+			if command == ip6Tables && ptc == "icmp" {
+				ptc = "ipv6-icmp"
+			}
+
+			match := func(ports []string) []string {
+				if ptc == "" {
+					return nil
+				}
+				return concat(args(iptProto, ptc), ports)
+			}
+
+			runs := 1
+			if ptc == "tcp" || ptc == "udp" {
+				runs = len(dports)
+			}
+			for i := 0; i < runs; i++ {
+				dprts, sprts := []string(nil), []string(nil)
+				if ptc == "tcp" || ptc == "udp" {
+					dprts, sprts = dports[i], sports[i]
+				}
+				if out {
+					rules = append(rules, concat(args(iptBlockOut, command, addr), match(dprts), args(iptBlockTag), verdict))
+				}
+				if in {
+					rules = append(rules, concat(args(iptBlockIn, command, addr), match(sprts), args(iptBlockTag), verdict))
+				}
+			}
+		}
+	}
+	return rules
+}
+
+func (t *tcThrottler) teardown(cfg *Config) error {
+	state := readState(cfg, t.c)
+	tree := currentTree(cfg, t.c, func() []string { return state })
+
+	deleted := []string{}
+	if tree.graft {
+		// Only the rules classifying into comcast's classes, not the HTB's own
+		for _, leaf := range comcastLeaves(tree.qdiscs, tree.major) {
+			var major, minor uint64
+			fmt.Sscanf(leaf, "%x:%x", &major, &minor)
+			rules, err := delMatchingRules(t.c, iptList, iptDel, fmt.Sprintf(iptClassSearch, major, minor))
+			if err != nil {
+				return err
+			}
+			deleted = append(deleted, rules...)
+		}
+	} else {
+		rules, err := delIptablesRules(cfg, t.c)
+		if err != nil {
+			return err
+		}
+		deleted = rules
+	}
+
+	if err := delPartitionRules(cfg, t.c); err != nil {
+		return err
+	}
+
+	if err := delTargetSets(t.c, deleted); err != nil {
+		return err
+	}
+
+	// The classes, or the root node to append the filters, unless only a
+	// partition was set up
+	return delTree(cfg, t.c, tree, state)
+}
+
+// undo deletes the iptables rules setup adds for cfg one by one, or batched
+// the way setup added them, then the target sets and the root qdisc and
+// everything below it.
+func (t *tcThrottler) undo(cfg *Config) error {
+	added := &collectCommander{}
+	if err := (&tcThrottler{added}).setup(cfg); err != nil {
+		return err
+	}
+
+	sets := []string{}
+	for _, cmd := range added.commands {
+		var err error
+		switch cmd.argv[0] {
+		case ip4Tables, ip6Tables:
+			err = t.c.execute(deleteRule(cmd.argv))
+		case ip4Tables + "-restore", ip6Tables + "-restore":
+			lines := strings.Split(cmd.input, "\n")
+			for i, line := range lines {
+				lines[i] = strings.Join(deleteRule(strings.Fields(line)), " ")
+			}
+			err = t.c.executeInput(cmd.argv, strings.Join(lines, "\n"))
+		case ipset:
+			for _, set := range targetSets {
+				if len(setMembers(set, strings.Split(cmd.input, "\n"))) > 0 {
+					sets = append(sets, set)
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	sort.Strings(sets)
+	for _, set := range sets {
+		if err := t.c.execute(args(ipsetDestroy, set)); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Partition != "" {
+		return nil
+	}
+	return delRootQDisc(cfg, t.c)
+}
+
+// deleteRule turns a rule added with -A into the one that deletes it.
+func deleteRule(rule []string) []string {
+	del := append([]string{}, rule...)
+	for i, arg := range del {
+		if arg == "-A" {
+			del[i] = "-D"
+			break
+		}
+	}
+	return del
+}
+
+func delIptablesRules(cfg *Config, c commander) ([]string, error) {
+	return delMatchingRules(c, iptList, iptDel, iptDelSearch)
+}
+
+func delPartitionRules(cfg *Config, c commander) error {
+	_, err := delMatchingRules(c, iptBlockList, iptBlockDel, iptBlockSearch)
+	return err
+}
+
+// delMatchingRules deletes the rules listed by listCmd that contain search,
+// for both iptables and ip6tables, returning them as listed.
+func delMatchingRules(c commander, listCmd, delCmd, search string) ([]string, error) {
+	deleted := []string{}
 	iptablesCommands := []string{ip4Tables, ip6Tables}
 
 	for _, iptablesCommand := range iptablesCommands {
 		if !c.commandExists(iptablesCommand) {
 			continue
 		}
-		lines, err := c.executeGetLines(fmt.Sprintf(iptList, iptablesCommand))
+		lines, err := c.executeGetLines(args(listCmd, iptablesCommand))
 		if err != nil {
-			// ignore exit code 3 from iptables, which might happen if the system
-			// has the ip6tables command, but no IPv6 capabilities
-			werr, ok := err.(*exec.ExitError)
-			if !ok {
-				return err
-			}
-			status, ok := werr.Sys().(syscall.WaitStatus)
-			if !ok {
-				return err
-			}
-			if status.ExitStatus() == 3 {
+			if noIptablesSupport(err) {
 				continue
 			}
-			return err
+			return nil, err
 		}
 
-		delCmdPrefix := fmt.Sprintf(iptDel, iptablesCommand)
+		delCmdPrefix := args(delCmd, iptablesCommand)
 
 		for _, line := range lines {
-			if strings.Contains(line, iptDelSearch) {
-				cmd := strings.Replace(line, "-A", delCmdPrefix, 1)
-				err = c.execute(cmd)
+			rule := splitRule(line)
+			if strings.Contains(line, search) && len(rule) > 0 && rule[0] == "-A" {
+				err = c.execute(concat(delCmdPrefix, rule[1:]))
 				if err != nil {
-					return err
+					return nil, err
 				}
+				deleted = append(deleted, line)
 			}
 		}
 	}
-	return nil
+	return deleted, nil
+}
+
+// splitRule splits a rule as listed by iptables -S, which double quotes the
+// arguments that contain spaces.
+func splitRule(line string) []string {
+	fields := []string{}
+	field, quoted, started := []rune{}, false, false
+	for _, r := range line {
+		switch {
+		case r == '"':
+			quoted, started = !quoted, true
+		case r == ' ' && !quoted:
+			if started {
+				fields = append(fields, string(field))
+			}
+			field, started = []rune{}, false
+		default:
+			field, started = append(field, r), true
+		}
+	}
+	if started {
+		fields = append(fields, string(field))
+	}
+	return fields
+}
+
+// noIptablesSupport reports whether err is iptables' exit code 3, which might
+// happen if the system has the ip6tables command, but no IPv6 capabilities.
+func noIptablesSupport(err error) bool {
+	var cerr *CommandError
+	return errors.As(err, &cerr) && cerr.ExitCode == 3
 }
 
 func delRootQDisc(cfg *Config, c commander) error {
 	//Delete the root QDisc
-	root := fmt.Sprintf(tcRootQDisc, cfg.Device)
-
-	strs := []string{tcDelQDisc, root}
-	cmd := strings.Join(strs, " ")
+	root := args(tcRootQDisc, cfg.Device)
+	cmd := concat(args(tcDelQDisc), root)
 
 	return c.execute(cmd)
 }
@@ -274,10 +650,545 @@ func (t *tcThrottler) exists() bool {
 	if dry {
 		return false
 	}
-	err := t.c.execute(tcExists)
-	return err == nil
+	if listed(t.c, args(tcExists), tcExistsSearch) {
+		return true
+	}
+
+	for _, iptablesCommand := range []string{ip4Tables, ip6Tables} {
+		if t.c.commandExists(iptablesCommand) && listed(t.c, args(iptBlockList, iptablesCommand), iptBlockSearch) {
+			return true
+		}
+	}
+	return false
+}
+
+// listed reports whether any line cmd prints contains search.
+func listed(c commander, cmd []string, search string) bool {
+	lines, err := c.executeGetLines(cmd)
+	if err != nil {
+		return false
+	}
+	for _, line := range lines {
+		if strings.Contains(line, search) {
+			return true
+		}
+	}
+	return false
 }
 
-func (t *tcThrottler) check() string {
-	return tcCheck
+func (t *tcThrottler) check() []string {
+	return args(tcCheck)
+}
+
+func (t *tcThrottler) stats(cfg *Config) (*backendStats, error) {
+	st := &backendStats{}
+	tree := currentTree(cfg, t.c, func() []string { return readState(cfg, t.c) })
+
+	qdiscs, err := qdiscStatsFor(cfg, t.c, tree)
+	if err != nil {
+		return nil, err
+	}
+	st.Qdiscs = qdiscs
+
+	classes, err := classStatsFor(cfg, t.c, tree)
+	if err != nil {
+		return nil, err
+	}
+	st.Classes = classes
+
+	for _, iptablesCommand := range []string{ip4Tables, ip6Tables} {
+		if !t.c.commandExists(iptablesCommand) {
+			continue
+		}
+		rules, err := ruleStatsFor(iptablesCommand, t.c, classSearches(tree))
+		if err != nil {
+			if noIptablesSupport(err) {
+				continue
+			}
+			return nil, err
+		}
+		st.Rules = append(st.Rules, rules...)
+	}
+
+	return st, nil
+}
+
+// qdiscStatsFor parses `tc -s -j qdisc` output, keeping only comcast's root
+// qdisc and the ones below it, or of a grafted tree its netem qdiscs.
+func qdiscStatsFor(cfg *Config, c commander, tree *tcTree) ([]qdiscStats, error) {
+	lines, err := c.executeGetLines(args(tcQDiscStats, cfg.Device))
+	if err != nil {
+		return nil, err
+	}
+
+	out := strings.Join(lines, "\n")
+	if strings.TrimSpace(out) == "" {
+		return nil, nil
+	}
+
+	var parsed []struct {
+		Kind       string `json:"kind"`
+		Handle     string `json:"handle"`
+		Parent     string `json:"parent"`
+		Bytes      uint64 `json:"bytes"`
+		Packets    uint64 `json:"packets"`
+		Drops      uint64 `json:"drops"`
+		Overlimits uint64 `json:"overlimits"`
+	}
+	if err := json.Unmarshal([]byte(out), &parsed); err != nil {
+		return nil, fmt.Errorf("Could not parse qdisc statistics: %s", err)
+	}
+
+	qdiscs := []qdiscStats{}
+	for _, q := range parsed {
+		if !tree.ownsQDisc(q.Handle, q.Parent) {
+			continue
+		}
+		qdiscs = append(qdiscs, qdiscStats{
+			Kind:     q.Kind,
+			Handle:   q.Handle,
+			Parent:   q.Parent,
+			counters: counters{q.Bytes, q.Packets, q.Drops, q.Overlimits},
+		})
+	}
+	return qdiscs, nil
+}
+
+// classStatsFor parses `tc -s class` output, which looks like:
+//
+//	class htb 10:10 root leaf 100: prio 0 rate 1Mbit ceil 1Mbit burst 1600b cburst 1600b
+//	 Sent 1234 bytes 12 pkt (dropped 1, overlimits 3 requeues 0)
+func classStatsFor(cfg *Config, c commander, tree *tcTree) ([]classStats, error) {
+	lines, err := c.executeGetLines(args(tcClassStats, cfg.Device))
+	if err != nil {
+		return nil, err
+	}
+
+	classes := []classStats{}
+	var current *classStats
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[0] == "class" {
+			current = nil
+			if tree.ownsClass(fields[2]) {
+				classes = append(classes, classStats{Class: fields[2]})
+				current = &classes[len(classes)-1]
+			}
+			continue
+		}
+
+		if current != nil && len(fields) > 0 && fields[0] == "Sent" {
+			var cs counters
+			fmt.Sscanf(strings.Join(fields, " "), "Sent %d bytes %d pkt (dropped %d, overlimits %d",
+				&cs.Bytes, &cs.Packets, &cs.Drops, &cs.Overlimits)
+			current.counters = cs
+		}
+	}
+	return classes, nil
+}
+
+// ruleStatsFor reads the counters of comcast's CLASSIFY rules, as the class
+// searches find them, from `iptables -S -v`, which reports them as
+// `-c <packets> <bytes>`.
+func ruleStatsFor(command string, c commander, searches []string) ([]ruleStats, error) {
+	lines, err := c.executeGetLines(args(iptStats, command))
+	if err != nil {
+		return nil, err
+	}
+
+	family := "ipv4"
+	if command == ip6Tables {
+		family = "ipv6"
+	}
+
+	rules := []ruleStats{}
+	for _, line := range lines {
+		if !containsAny(line, searches) {
+			continue
+		}
+
+		r := ruleStats{Family: family}
+		fields := strings.Fields(line)
+		rule := []string{}
+		for i := 0; i < len(fields); i++ {
+			if fields[i] == "-c" && i+2 < len(fields) {
+				r.Packets, _ = strconv.ParseUint(fields[i+1], 10, 64)
+				r.Bytes, _ = strconv.ParseUint(fields[i+2], 10, 64)
+				i += 2
+				continue
+			}
+			rule = append(rule, fields[i])
+		}
+		r.Rule = strings.Join(rule, " ")
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// tcLive is a qdisc or class of comcast's tree as tc lists it.
+type tcLive struct {
+	key    string
+	parent string
+	spec   string
+}
+
+// plan compares the tc objects and iptables rules setup adds with the live
+// ones. Objects whose parameters differ are changed in place.
+func (t *tcThrottler) plan(cfg *Config, desired []command) ([]Change, error) {
+	state := readState(cfg, t.c)
+	tree := currentTree(cfg, t.c, func() []string { return state })
+	objects, order, err := liveTcObjects(cfg, t.c, tree)
+	if err != nil {
+		return nil, err
+	}
+	rules, ruleOrder, err := liveIptablesRules(t.c, classSearches(tree))
+	if err != nil {
+		return nil, err
+	}
+
+	changes, saves := []Change{}, []Change{}
+	wanted := map[string]bool{}
+	shaped := false
+	sets := []string{}
+	addRule := func(argv []string) {
+		key := ruleKey(argv[0], argv[1:])
+		wanted[key] = true
+		if _, found := rules[key]; !found {
+			changes = append(changes, Change{Action: ChangeAdd, Rule: shellJoin(argv), Command: argv})
+		}
+	}
+	for _, cmd := range desired {
+		argv := cmd.argv
+		if argv[0] == "tee" {
+			// Saving what setup found only matters along with other changes
+			saves = append(saves, Change{Action: ChangeAdd, Rule: shellJoin(argv), Command: argv, Input: cmd.input})
+			continue
+		}
+		if argv[0] == ipset {
+			set := strings.Fields(cmd.input)[1]
+			sets = append(sets, set)
+			if change, differs := setChange(t.c, set, cmd); differs {
+				changes = append(changes, change)
+			}
+			continue
+		}
+		if strings.HasSuffix(argv[0], "-restore") {
+			for _, rule := range restoredRules(argv[0], cmd.input) {
+				addRule(rule)
+			}
+			continue
+		}
+		if argv[0] != "tc" {
+			addRule(argv)
+			continue
+		}
+
+		id, _, spec := tcObject(argv[5:])
+		key := argv[1] + " " + id
+		wanted[key] = true
+		shaped = true
+		now := tcSpec(spec)
+		live, found := objects[key]
+		if !found {
+			changes = append(changes, Change{Action: ChangeAdd, Rule: key, Detail: now, Command: argv})
+		} else if live.spec != now {
+			change := concat(argv[:2], []string{"change"}, argv[3:])
+			changes = append(changes, Change{Action: ChangeUpdate, Rule: key, Detail: live.spec + " -> " + now, Command: change})
+		}
+	}
+
+	removed, unmatched := []Change{}, []string{}
+	for _, key := range ruleOrder {
+		if !wanted[key] {
+			removed = append(removed, Change{Action: ChangeRemove, Rule: shellJoin(rules[key]), Command: rules[key]})
+			unmatched = append(unmatched, shellJoin(rules[key]))
+		}
+	}
+	// Sets go once no rule matches them
+	for _, set := range matchedSets(unmatched) {
+		if !contains(sets, set) {
+			removed = append(removed, Change{Action: ChangeRemove, Rule: "set " + set, Command: args(ipsetDestroy, set)})
+		}
+	}
+
+	// Without any shaping, the tree goes the way teardown removes it
+	if !shaped && len(objects) > 0 {
+		deleted := &collectCommander{}
+		if err := delTree(cfg, deleted, tree, state); err != nil {
+			return nil, err
+		}
+		for _, cmd := range deleted.commands {
+			removed = append(removed, Change{Action: ChangeRemove, Rule: shellJoin(cmd.argv), Command: cmd.argv})
+		}
+		return append(removed, changes...), nil
+	}
+
+	// Qdiscs go before the classes they hang off
+	for _, kind := range []string{"qdisc", "class"} {
+		for _, key := range order {
+			live := objects[key]
+			if wanted[key] || !strings.HasPrefix(key, kind+" ") {
+				continue
+			}
+			id := strings.TrimPrefix(key, kind+" ")
+			del := concat(args(tcDelQDisc), args(tcDelChild, cfg.Device, live.parent, id))
+			if kind == "class" {
+				del = concat(args(tcDelClass), args(tcDelClassID, cfg.Device, id))
+			}
+			removed = append(removed, Change{Action: ChangeRemove, Rule: key, Detail: live.spec, Command: del})
+		}
+	}
+
+	changes = append(removed, changes...)
+	if len(changes) > 0 {
+		changes = append(saves, changes...)
+	}
+	return changes, nil
+}
+
+// liveTcObjects lists the qdiscs and classes of comcast's tree on the device,
+// keyed like "qdisc 100:" or "class 10:10", in the order tc lists them. Of a
+// grafted tree, that's comcast's classes and their netem qdiscs.
+func liveTcObjects(cfg *Config, c commander, tree *tcTree) (map[string]tcLive, []string, error) {
+	classes, err := c.executeGetLines(args(tcShowClass, cfg.Device))
+	if err != nil {
+		return nil, nil, err
+	}
+	leaves := comcastLeaves(tree.qdiscs, tree.major)
+
+	objects := map[string]tcLive{}
+	order := []string{}
+	for _, lines := range [][]string{tree.qdiscs, classes} {
+		for _, line := range lines {
+			fields := strings.Fields(line)
+			if len(fields) < 4 || (fields[0] != "qdisc" && fields[0] != "class") {
+				continue
+			}
+			_, parent, params := tcObject(fields[3:])
+			id := fields[2]
+			if tree.graft {
+				if !contains(leaves, parent) && !(fields[0] == "class" && contains(leaves, id)) {
+					continue
+				}
+			} else if id != tcRootHandle && !strings.HasPrefix(parent, tcRootHandle) && !(fields[0] == "class" && strings.HasPrefix(id, tcRootHandle)) {
+				continue
+			}
+
+			key := fields[0] + " " + id
+			objects[key] = tcLive{key: key, parent: parent, spec: tcSpec(append([]string{fields[1]}, params...))}
+			order = append(order, key)
+		}
+	}
+	return objects, order, nil
+}
+
+// classSearches finds the CLASSIFY rules into comcast's classes: any below
+// its own root qdisc, but only its own grafted ones below someone else's.
+func classSearches(tree *tcTree) []string {
+	if !tree.graft {
+		return []string{iptDelSearch}
+	}
+	searches := []string{}
+	for _, leaf := range comcastLeaves(tree.qdiscs, tree.major) {
+		var major, minor uint64
+		fmt.Sscanf(leaf, "%x:%x", &major, &minor)
+		searches = append(searches, fmt.Sprintf(iptClassSearch, major, minor))
+	}
+	return searches
+}
+
+// liveIptablesRules lists comcast's CLASSIFY rules, as the class searches
+// find them, and partition rules, keyed by ruleKey, as the commands that
+// delete them.
+func liveIptablesRules(c commander, classes []string) (map[string][]string, []string, error) {
+	rules := map[string][]string{}
+	order := []string{}
+	lists := []struct {
+		list, del string
+		searches  []string
+	}{
+		{iptList, iptDel, classes},
+		{iptBlockList, iptBlockDel, []string{iptBlockSearch}},
+	}
+	for _, iptablesCommand := range []string{ip4Tables, ip6Tables} {
+		if !c.commandExists(iptablesCommand) {
+			continue
+		}
+		for _, l := range lists {
+			if len(l.searches) == 0 {
+				continue
+			}
+			lines, err := c.executeGetLines(args(l.list, iptablesCommand))
+			if err != nil {
+				if noIptablesSupport(err) {
+					break
+				}
+				return nil, nil, err
+			}
+
+			for _, line := range lines {
+				rule := splitRule(line)
+				if !containsAny(line, l.searches) || len(rule) == 0 || rule[0] != "-A" {
+					continue
+				}
+				key := ruleKey(iptablesCommand, rule)
+				rules[key] = concat(args(l.del, iptablesCommand), rule[1:])
+				order = append(order, key)
+			}
+		}
+	}
+	return rules, order, nil
+}
+
+func containsAny(line string, searches []string) bool {
+	for _, search := range searches {
+		if strings.Contains(line, search) {
+			return true
+		}
+	}
+	return false
+}
+
+// tcObject splits the arguments of a qdisc or class after the device into
+// its handle or class ID, its parent, and its kind with its parameters.
+func tcObject(fields []string) (string, string, []string) {
+	id, parent := "", ""
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "root":
+			parent = "root"
+		case "handle", "classid", "parent":
+			if i+1 < len(fields) {
+				if fields[i] == "parent" {
+					parent = fields[i+1]
+				} else {
+					id = fields[i+1]
+				}
+				i++
+			}
+		case "refcnt":
+			i++
+		default:
+			return id, parent, fields[i:]
+		}
+	}
+	return id, parent, nil
+}
+
+// tcSpec renders the parameters comcast sets of a qdisc or class, given its
+// kind and parameters as passed to tc or as tc lists them, so the two
+// compare equal when they're in effect.
+func tcSpec(fields []string) string {
+	if len(fields) == 0 {
+		return ""
+	}
+	params := map[string]string{}
+	for i := 1; i+1 < len(fields); i++ {
+		value := fields[i+1]
+		switch fields[i] {
+		case "default":
+			minor, err := strconv.ParseUint(strings.TrimPrefix(value, "0x"), 16, 32)
+			if err == nil {
+				params["default"] = strconv.FormatUint(minor, 16)
+			}
+		case "rate":
+			if bits, ok := parseTcRate(value); ok {
+				params["rate"] = strconv.FormatUint(bits/1000, 10) + "kbit"
+			}
+		case "delay":
+			if d, err := time.ParseDuration(value); err == nil {
+				params["delay"] = formatMs(d)
+				if i+2 < len(fields) {
+					if jitter, err := time.ParseDuration(fields[i+2]); err == nil {
+						params["jitter"] = formatMs(jitter)
+					}
+				}
+			}
+		case "loss":
+			if loss, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64); err == nil {
+				params["loss"] = strconv.FormatFloat(loss, 'f', -1, 64) + "%"
+			}
+		}
+	}
+
+	spec := []string{fields[0]}
+	for _, param := range []string{"default", "rate", "delay", "jitter", "loss"} {
+		if value, found := params[param]; found {
+			spec = append(spec, param, value)
+		}
+	}
+	return strings.Join(spec, " ")
+}
+
+// parseTcRate parses a rate like 1000kbit or 1Mbit into bits per second.
+func parseTcRate(rate string) (uint64, bool) {
+	rate = strings.ToLower(rate)
+	units := []struct {
+		suffix string
+		bits   uint64
+	}{
+		{"tbit", 1e12}, {"gbit", 1e9}, {"mbit", 1e6}, {"kbit", 1e3}, {"bit", 1},
+		{"tbps", 8e12}, {"gbps", 8e9}, {"mbps", 8e6}, {"kbps", 8e3}, {"bps", 8},
+	}
+	for _, unit := range units {
+		if strings.HasSuffix(rate, unit.suffix) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(rate, unit.suffix), 64)
+			return uint64(n * float64(unit.bits)), err == nil
+		}
+	}
+	return 0, false
+}
+
+func formatMs(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64) + "ms"
+}
+
+// ruleKey identifies an iptables rule whether it's given as comcast adds it
+// or as iptables -S lists it, which spells some of it differently and in
+// another order.
+func ruleKey(tool string, rule []string) string {
+	opts := []string{}
+	reject, rejectWith := false, false
+	for i := 0; i < len(rule); i++ {
+		opt := []string{rule[i]}
+		for i+1 < len(rule) && !strings.HasPrefix(rule[i+1], "-") {
+			opt = append(opt, rule[i+1])
+			i++
+		}
+
+		if opt[0] == "--match" {
+			opt[0] = "-m"
+		}
+		if len(opt) == 2 {
+			switch opt[0] {
+			case "-t":
+				continue
+			case "-m":
+				// Implied by the protocol
+				if contains([]string{"tcp", "udp", "icmp", "icmp6", "ipv6-icmp"}, opt[1]) {
+					continue
+				}
+			case "-d", "-s":
+				if !strings.Contains(opt[1], "/") {
+					opt[1] += map[bool]string{true: "/32", false: "/128"}[isIPv4(opt[1])]
+				}
+			case "--set-class":
+				var major, minor uint64
+				if _, err := fmt.Sscanf(opt[1], "%x:%x", &major, &minor); err == nil {
+					opt[1] = fmt.Sprintf("%x:%x", major, minor)
+				}
+			case "-j":
+				reject = opt[1] == "REJECT"
+			case "--reject-with":
+				rejectWith = true
+			}
+		}
+		opts = append(opts, strings.Join(opt, " "))
+	}
+
+	if reject && !rejectWith {
+		opts = append(opts, "--reject-with "+map[bool]string{true: "icmp-port-unreachable", false: "icmp6-port-unreachable"}[tool == ip4Tables])
+	}
+	sort.Strings(opts)
+	return tool + " " + strings.Join(opts, " ")
 }
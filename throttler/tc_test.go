@@ -1,6 +1,9 @@
 package throttler
 
 import (
+	"errors"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -8,25 +11,39 @@ type cmdRecorder struct {
 	commands     []string
 	responses    map[string][]string
 	cmdBlackList []string
+	failures     map[string]error
 }
 
 func newCmdRecorder() *cmdRecorder {
-	return &cmdRecorder{[]string{}, map[string][]string{}, []string{}}
+	return &cmdRecorder{[]string{}, map[string][]string{}, []string{}, map[string]error{}}
 }
 
-func (r *cmdRecorder) execute(cmd string) error {
+func (r *cmdRecorder) record(cmd string) error {
 	r.commands = append(r.commands, cmd)
-	return nil
+	return r.failures[cmd]
 }
 
-func (r *cmdRecorder) executeGetLines(cmd string) ([]string, error) {
-	r.execute(cmd)
-	if responses, found := r.responses[cmd]; found {
+func (r *cmdRecorder) execute(cmd []string) error {
+	return r.record(strings.Join(cmd, " "))
+}
+
+func (r *cmdRecorder) executeGetLines(cmd []string) ([]string, error) {
+	line := strings.Join(cmd, " ")
+	if err := r.record(line); err != nil {
+		return []string{}, err
+	}
+	if responses, found := r.responses[line]; found {
 		return responses, nil
 	}
 	return []string{}, nil
 }
 
+// executeInput records the input after the command, the way a here-string
+// would pass it.
+func (r *cmdRecorder) executeInput(cmd []string, input string) error {
+	return r.record(strings.Join(cmd, " ") + " <<< " + strconv.Quote(input))
+}
+
 func (r *cmdRecorder) commandExists(cmd string) bool {
 	for _, blackListed := range r.cmdBlackList {
 		if blackListed == cmd {
@@ -68,6 +85,11 @@ var defaultTestConfig = Config{
 	DryRun:           false,
 }
 
+var tcRootQDiscShow = []string{
+	"qdisc htb 10: root refcnt 2 r2q 10 default 0x1 direct_packets_stat 0 direct_qlen 1000",
+	"qdisc netem 100: parent 10:10 limit 1000 loss 0.1%",
+}
+
 func TestTcPacketLossSetup(t *testing.T) {
 	r := newCmdRecorder()
 	th := &tcThrottler{r}
@@ -76,11 +98,12 @@ func TestTcPacketLossSetup(t *testing.T) {
 	cfg.PacketLoss = 0.2
 	th.setup(&cfg)
 	r.verifyCommands(t, []string{
-		"sudo tc qdisc add dev eth1 handle 10: root htb default 1",
-		"sudo tc class add dev eth1 parent 10: classid 10:1 htb rate 20000kbit",
-		"sudo tc class add dev eth1 parent 10: classid 10:10 htb rate 1000000kbit",
-		"sudo tc qdisc add dev eth1 parent 10:10 handle 100: netem loss 0.20%",
-		"sudo iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p tcp --dport 80 -d 10.10.10.10",
+		"tc qdisc show dev eth1",
+		"tc qdisc add dev eth1 handle 10: root htb default 1",
+		"tc class add dev eth1 parent 10: classid 10:1 htb rate 20000kbit",
+		"tc class add dev eth1 parent 10: classid 10:10 htb rate 1000000kbit",
+		"tc qdisc add dev eth1 parent 10:10 handle 100: netem loss 0.20%",
+		"iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p tcp --dport 80 -d 10.10.10.10",
 	})
 }
 
@@ -94,12 +117,13 @@ func TestTcWildcardIps(t *testing.T) {
 	cfg.PacketLoss = -1
 	th.setup(&cfg)
 	r.verifyCommands(t, []string{
-		"sudo tc qdisc add dev eth0 handle 10: root htb default 1",
-		"sudo tc class add dev eth0 parent 10: classid 10:1 htb rate 20000kbit",
-		"sudo tc class add dev eth0 parent 10: classid 10:10 htb rate 1000000kbit",
-		"sudo tc qdisc add dev eth0 parent 10:10 handle 100: netem",
-		"sudo iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10",
-		"sudo ip6tables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10",
+		"tc qdisc show dev eth0",
+		"tc qdisc add dev eth0 handle 10: root htb default 1",
+		"tc class add dev eth0 parent 10: classid 10:1 htb rate 20000kbit",
+		"tc class add dev eth0 parent 10: classid 10:10 htb rate 1000000kbit",
+		"tc qdisc add dev eth0 parent 10:10 handle 100: netem",
+		"iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10",
+		"ip6tables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10",
 	})
 }
 
@@ -112,14 +136,15 @@ func TestTcMultiplePortsAndIps(t *testing.T) {
 	cfg.TargetProtos = []string{"tcp", "udp"}
 	th.setup(&cfg)
 	r.verifyCommands(t, []string{
-		"sudo tc qdisc add dev eth0 handle 10: root htb default 1",
-		"sudo tc class add dev eth0 parent 10: classid 10:1 htb rate 20000kbit",
-		"sudo tc class add dev eth0 parent 10: classid 10:10 htb rate 1000000kbit",
-		"sudo tc qdisc add dev eth0 parent 10:10 handle 100: netem loss 0.10%",
-		"sudo iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p tcp --match multiport --dports 80,8080 -d 1.1.1.1",
-		"sudo iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p udp --match multiport --dports 80,8080 -d 1.1.1.1",
-		"sudo iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p tcp --match multiport --dports 80,8080 -d 2.2.2.2",
-		"sudo iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p udp --match multiport --dports 80,8080 -d 2.2.2.2",
+		"tc qdisc show dev eth0",
+		"tc qdisc add dev eth0 handle 10: root htb default 1",
+		"tc class add dev eth0 parent 10: classid 10:1 htb rate 20000kbit",
+		"tc class add dev eth0 parent 10: classid 10:10 htb rate 1000000kbit",
+		"tc qdisc add dev eth0 parent 10:10 handle 100: netem loss 0.10%",
+		"iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p tcp --match multiport --dports 80,8080 -d 1.1.1.1",
+		"iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p udp --match multiport --dports 80,8080 -d 1.1.1.1",
+		"iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p tcp --match multiport --dports 80,8080 -d 2.2.2.2",
+		"iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p udp --match multiport --dports 80,8080 -d 2.2.2.2",
 	})
 }
 
@@ -132,12 +157,13 @@ func TestTcMixedIPv6Setup(t *testing.T) {
 	cfg.TargetIps6 = []string{"2001:db8::1"}
 	th.setup(&cfg)
 	r.verifyCommands(t, []string{
-		"sudo tc qdisc add dev eth1 handle 10: root htb default 1",
-		"sudo tc class add dev eth1 parent 10: classid 10:1 htb rate 20000kbit",
-		"sudo tc class add dev eth1 parent 10: classid 10:10 htb rate 1000000kbit",
-		"sudo tc qdisc add dev eth1 parent 10:10 handle 100: netem loss 0.20%",
-		"sudo iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p tcp --dport 80 -d 10.10.10.10",
-		"sudo ip6tables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p tcp --dport 80 -d 2001:db8::1",
+		"tc qdisc show dev eth1",
+		"tc qdisc add dev eth1 handle 10: root htb default 1",
+		"tc class add dev eth1 parent 10: classid 10:1 htb rate 20000kbit",
+		"tc class add dev eth1 parent 10: classid 10:10 htb rate 1000000kbit",
+		"tc qdisc add dev eth1 parent 10:10 handle 100: netem loss 0.20%",
+		"iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p tcp --dport 80 -d 10.10.10.10",
+		"ip6tables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p tcp --dport 80 -d 2001:db8::1",
 	})
 }
 
@@ -145,7 +171,8 @@ func TestTcTeardown(t *testing.T) {
 	r := newCmdRecorder()
 	th := &tcThrottler{r}
 	r.responses = map[string][]string{
-		"sudo iptables -S -t mangle": {
+		"tc qdisc show dev eth0": tcRootQDiscShow,
+		"iptables -S -t mangle": {
 			"-P PREROUTING ACCEPT",
 			"-P INPUT ACCEPT",
 			"-P FORWARD ACCEPT",
@@ -153,7 +180,7 @@ func TestTcTeardown(t *testing.T) {
 			"-P POSTROUTING ACCEPT",
 			"-A POSTROUTING -d 10.10.10.10 -p tcp -m tcp --dport 80 -j CLASSIFY --set-class 0010:0010",
 		},
-		"sudo ip6tables -S -t mangle": {
+		"ip6tables -S -t mangle": {
 			"-P PREROUTING ACCEPT",
 			"-P INPUT ACCEPT",
 			"-P FORWARD ACCEPT",
@@ -163,30 +190,72 @@ func TestTcTeardown(t *testing.T) {
 	}
 	th.teardown(&defaultTestConfig)
 	r.verifyCommands(t, []string{
-		"sudo iptables -S -t mangle",
-		"sudo iptables -t mangle -D POSTROUTING -d 10.10.10.10 -p tcp -m tcp --dport 80 -j CLASSIFY --set-class 0010:0010",
-		"sudo ip6tables -S -t mangle",
-		"sudo tc qdisc del dev eth0 handle 10: root",
+		tcReadEth0State,
+		"tc qdisc show dev eth0",
+		"iptables -S -t mangle",
+		"iptables -t mangle -D POSTROUTING -d 10.10.10.10 -p tcp -m tcp --dport 80 -j CLASSIFY --set-class 0010:0010",
+		"ip6tables -S -t mangle",
+		"iptables -S",
+		"ip6tables -S",
+		"tc qdisc del dev eth0 handle 10: root",
 	})
 }
 
 func TestTcTeardownNoIpTables(t *testing.T) {
 	r := newCmdRecorder()
 	th := &tcThrottler{r}
+	r.responses = map[string][]string{
+		"tc qdisc show dev eth0": tcRootQDiscShow,
+	}
 	th.teardown(&defaultTestConfig)
 	r.verifyCommands(t, []string{
-		"sudo iptables -S -t mangle",
-		"sudo ip6tables -S -t mangle",
-		"sudo tc qdisc del dev eth0 handle 10: root",
+		tcReadEth0State,
+		"tc qdisc show dev eth0",
+		"iptables -S -t mangle",
+		"ip6tables -S -t mangle",
+		"iptables -S",
+		"ip6tables -S",
+		"tc qdisc del dev eth0 handle 10: root",
 	})
 }
 
+func TestTcTeardownNoIPv6Support(t *testing.T) {
+	r := newCmdRecorder()
+	th := &tcThrottler{r}
+	r.failures = map[string]error{
+		"ip6tables -S -t mangle": &CommandError{Command: "ip6tables -S -t mangle", ExitCode: 3},
+		"ip6tables -S":           &CommandError{Command: "ip6tables -S", ExitCode: 3},
+	}
+	if err := th.teardown(&defaultTestConfig); err != nil {
+		t.Fatalf("Expected missing IPv6 support to be skipped, got %s", err)
+	}
+}
+
+func TestTcSetupCommandError(t *testing.T) {
+	r := newCmdRecorder()
+	th := &tcThrottler{r}
+	failed := &CommandError{
+		Command:  "tc qdisc add dev eth0 handle 10: root htb default 1",
+		ExitCode: 2,
+		Stderr:   "RTNETLINK answers: File exists\n",
+	}
+	r.failures = map[string]error{failed.Command: failed}
+
+	err := th.setup(&defaultTestConfig)
+	var cerr *CommandError
+	if !errors.As(err, &cerr) || cerr != failed {
+		t.Fatalf("Expected the command error, got %v", err)
+	}
+	r.verifyCommands(t, []string{"tc qdisc show dev eth0", failed.Command})
+}
+
 func TestTcIPv6Teardown(t *testing.T) {
 	r := newCmdRecorder()
 	th := &tcThrottler{r}
 	r.responses = map[string][]string{
-		"sudo iptables -S -t mangle": {},
-		"sudo ip6tables -S -t mangle": {
+		"tc qdisc show dev eth0": tcRootQDiscShow,
+		"iptables -S -t mangle":  {},
+		"ip6tables -S -t mangle": {
 			"-P PREROUTING ACCEPT",
 			"-P INPUT ACCEPT",
 			"-P FORWARD ACCEPT",
@@ -199,10 +268,14 @@ func TestTcIPv6Teardown(t *testing.T) {
 
 	th.teardown(&config)
 	r.verifyCommands(t, []string{
-		"sudo iptables -S -t mangle",
-		"sudo ip6tables -S -t mangle",
-		"sudo ip6tables -t mangle -D POSTROUTING -d 2001:db8::1 -p tcp -m tcp --dport 80 -j CLASSIFY --set-class 0010:0010",
-		"sudo tc qdisc del dev eth0 handle 10: root",
+		tcReadEth0State,
+		"tc qdisc show dev eth0",
+		"iptables -S -t mangle",
+		"ip6tables -S -t mangle",
+		"ip6tables -t mangle -D POSTROUTING -d 2001:db8::1 -p tcp -m tcp --dport 80 -j CLASSIFY --set-class 0010:0010",
+		"iptables -S",
+		"ip6tables -S",
+		"tc qdisc del dev eth0 handle 10: root",
 	})
 }
 
@@ -211,7 +284,8 @@ func TestTcTeardownNoIPv6(t *testing.T) {
 	r.cmdBlackList = []string{"ip6tables"}
 	th := &tcThrottler{r}
 	r.responses = map[string][]string{
-		"sudo iptables -S -t mangle": {
+		"tc qdisc show dev eth0": tcRootQDiscShow,
+		"iptables -S -t mangle": {
 			"-P PREROUTING ACCEPT",
 			"-P INPUT ACCEPT",
 			"-P FORWARD ACCEPT",
@@ -223,8 +297,79 @@ func TestTcTeardownNoIPv6(t *testing.T) {
 
 	th.teardown(&defaultTestConfig)
 	r.verifyCommands(t, []string{
-		"sudo iptables -S -t mangle",
-		"sudo iptables -t mangle -D POSTROUTING -d 10.10.10.10 -p tcp -m tcp --dport 80 -j CLASSIFY --set-class 0010:0010",
-		"sudo tc qdisc del dev eth0 handle 10: root",
+		tcReadEth0State,
+		"tc qdisc show dev eth0",
+		"iptables -S -t mangle",
+		"iptables -t mangle -D POSTROUTING -d 10.10.10.10 -p tcp -m tcp --dport 80 -j CLASSIFY --set-class 0010:0010",
+		"iptables -S",
+		"tc qdisc del dev eth0 handle 10: root",
+	})
+}
+
+func TestTcLinksSetup(t *testing.T) {
+	r := newCmdRecorder()
+	th := &tcThrottler{r}
+	cfg := defaultTestConfig
+	cfg.TargetIps = []string{}
+	cfg.TargetPorts = []string{}
+	cfg.Links = []Link{
+		{Dest: "10.0.1.0/24", Latency: 80, Jitter: 5, PacketLoss: 0.1, Bandwidth: 100000},
+		{Dest: "2001:db8::/64", Latency: 200},
+	}
+	th.setup(&cfg)
+	r.verifyCommands(t, []string{
+		"tc qdisc show dev eth0",
+		"tc qdisc add dev eth0 handle 10: root htb default 1",
+		"tc class add dev eth0 parent 10: classid 10:1 htb rate 20000kbit",
+		"tc class add dev eth0 parent 10: classid 10:11 htb rate 100000kbit",
+		"tc qdisc add dev eth0 parent 10:11 handle 101: netem delay 80ms 5ms rate 100000kbit loss 0.10%",
+		"iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:11 -p tcp -d 10.0.1.0/24",
+		"tc class add dev eth0 parent 10: classid 10:12 htb rate 1000000kbit",
+		"tc qdisc add dev eth0 parent 10:12 handle 102: netem delay 200ms",
+		"ip6tables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:12 -p tcp -d 2001:db8::/64",
+	})
+}
+
+func TestTcLinksTeardown(t *testing.T) {
+	r := newCmdRecorder()
+	th := &tcThrottler{r}
+	r.responses = map[string][]string{
+		"tc qdisc show dev eth0": tcRootQDiscShow,
+		"iptables -S -t mangle": {
+			"-P POSTROUTING ACCEPT",
+			"-A POSTROUTING -d 10.0.1.0/24 -p tcp -j CLASSIFY --set-class 0010:0011",
+			"-A POSTROUTING -d 10.0.2.0/24 -p tcp -j CLASSIFY --set-class 0020:0011",
+		},
+	}
+	th.teardown(&defaultTestConfig)
+	r.verifyCommands(t, []string{
+		tcReadEth0State,
+		"tc qdisc show dev eth0",
+		"iptables -S -t mangle",
+		"iptables -t mangle -D POSTROUTING -d 10.0.1.0/24 -p tcp -j CLASSIFY --set-class 0010:0011",
+		"ip6tables -S -t mangle",
+		"iptables -S",
+		"ip6tables -S",
+		"tc qdisc del dev eth0 handle 10: root",
+	})
+}
+
+func TestTcOwnerSetup(t *testing.T) {
+	r := newCmdRecorder()
+	th := &tcThrottler{r}
+	cfg := defaultTestConfig
+	cfg.TargetCgroups = []string{"system.slice/nginx.service"}
+	cfg.TargetUids = []string{"1000"}
+	cfg.TargetGids = []string{"www-data"}
+	th.setup(&cfg)
+	r.verifyCommands(t, []string{
+		"tc qdisc show dev eth0",
+		"tc qdisc add dev eth0 handle 10: root htb default 1",
+		"tc class add dev eth0 parent 10: classid 10:1 htb rate 20000kbit",
+		"tc class add dev eth0 parent 10: classid 10:10 htb rate 1000000kbit",
+		"tc qdisc add dev eth0 parent 10:10 handle 100: netem loss 0.10%",
+		"iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p tcp --dport 80 -m cgroup --path system.slice/nginx.service -d 10.10.10.10",
+		"iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p tcp --dport 80 -m owner --uid-owner 1000 -d 10.10.10.10",
+		"iptables -A POSTROUTING -t mangle -j CLASSIFY --set-class 10:10 -p tcp --dport 80 -m owner --gid-owner www-data -d 10.10.10.10",
 	})
 }
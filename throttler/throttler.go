@@ -2,11 +2,14 @@ package throttler
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"runtime"
+	"strings"
 )
 
 const (
@@ -21,146 +24,358 @@ const (
 
 // Config specifies options for configuring packet filter rules.
 type Config struct {
-	Device           string
-	Stop             bool
-	Latency          int
-	TargetBandwidth  int
-	DefaultBandwidth int
-	PacketLoss       float64
-	TargetIps        []string
-	TargetIps6       []string
-	TargetPorts      []string
-	TargetProtos     []string
-	DryRun           bool
+	Device           string   `json:"device"`
+	Stop             bool     `json:"stop,omitempty"`
+	Latency          int      `json:"latency"`
+	TargetBandwidth  int      `json:"target_bw"`
+	DefaultBandwidth int      `json:"default_bw"`
+	PacketLoss       float64  `json:"packet_loss"`
+	TargetIps        []string `json:"target_ips,omitempty"`
+	TargetIps6       []string `json:"target_ips6,omitempty"`
+	TargetPorts      []string `json:"target_ports,omitempty"`
+	TargetProtos     []string `json:"target_protos,omitempty"`
+	TargetCgroups    []string `json:"target_cgroups,omitempty"`
+	TargetUids       []string `json:"target_uids,omitempty"`
+	TargetGids       []string `json:"target_gids,omitempty"`
+	Links            []Link   `json:"links,omitempty"`
+	Partition        string   `json:"partition,omitempty"`
+	PartitionReject  bool     `json:"partition_reject,omitempty"`
+	DryRun           bool     `json:"dry_run,omitempty"`
+	// Privilege is how commands get the privileges they need: one of the
+	// Privilege strategies, or a custom command prefix such as "sudo -n".
+	// Empty picks automatically. It's left out of JSON, so clients of the
+	// control API can't pick what runs their commands.
+	Privilege string `json:"-"`
+	// TargetOS and Backend generate the rules of another OS or backend than
+	// the one running, which can only be printed or exported.
+	TargetOS string `json:"target_os,omitempty"`
+	Backend  string `json:"backend,omitempty"`
 }
 
 type throttler interface {
 	setup(*Config) error
 	teardown(*Config) error
 	exists() bool
-	check() string
+	check() []string
 }
 
+// commander runs commands as argv, without a shell, prefixing them with
+// whatever gives them the privileges they need.
 type commander interface {
-	execute(string) error
-	executeGetLines(string) ([]string, error)
+	execute([]string) error
+	executeGetLines([]string) ([]string, error)
+	executeInput([]string, string) error
 	commandExists(string) bool
 }
 
-type dryRunCommander struct{}
+type dryRunCommander struct {
+	prefix []string
+}
+
+// quietCommander runs commands like shellCommander without printing them,
+// for checks that report on their own.
+type quietCommander struct {
+	shellCommander
+}
 
-type shellCommander struct{}
+type shellCommander struct {
+	prefix []string
+}
 
 var dry bool
 
-func setup(t throttler, cfg *Config) {
-	if t.exists() {
-		fmt.Println("It looks like the packet rules are already setup")
-		os.Exit(1)
+var (
+	// ErrAlreadySetup is returned when setting up packet rules that are
+	// already in place.
+	ErrAlreadySetup = errors.New("packet rules are already setup")
+	// ErrNotSetup is returned when tearing down packet rules that aren't
+	// in place.
+	ErrNotSetup = errors.New("packet rules aren't setup")
+)
+
+// CommandError is returned when a system command fails, carrying what it
+// printed. Callers can get at it with errors.As.
+type CommandError struct {
+	Command string
+	// ExitCode is -1 if the command didn't exit normally, e.g. it couldn't be
+	// started or was killed.
+	ExitCode int
+	Stdout   string
+	Stderr   string
+	Err      error
+}
+
+func (e *CommandError) Error() string {
+	msg := fmt.Sprintf("`%s` failed: %s", e.Command, e.Err)
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		msg += ": " + strings.Replace(stderr, "\n", "; ", -1)
 	}
+	return msg
+}
 
-	if err := t.setup(cfg); err != nil {
-		fmt.Println("I couldn't setup the packet rules:", err.Error())
-		os.Exit(1)
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+func newCommandError(cmd string, err error, stdout, stderr string) error {
+	if err == nil {
+		return nil
+	}
+	code := -1
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		code = exitErr.ExitCode()
+	}
+	return &CommandError{Command: cmd, ExitCode: code, Stdout: stdout, Stderr: stderr, Err: err}
+}
+
+// checkTcOnly returns an error for options only the tc throttler supports.
+func checkTcOnly(cfg *Config) error {
+	if len(cfg.Links) > 0 {
+		return errors.New("Latency matrices are only supported with tc on Linux")
 	}
+	if len(cfg.TargetCgroups) > 0 || len(cfg.TargetUids) > 0 || len(cfg.TargetGids) > 0 {
+		return errors.New("Targeting cgroups, users or groups is only supported with tc on Linux")
+	}
+	return nil
+}
 
-	fmt.Println("Packet rules setup...")
-	fmt.Printf("Run `%s` to double check\n", t.check())
-	fmt.Printf("Run `%s --device %s --stop` to reset\n", os.Args[0], cfg.Device)
+func targeted(c *Config) bool {
+	return len(c.TargetIps) > 0 || len(c.TargetIps6) > 0 || len(c.TargetPorts) > 0 || len(c.TargetProtos) > 0
 }
 
-func teardown(t throttler, cfg *Config) {
-	if !t.exists() {
-		fmt.Println("It looks like the packet rules aren't setup")
-		os.Exit(1)
+// fastLane is whether the traffic that isn't targeted gets a pipe of its own,
+// limited to the default bandwidth, with dummynet.
+func fastLane(c *Config) bool {
+	return targeted(c) && c.DefaultBandwidth > 0
+}
+
+func setup(t throttler, cfg *Config) error {
+	if t.exists() {
+		return ErrAlreadySetup
 	}
 
-	if err := t.teardown(cfg); err != nil {
-		fmt.Println("Failed to stop packet controls")
-		os.Exit(1)
+	return t.setup(cfg)
+}
+
+func teardown(t throttler, cfg *Config) error {
+	if !t.exists() {
+		return ErrNotSetup
 	}
 
-	fmt.Println("Packet rules stopped...")
-	fmt.Printf("Run `%s` to double check\n", t.check())
-	fmt.Printf("Run `%s` to start\n", os.Args[0])
+	return t.teardown(cfg)
 }
 
-// Run executes the packet filter operation, either setting it up or tearing
-// it down.
-func Run(cfg *Config) {
+func newCommander(cfg *Config) commander {
 	dry = cfg.DryRun
-	var t throttler
-	var c commander
+	return commanderFor(cfg)
+}
 
+// commanderFor is newCommander without setting dry for the backends.
+func commanderFor(cfg *Config) commander {
 	if cfg.DryRun {
-		c = &dryRunCommander{}
-	} else {
-		c = &shellCommander{}
+		return &dryRunCommander{privilegeFor(cfg)}
 	}
+	return &shellCommander{privilegeFor(cfg)}
+}
 
-	switch runtime.GOOS {
-	case freebsd:
-		if cfg.Device == "" {
-			fmt.Println("Device not specified, unable to default to eth0 on FreeBSD.")
-			os.Exit(1)
+// args splits a command template into arguments before filling in its verbs,
+// so each value ends up in one argument whatever it contains.
+func args(template string, a ...interface{}) []string {
+	fields := strings.Fields(template)
+	for i, field := range fields {
+		if !strings.Contains(field, "%") {
+			continue
 		}
+		n := strings.Count(field, "%") - 2*strings.Count(field, "%%")
+		fields[i] = fmt.Sprintf(field, a[:n]...)
+		a = a[n:]
+	}
+	return fields
+}
 
-		t = &ipfwThrottler{c}
-	case darwin:
-		// Avoid OS version pinning and choose based on what's available
-		if c.commandExists(pfctl) {
-			t = &pfctlThrottler{c}
-		} else if c.commandExists(ipfw) {
-			t = &ipfwThrottler{c}
-		} else {
-			fmt.Println("Could not determine an appropriate firewall tool for OSX (tried pfctl, ipfw), exiting")
-			os.Exit(1)
+// concat joins commands and parts of them into a new one.
+func concat(parts ...[]string) []string {
+	cmd := []string{}
+	for _, part := range parts {
+		cmd = append(cmd, part...)
+	}
+	return cmd
+}
+
+// shellJoin renders cmd for a shell, quoting the arguments that need it.
+func shellJoin(cmd []string) string {
+	quoted := make([]string, len(cmd))
+	for i, arg := range cmd {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+func shellQuote(arg string) string {
+	if arg != "" && strings.IndexFunc(arg, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("@%+=:,./_-", r))
+	}) < 0 {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+// checkCommand renders the command that shows the packet rules of t.
+func checkCommand(t throttler, cfg *Config) string {
+	return shellJoin(concat(privilegeFor(cfg), t.check()))
+}
+
+// newThrottler picks the backend cfg asks for, or the default one for the
+// target OS, the running one unless cfg says otherwise. Only commanders that
+// don't run anything get throttlers for another OS.
+func newThrottler(cfg *Config, c commander) (throttler, error) {
+	_, live := c.(*shellCommander)
+
+	goos := runtime.GOOS
+	if cfg.TargetOS != "" {
+		if live && cfg.TargetOS != runtime.GOOS {
+			return nil, fmt.Errorf("Rules for %s can only be printed with --dry-run or exported", cfg.TargetOS)
+		}
+		goos = cfg.TargetOS
+	}
+
+	if cfg.Backend == "" {
+		b, err := defaultBackend(c, goos)
+		if err != nil {
+			return nil, err
 		}
+		return b.create(cfg, c, goos)
+	}
 
-		if cfg.Device == "" {
-			cfg.Device = "eth0"
+	b := findBackend(cfg.Backend)
+	if b == nil {
+		return nil, fmt.Errorf("Unknown backend %s, pick one of %s", cfg.Backend, strings.Join(Backends(), ", "))
+	}
+	if !contains(b.OSes, goos) {
+		if live || cfg.TargetOS != "" {
+			return nil, fmt.Errorf("The %s backend doesn't run on %s", cfg.Backend, goos)
 		}
+		goos = b.OSes[0]
+	}
+	return b.create(cfg, c, goos)
+}
 
-	case linux:
-		if cfg.Device == "" {
-			cfg.Device = "eth0"
+func contains(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
 		}
+	}
+	return false
+}
+
+// Setup installs the packet rules described by cfg, returning
+// ErrAlreadySetup if rules are already in place.
+func Setup(cfg *Config) error {
+	t, err := newThrottler(cfg, newCommander(cfg))
+	if err != nil {
+		return err
+	}
+	return setup(t, cfg)
+}
 
-		t = &tcThrottler{c}
-	default:
-		fmt.Printf("I don't support your OS: %s\n", runtime.GOOS)
+// Teardown removes the packet rules for cfg, returning ErrNotSetup if there
+// is nothing to remove.
+func Teardown(cfg *Config) error {
+	t, err := newThrottler(cfg, newCommander(cfg))
+	if err != nil {
+		return err
+	}
+	return teardown(t, cfg)
+}
+
+// Run executes the packet filter operation, either setting it up or tearing
+// it down.
+func Run(cfg *Config) {
+	t, err := newThrottler(cfg, newCommander(cfg))
+	if err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 	}
 
 	if !cfg.Stop {
-		setup(t, cfg)
+		if err := setup(t, cfg); err != nil {
+			if err == ErrAlreadySetup {
+				fmt.Println("It looks like the packet rules are already setup")
+			} else {
+				fmt.Println("I couldn't setup the packet rules:", err.Error())
+			}
+			os.Exit(1)
+		}
+
+		fmt.Println("Packet rules setup...")
+		fmt.Printf("Run `%s` to double check\n", checkCommand(t, cfg))
+		fmt.Printf("Run `%s --device %s --stop` to reset\n", os.Args[0], cfg.Device)
 	} else {
-		teardown(t, cfg)
+		if err := teardown(t, cfg); err != nil {
+			if err == ErrNotSetup {
+				fmt.Println("It looks like the packet rules aren't setup")
+			} else {
+				fmt.Println("Failed to stop packet controls:", err.Error())
+			}
+			os.Exit(1)
+		}
+
+		fmt.Println("Packet rules stopped...")
+		fmt.Printf("Run `%s` to double check\n", checkCommand(t, cfg))
+		fmt.Printf("Run `%s` to start\n", os.Args[0])
 	}
 }
 
-func (c *dryRunCommander) execute(cmd string) error {
-	fmt.Println(cmd)
+func (c *dryRunCommander) execute(cmd []string) error {
+	fmt.Println(shellJoin(concat(c.prefix, cmd)))
 	return nil
 }
 
-func (c *dryRunCommander) executeGetLines(cmd string) ([]string, error) {
-	fmt.Println(cmd)
+// executeGetLines prints nothing, reads change nothing and in a dry run they
+// read nothing either.
+func (c *dryRunCommander) executeGetLines(cmd []string) ([]string, error) {
 	return []string{}, nil
 }
 
+func (c *dryRunCommander) executeInput(cmd []string, input string) error {
+	fmt.Printf("%s <<'EOF'\n%s\nEOF\n", shellJoin(concat(c.prefix, cmd)), strings.TrimRight(input, "\n"))
+	return nil
+}
+
 func (c *dryRunCommander) commandExists(cmd string) bool {
 	return true
 }
 
-func (c *shellCommander) execute(cmd string) error {
-	fmt.Println(cmd)
-	return exec.Command("/bin/sh", "-c", cmd).Run()
+func (c *shellCommander) execute(cmd []string) error {
+	return c.run(cmd, nil)
 }
 
-func (c *shellCommander) executeGetLines(cmd string) ([]string, error) {
+func (c *shellCommander) executeInput(cmd []string, input string) error {
+	return c.run(cmd, strings.NewReader(input))
+}
+
+func (c *shellCommander) run(cmd []string, stdin io.Reader) error {
+	fmt.Println(shellJoin(concat(c.prefix, cmd)))
+	return c.runQuietly(cmd, stdin)
+}
+
+func (c *shellCommander) runQuietly(cmd []string, stdin io.Reader) error {
+	argv := concat(c.prefix, cmd)
+	var stdout, stderr bytes.Buffer
+	child := exec.Command(argv[0], argv[1:]...)
+	child.Stdin = stdin
+	child.Stdout = &stdout
+	child.Stderr = &stderr
+	return newCommandError(shellJoin(argv), child.Run(), stdout.String(), stderr.String())
+}
+
+func (c *shellCommander) executeGetLines(cmd []string) ([]string, error) {
+	argv := concat(c.prefix, cmd)
 	lines := []string{}
-	child := exec.Command("/bin/sh", "-c", cmd)
+	var stderr bytes.Buffer
+	child := exec.Command(argv[0], argv[1:]...)
+	child.Stderr = &stderr
 
 	out, err := child.StdoutPipe()
 	if err != nil {
@@ -169,7 +384,7 @@ func (c *shellCommander) executeGetLines(cmd string) ([]string, error) {
 
 	err = child.Start()
 	if err != nil {
-		return []string{}, err
+		return []string{}, newCommandError(shellJoin(argv), err, "", "")
 	}
 
 	scanner := bufio.NewScanner(out)
@@ -183,12 +398,20 @@ func (c *shellCommander) executeGetLines(cmd string) ([]string, error) {
 
 	err = child.Wait()
 	if err != nil {
-		return []string{}, err
+		return []string{}, newCommandError(shellJoin(argv), err, strings.Join(lines, "\n"), stderr.String())
 	}
 
 	return lines, nil
 }
 
+func (c *quietCommander) execute(cmd []string) error {
+	return c.runQuietly(cmd, nil)
+}
+
+func (c *quietCommander) executeInput(cmd []string, input string) error {
+	return c.runQuietly(cmd, strings.NewReader(input))
+}
+
 func (c *shellCommander) commandExists(cmd string) bool {
 	_, err := exec.LookPath(cmd)
 	return err == nil
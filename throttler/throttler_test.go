@@ -0,0 +1,98 @@
+package throttler
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestShellCommanderError(t *testing.T) {
+	c := &shellCommander{}
+	cmd := []string{"sh", "-c", "echo out; echo oops >&2; exit 3"}
+
+	for _, err := range []error{
+		c.execute(cmd),
+		func() error { _, err := c.executeGetLines(cmd); return err }(),
+	} {
+		var cerr *CommandError
+		if !errors.As(err, &cerr) {
+			t.Fatalf("Expected a CommandError, got %v", err)
+		}
+		if cerr.Command != shellJoin(cmd) || cerr.ExitCode != 3 || cerr.Stdout != "out\n" && cerr.Stdout != "out" || cerr.Stderr != "oops\n" {
+			t.Errorf("Unexpected details %+v", cerr)
+		}
+		if expected := "`sh -c 'echo out; echo oops >&2; exit 3'` failed: exit status 3: oops"; err.Error() != expected {
+			t.Errorf("Expected %q, got %q", expected, err.Error())
+		}
+	}
+
+	if err := c.execute([]string{"true"}); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
+
+func TestShellCommanderInput(t *testing.T) {
+	c := &shellCommander{}
+	err := c.executeInput([]string{"sh", "-c", `read line; test "$line" = "pass in all"`}, "pass in all\n")
+	if err != nil {
+		t.Errorf("Expected the input on stdin, got %s", err)
+	}
+}
+
+func TestNewThrottlerForeign(t *testing.T) {
+	cfg := &Config{TargetOS: darwin}
+	if th, err := newThrottler(cfg, &dryRunCommander{}); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	} else if _, ok := th.(*pfctlThrottler); !ok || cfg.Device != "eth0" {
+		t.Errorf("Expected pfctl on eth0 for darwin, got %T on %s", th, cfg.Device)
+	}
+
+	cfg = &Config{Backend: BackendIpfw, Device: "em0"}
+	if th, _ := newThrottler(cfg, newCmdRecorder()); th == nil {
+		t.Error("Expected ipfw from any OS when not running commands")
+	} else if _, ok := th.(*ipfwThrottler); !ok {
+		t.Errorf("Expected ipfw, got %T", th)
+	}
+
+	cfg = &Config{TargetOS: linux, Backend: BackendPfctl}
+	if _, err := newThrottler(cfg, &dryRunCommander{}); err == nil {
+		t.Error("Expected an error for pfctl on linux")
+	}
+
+	cfg = &Config{TargetOS: "plan9"}
+	if _, err := newThrottler(cfg, &shellCommander{}); err == nil || !strings.Contains(err.Error(), "--dry-run") {
+		t.Errorf("Expected running foreign rules to fail, got %v", err)
+	}
+}
+
+func TestArgs(t *testing.T) {
+	cmd := args(tcLinkNetem, "eth0; rm -rf /", "10:", 0x11, 0x101)
+	expected := []string{"dev", "eth0; rm -rf /", "parent", "10:11", "handle", "101:"}
+	if strings.Join(cmd, "|") != strings.Join(expected, "|") {
+		t.Errorf("Expected %q, got %q", expected, cmd)
+	}
+
+	loss := args(tcLoss, "0.10")
+	if loss[1] != "0.10%" {
+		t.Errorf("Expected a literal percent, got %q", loss)
+	}
+
+	if line := shellJoin(concat([]string{"sudo"}, loss, []string{"it's"})); line != `sudo loss 0.10% 'it'\''s'` {
+		t.Errorf("Unexpected quoting %s", line)
+	}
+}
+
+func TestCommandErrorWrapped(t *testing.T) {
+	r := newCmdRecorder()
+	failed := &CommandError{Command: pfctlEnableFirewall, ExitCode: 1, Stderr: "pfctl: /dev/pf: Permission denied", Err: errors.New("exit status 1")}
+	r.failures["pfctl -E"] = failed
+
+	err := (&pfctlThrottler{r}).setup(&defaultTestConfig)
+	var cerr *CommandError
+	if !errors.As(err, &cerr) || cerr.Stderr != failed.Stderr {
+		t.Fatalf("Expected to find the command error in %v", err)
+	}
+	if expected := "Could not enable firewall: `pfctl -E` failed: exit status 1: pfctl: /dev/pf: Permission denied"; err.Error() != expected {
+		t.Errorf("Expected %q, got %q", expected, err.Error())
+	}
+}
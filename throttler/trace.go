@@ -0,0 +1,325 @@
+package throttler
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mahimahiPacketBits is the size of the MTU-sized packet each line of a
+// Mahimahi trace is an opportunity to deliver.
+const mahimahiPacketBits = 1500 * 8
+
+// Sample is the shaping of the target class at a point in time. Fields that
+// are -1 leave the configured value in place.
+type Sample struct {
+	At         time.Duration
+	Bandwidth  int     // kbit/s
+	Latency    int     // ms
+	PacketLoss float64 // percent
+}
+
+// Source gives the shaping to apply over time. Sample returns false once the
+// source has nothing more to apply.
+type Source interface {
+	Sample(at time.Duration) (Sample, bool)
+}
+
+// Trace is a recorded series of samples, ordered by time, that lasts Length.
+type Trace struct {
+	Samples []Sample
+	Length  time.Duration
+	// Interpolate blends linearly between samples instead of stepping from
+	// one to the next.
+	Interpolate bool
+	// Loop starts the trace over when it reaches the end.
+	Loop bool
+}
+
+// Sample returns the shaping at time at into the trace.
+func (t *Trace) Sample(at time.Duration) (Sample, bool) {
+	if len(t.Samples) == 0 {
+		return Sample{}, false
+	}
+	if at >= t.Length {
+		if !t.Loop || t.Length <= 0 {
+			return Sample{}, false
+		}
+		at %= t.Length
+	}
+
+	i := len(t.Samples) - 1
+	for i > 0 && t.Samples[i].At > at {
+		i--
+	}
+	s := t.Samples[i]
+	if !t.Interpolate {
+		s.At = at
+		return s, true
+	}
+
+	// Blend towards the next sample, wrapping around to the first
+	next, end := t.Samples[0], t.Length+t.Samples[0].At
+	if i+1 < len(t.Samples) {
+		next, end = t.Samples[i+1], t.Samples[i+1].At
+	}
+	frac := 0.0
+	if end > s.At {
+		frac = float64(at-s.At) / float64(end-s.At)
+	}
+
+	return Sample{
+		At:         at,
+		Bandwidth:  int(math.Round(blend(float64(s.Bandwidth), float64(next.Bandwidth), frac))),
+		Latency:    int(math.Round(blend(float64(s.Latency), float64(next.Latency), frac))),
+		PacketLoss: blend(s.PacketLoss, next.PacketLoss, frac),
+	}, true
+}
+
+// blend interpolates between a and b, unless either is unset.
+func blend(a, b, frac float64) float64 {
+	if a < 0 || b < 0 {
+		return a
+	}
+	return a + (b-a)*frac
+}
+
+// ParseTraceCSV reads a trace of `time,bandwidth,latency,loss` rows, where the
+// time is in seconds (or a duration such as 1500ms), bandwidth in kbit/s,
+// latency in ms and loss in percent. Trailing columns may be left off and `-`
+// or an empty field leaves a value as configured. A bandwidth of 0 becomes
+// 100% loss. A header row and # comments are skipped. The last sample lasts
+// as long as the one before it.
+func ParseTraceCSV(r io.Reader) (*Trace, error) {
+	trace := &Trace{}
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+
+		at, err := parseTraceTime(fields[0])
+		if err != nil {
+			if len(trace.Samples) == 0 {
+				continue // Header
+			}
+			return nil, fmt.Errorf("line %d: invalid time %q", lineNo, fields[0])
+		}
+		if len(fields) > 4 {
+			return nil, fmt.Errorf("line %d: expected time and optionally bandwidth, latency and loss", lineNo)
+		}
+		if n := len(trace.Samples); n > 0 && at <= trace.Samples[n-1].At {
+			return nil, fmt.Errorf("line %d: samples must be in time order", lineNo)
+		}
+
+		s := Sample{At: at, Bandwidth: -1, Latency: -1, PacketLoss: -1}
+		for i, field := range fields[1:] {
+			if field == "" || field == "-" {
+				continue
+			}
+
+			switch i {
+			case 0:
+				s.Bandwidth, err = strconv.Atoi(strings.TrimSuffix(field, "kbit"))
+			case 1:
+				s.Latency, err = strconv.Atoi(strings.TrimSuffix(field, "ms"))
+			case 2:
+				s.PacketLoss, err = strconv.ParseFloat(strings.TrimSuffix(field, "%"), 64)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid value %q", lineNo, field)
+			}
+		}
+		if s.Bandwidth == 0 {
+			s.Bandwidth, s.PacketLoss = -1, 100
+		}
+		trace.Samples = append(trace.Samples, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	n := len(trace.Samples)
+	switch {
+	case n == 0:
+		return nil, errors.New("trace has no samples")
+	case n == 1:
+		trace.Length = trace.Samples[0].At + time.Second
+	default:
+		trace.Length = 2*trace.Samples[n-1].At - trace.Samples[n-2].At
+	}
+	return trace, nil
+}
+
+// WriteTraceCSV writes the samples of t in the format ParseTraceCSV reads.
+func WriteTraceCSV(w io.Writer, t *Trace) error {
+	if _, err := fmt.Fprintln(w, "time,bandwidth,latency,loss"); err != nil {
+		return err
+	}
+	for _, s := range t.Samples {
+		fields := []string{strconv.FormatFloat(s.At.Seconds(), 'f', -1, 64), "-", "-", "-"}
+		if s.Bandwidth >= 0 {
+			fields[1] = strconv.Itoa(s.Bandwidth)
+		}
+		if s.Latency >= 0 {
+			fields[2] = strconv.Itoa(s.Latency)
+		}
+		if s.PacketLoss >= 0 {
+			fields[3] = strconv.FormatFloat(s.PacketLoss, 'f', -1, 64)
+		}
+		if _, err := fmt.Fprintln(w, strings.Join(fields, ",")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseTraceTime(field string) (time.Duration, error) {
+	if secs, err := strconv.ParseFloat(field, 64); err == nil {
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+	return time.ParseDuration(field)
+}
+
+// ParseMahimahi reads a Mahimahi packet delivery trace, one millisecond
+// timestamp per line for each MTU-sized packet the link can deliver, and
+// turns it into a bandwidth sample for each bin. Bins without any delivery
+// opportunities become 100% loss. Like in Mahimahi, the trace lasts until its
+// last timestamp.
+func ParseMahimahi(r io.Reader, bin time.Duration) (*Trace, error) {
+	if bin < time.Millisecond {
+		return nil, errors.New("bin must be at least a millisecond")
+	}
+
+	counts := []int{}
+	last := -1
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		ms, err := strconv.Atoi(line)
+		if err != nil || ms < 0 {
+			return nil, fmt.Errorf("line %d: invalid timestamp %q", lineNo, line)
+		}
+		if ms < last {
+			return nil, fmt.Errorf("line %d: timestamps must be in order", lineNo)
+		}
+		last = ms
+
+		// A delivery at the very end belongs to the last bin
+		b := int(time.Duration(ms) * time.Millisecond / bin)
+		if b > 0 && time.Duration(ms)*time.Millisecond%bin == 0 {
+			b--
+		}
+		for len(counts) <= b {
+			counts = append(counts, 0)
+		}
+		counts[b]++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if last <= 0 {
+		return nil, errors.New("trace has no delivery opportunities after time 0")
+	}
+
+	trace := &Trace{Length: time.Duration(last) * time.Millisecond}
+	for i, count := range counts {
+		s := Sample{At: time.Duration(i) * bin, Bandwidth: -1, Latency: -1, PacketLoss: -1}
+		if count == 0 {
+			s.PacketLoss = 100
+		} else {
+			s.Bandwidth = int(float64(count*mahimahiPacketBits) / 1000 / bin.Seconds())
+		}
+		trace.Samples = append(trace.Samples, s)
+	}
+	return trace, nil
+}
+
+// Replay applies the shaping from src to the target class every tick, in
+// place where the throttler can, until src runs out or ctx is done. Samples
+// apply to cfg, so what they leave out stays as configured rather than as the
+// last sample had it. The rules for cfg shaped like the first sample must
+// already be set up. current, if not nil, follows the config in effect.
+func Replay(ctx context.Context, cfg *Config, src Source, tick time.Duration, current *Applied) error {
+	t, err := newThrottler(cfg, newCommander(cfg))
+	if err != nil {
+		return err
+	}
+	return replay(ctx, t, cfg, src, tick, current, time.Now, time.After)
+}
+
+func replay(ctx context.Context, t throttler, cfg *Config, src Source, tick time.Duration, current *Applied, now func() time.Time, after func(time.Duration) <-chan time.Time) error {
+	if len(cfg.Links) > 0 || cfg.Partition != "" {
+		return errors.New("Replaying only shapes the target class, not latency matrices or partitions")
+	}
+	if tick <= 0 {
+		return errors.New("Tick must be positive")
+	}
+
+	first, ok := src.Sample(0)
+	if !ok {
+		return nil
+	}
+	applied := *ApplySample(cfg, first)
+	start := now()
+	for {
+		s, ok := src.Sample(now().Sub(start))
+		if !ok {
+			return nil
+		}
+
+		next := ApplySample(cfg, s)
+		if next.TargetBandwidth != applied.TargetBandwidth || next.Latency != applied.Latency || next.PacketLoss != applied.PacketLoss {
+			if err := change(t, next); err != nil {
+				return err
+			}
+			applied = *next
+			current.set(next)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-after(tick):
+		}
+	}
+}
+
+// ApplySample returns a copy of cfg shaped like s.
+func ApplySample(cfg *Config, s Sample) *Config {
+	next := *cfg
+	if s.Bandwidth >= 0 {
+		next.TargetBandwidth = s.Bandwidth
+	}
+	if s.Latency >= 0 {
+		next.Latency = s.Latency
+	}
+	if s.PacketLoss >= 0 {
+		next.PacketLoss = s.PacketLoss
+	}
+	return &next
+}
@@ -0,0 +1,198 @@
+package throttler
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTraceCSV = `time,bandwidth,latency,loss
+# Drive test
+0, 5000, 40, 0
+1.5, 2000, 80
+3s, 0, -, 1%
+`
+
+func TestParseTraceCSV(t *testing.T) {
+	trace, err := ParseTraceCSV(strings.NewReader(testTraceCSV))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	expected := []Sample{
+		{At: 0, Bandwidth: 5000, Latency: 40, PacketLoss: 0},
+		{At: 1500 * time.Millisecond, Bandwidth: 2000, Latency: 80, PacketLoss: -1},
+		{At: 3 * time.Second, Bandwidth: -1, Latency: -1, PacketLoss: 100},
+	}
+	if !reflect.DeepEqual(trace.Samples, expected) {
+		t.Errorf("Expected %v, got %v", expected, trace.Samples)
+	}
+	if trace.Length != 4500*time.Millisecond {
+		t.Errorf("Expected the trace to last 4.5s, got %s", trace.Length)
+	}
+}
+
+func TestParseTraceCSVErrors(t *testing.T) {
+	for _, bad := range []string{
+		"",
+		"0,100\n1,fast\n",
+		"1,100\n0,200\n",
+		"0,100,10,1,extra\n",
+	} {
+		if _, err := ParseTraceCSV(strings.NewReader(bad)); err == nil {
+			t.Errorf("Expected an error parsing %q", bad)
+		}
+	}
+}
+
+func TestParseMahimahi(t *testing.T) {
+	// Two opportunities in the first 100ms, none in the next and one at the end
+	trace, err := ParseMahimahi(strings.NewReader("0\n50\n\n300\n"), 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	expected := []Sample{
+		{At: 0, Bandwidth: 240, Latency: -1, PacketLoss: -1},
+		{At: 100 * time.Millisecond, Bandwidth: -1, Latency: -1, PacketLoss: 100},
+		{At: 200 * time.Millisecond, Bandwidth: 120, Latency: -1, PacketLoss: -1},
+	}
+	if !reflect.DeepEqual(trace.Samples, expected) {
+		t.Errorf("Expected %v, got %v", expected, trace.Samples)
+	}
+	if trace.Length != 300*time.Millisecond {
+		t.Errorf("Expected the trace to last 300ms, got %s", trace.Length)
+	}
+
+	if _, err := ParseMahimahi(strings.NewReader("10\n5\n"), 100*time.Millisecond); err == nil {
+		t.Error("Expected an error for out of order timestamps")
+	}
+}
+
+func TestTraceSample(t *testing.T) {
+	trace := &Trace{
+		Samples: []Sample{
+			{At: 0, Bandwidth: 1000, Latency: 10, PacketLoss: -1},
+			{At: 10 * time.Second, Bandwidth: 2000, Latency: -1, PacketLoss: -1},
+		},
+		Length: 20 * time.Second,
+	}
+
+	s, _ := trace.Sample(5 * time.Second)
+	if s.Bandwidth != 1000 || s.Latency != 10 {
+		t.Errorf("Expected to step to the first sample, got %v", s)
+	}
+
+	trace.Interpolate = true
+	s, _ = trace.Sample(5 * time.Second)
+	if s.Bandwidth != 1500 || s.Latency != 10 {
+		t.Errorf("Expected to blend bandwidth halfway, got %v", s)
+	}
+	s, _ = trace.Sample(15 * time.Second)
+	if s.Bandwidth != 1500 {
+		t.Errorf("Expected to blend back towards the first sample, got %v", s)
+	}
+
+	if _, ok := trace.Sample(25 * time.Second); ok {
+		t.Error("Expected the trace to end")
+	}
+	trace.Loop = true
+	s, ok := trace.Sample(25 * time.Second)
+	if !ok || s.Bandwidth != 1500 || s.At != 5*time.Second {
+		t.Errorf("Expected the trace to loop, got %v", s)
+	}
+}
+
+// fakeClock advances time by each tick waited for, cancelling after n ticks.
+type fakeClock struct {
+	now    time.Time
+	ticks  int
+	n      int
+	cancel func()
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.ticks++
+	if c.ticks > c.n {
+		c.cancel()
+		return nil
+	}
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func TestTcReplay(t *testing.T) {
+	r := newCmdRecorder()
+	th := &tcThrottler{r}
+	cfg := defaultTestConfig
+	trace := &Trace{
+		Samples: []Sample{
+			{At: 0, Bandwidth: 1000, Latency: -1, PacketLoss: -1},
+			{At: 2 * time.Second, Bandwidth: 500, Latency: 20, PacketLoss: -1},
+		},
+		Length: 4 * time.Second,
+		Loop:   true,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := &fakeClock{now: time.Unix(0, 0), n: 4, cancel: cancel}
+	err := replay(ctx, th, &cfg, trace, time.Second, nil, clock.Now, clock.After)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// Nothing to change at 0s, 1s and 3s
+	r.verifyCommands(t, []string{
+		"tc qdisc show dev eth0",
+		"tc class change dev eth0 parent 10: classid 10:10 htb rate 500kbit",
+		"tc qdisc change dev eth0 parent 10:10 handle 100: netem delay 20ms rate 500kbit loss 0.10%",
+		"tc qdisc show dev eth0",
+		"tc class change dev eth0 parent 10: classid 10:10 htb rate 1000kbit",
+		"tc qdisc change dev eth0 parent 10:10 handle 100: netem rate 1000kbit loss 0.10%",
+	})
+}
+
+func TestTcReplayAfterOutage(t *testing.T) {
+	// Loss from an outage at the start doesn't outlast it
+	r := newCmdRecorder()
+	cfg := defaultTestConfig
+	trace := &Trace{
+		Samples: []Sample{
+			{At: 0, Bandwidth: -1, Latency: -1, PacketLoss: 100},
+			{At: time.Second, Bandwidth: 1000, Latency: -1, PacketLoss: -1},
+			{At: 2 * time.Second, Bandwidth: 2000, Latency: -1, PacketLoss: -1},
+		},
+		Length: 3 * time.Second,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	clock := &fakeClock{now: time.Unix(0, 0), n: 2, cancel: cancel}
+	replay(ctx, &tcThrottler{r}, &cfg, trace, time.Second, nil, clock.Now, clock.After)
+	r.verifyCommands(t, []string{
+		"tc qdisc show dev eth0",
+		"tc class change dev eth0 parent 10: classid 10:10 htb rate 1000kbit",
+		"tc qdisc change dev eth0 parent 10:10 handle 100: netem rate 1000kbit loss 0.10%",
+		"tc qdisc show dev eth0",
+		"tc class change dev eth0 parent 10: classid 10:10 htb rate 2000kbit",
+		"tc qdisc change dev eth0 parent 10:10 handle 100: netem rate 2000kbit loss 0.10%",
+	})
+}
+
+func TestReplayStopsAtEnd(t *testing.T) {
+	r := newCmdRecorder()
+	cfg := defaultTestConfig
+	trace := &Trace{Samples: []Sample{{At: 0, Bandwidth: 1000, Latency: -1, PacketLoss: -1}}, Length: time.Second}
+
+	clock := &fakeClock{now: time.Unix(0, 0), n: 10, cancel: func() {}}
+	replay(context.Background(), &tcThrottler{r}, &cfg, trace, time.Second, nil, clock.Now, clock.After)
+	if clock.ticks != 1 {
+		t.Errorf("Expected replay to stop when the trace ends, waited %d ticks", clock.ticks)
+	}
+}
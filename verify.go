@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/tylertreat/comcast/probe"
+	"github.com/tylertreat/comcast/throttler"
+)
+
+// How far apart probes are sent when verifying.
+const verifySpacing = 20 * time.Millisecond
+
+// verifyLocal is the --verify target that has comcast probe an echo endpoint
+// it serves itself.
+const verifyLocal = "local"
+
+// localEcho serves echo on a free loopback port until ctx is done and returns
+// its address, exiting if it can't.
+func localEcho(ctx context.Context, cfg *throttler.Config) string {
+	addr, err := probe.StartEcho(ctx, "127.0.0.1:0")
+	if err != nil {
+		fmt.Println("Couldn't start an echo endpoint to verify against:", err)
+		os.Exit(1)
+	}
+
+	if iface, err := net.InterfaceByName(cfg.Device); err != nil || iface.Flags&net.FlagLoopback == 0 {
+		fmt.Println("Warning: the echo endpoint is on the loopback device, so only packet rules on it (e.g. --device lo) will affect it")
+	}
+	return addr
+}
+
+// verifier checks the packet rules took effect by probing a target before and
+// after they're set up.
+type verifier struct {
+	target    string
+	p         probe.Prober
+	probes    int
+	tolerance time.Duration
+	baseline  probe.Stats
+}
+
+// newVerifier measures the link to target before the packet rules are set up.
+func newVerifier(cfg *throttler.Config, target string, p probe.Prober, probes int, tolerance time.Duration) *verifier {
+	v := &verifier{target: target, p: p, probes: probes, tolerance: tolerance}
+	if !v.covered(cfg) {
+		fmt.Printf("Warning: %s isn't one of the target addresses, so the packet rules won't affect it\n", target)
+	}
+
+	fmt.Printf("Measuring the link to %s before setting up the packet rules...\n", target)
+	v.baseline = probe.Measure(p, probes, verifySpacing, time.Second)
+	return v
+}
+
+// check measures the link again and reports whether it matches cfg.
+func (v *verifier) check(cfg *throttler.Config) bool {
+	latency, loss := v.expected(cfg)
+	timeout := time.Second + 2*latency
+	if _, tcp := v.p.(*probe.TCPConnect); tcp && v.baseline.RTT+latency >= probe.SYNRetransmit {
+		fmt.Printf("TCP connects to %s can't tell a round trip of %s from a lost SYN, --verify with --verify-method icmp or udp instead\n", v.target, v.baseline.RTT+latency)
+		return false
+	}
+
+	fmt.Printf("Measuring the link to %s with the packet rules...\n", v.target)
+	measured := probe.Measure(v.p, v.probes, verifySpacing, timeout)
+
+	r := probe.Verify(v.baseline, measured, latency, loss, v.tolerance)
+	r.Write(os.Stdout)
+	if !r.OK() {
+		fmt.Println("The packet rules didn't take effect as requested. Check the device is the one traffic to the target leaves through, and run `comcast doctor` for missing kernel modules or tools.")
+		return false
+	}
+
+	fmt.Println("Verified the packet rules took effect")
+	return true
+}
+
+// expected returns the latency and loss the rules should add for the target.
+func (v *verifier) expected(cfg *throttler.Config) (time.Duration, float64) {
+	if cfg.Partition != "" {
+		return 0, 100
+	}
+
+	if len(cfg.Links) > 0 {
+		ip := v.ip()
+		for _, link := range cfg.Links {
+			if addrContains(link.Dest, ip) {
+				return time.Duration(link.Latency) * time.Millisecond, link.PacketLoss
+			}
+		}
+		return 0, 0
+	}
+
+	latency := time.Duration(0)
+	if cfg.Latency > 0 {
+		latency = time.Duration(cfg.Latency) * time.Millisecond
+	}
+	return latency, cfg.PacketLoss
+}
+
+// covered reports whether the rules apply to traffic to the target.
+func (v *verifier) covered(cfg *throttler.Config) bool {
+	addrs := append(append([]string{}, cfg.TargetIps...), cfg.TargetIps6...)
+	for _, link := range cfg.Links {
+		addrs = append(addrs, link.Dest)
+	}
+	if len(addrs) == 0 {
+		return true
+	}
+
+	ip := v.ip()
+	for _, addr := range addrs {
+		if addrContains(addr, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *verifier) ip() net.IP {
+	host := v.target
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return nil
+	}
+	return ips[0]
+}
+
+func addrContains(addr string, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if _, n, err := net.ParseCIDR(addr); err == nil {
+		return n.Contains(ip)
+	}
+	return net.ParseIP(addr).Equal(ip)
+}